@@ -19,6 +19,7 @@ package atatus
 import (
 	"net/http"
 	"os"
+	"time"
 )
 
 type configuration struct {
@@ -137,7 +138,8 @@ func newConfiguration(service tracerService) configuration {
 	c.Analytics = service.Analytics
 	c.TraceThreshold = service.TraceThreshold
 	c.NotifyHost = service.NotifyHost
-	c.NotifyInterval = 60
+	c.NotifyProxy = service.NotifyProxy
+	c.NotifyInterval = int(defaultNotifyInterval / time.Second)
 	c.Hostname, _ = os.Hostname()
 	c.CollectErrors = true
 	c.IgnoreStatusCodes = []int{404}
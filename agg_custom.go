@@ -0,0 +1,107 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"go.atatus.com/agent/internal/wildcard"
+)
+
+const (
+	// aggCustomDataMaxKeys is the maximum number of custom data
+	// entries sent with an error, trace, request or HTTP failure.
+	aggCustomDataMaxKeys = 64
+
+	// aggCustomDataMaxValueSize is the maximum size in bytes of the
+	// JSON encoding of a custom data value. Larger values are sent
+	// as truncated strings.
+	aggCustomDataMaxValueSize = 2048
+)
+
+// buildAggCustomData returns the custom data sent to Atatus for ctx,
+// made up of the global labels, the context's labels and its custom
+// context. Later entries take precedence over earlier ones with the
+// same key. Values whose keys match the sanitized field names are
+// redacted. buildAggCustomData returns nil if there is no custom data.
+func buildAggCustomData(ctx *Context) map[string]interface{} {
+	n := len(globalLabels) + len(ctx.model.Tags) + len(ctx.model.Custom)
+	if n == 0 {
+		return nil
+	}
+	if n > aggCustomDataMaxKeys {
+		n = aggCustomDataMaxKeys
+	}
+	custom := make(map[string]interface{}, n)
+	for _, l := range globalLabels {
+		setAggCustomData(custom, l.Key, l.Value, ctx.sanitizedFieldNames)
+	}
+	for _, l := range ctx.model.Tags {
+		setAggCustomData(custom, l.Key, l.Value, ctx.sanitizedFieldNames)
+	}
+	for _, c := range ctx.model.Custom {
+		setAggCustomData(custom, c.Key, sanitizeAggCustomValue(c.Value), ctx.sanitizedFieldNames)
+	}
+	return custom
+}
+
+func setAggCustomData(custom map[string]interface{}, key string, value interface{}, matchers wildcard.Matchers) {
+	if _, ok := custom[key]; !ok && len(custom) >= aggCustomDataMaxKeys {
+		return
+	}
+	if matchers.MatchAny(key) {
+		value = redacted
+	}
+	custom[key] = value
+}
+
+// sanitizeAggCustomValue returns v in a form that can always be encoded
+// in an Atatus payload. Basic values are handled as labels are, and other
+// values are encoded as JSON up front, so later changes to v and encoding
+// failures cannot affect the payload.
+func sanitizeAggCustomValue(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, bool, string, float32, float64,
+		uint, uint8, uint16, uint32, uint64,
+		int, int8, int16, int32, int64:
+		return makeLabelValue(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return truncateString(fmt.Sprint(v))
+	}
+	if len(data) > aggCustomDataMaxValueSize {
+		return truncateString(string(data))
+	}
+	return json.RawMessage(data)
+}
+
+// aggGlobalLabelTags returns the global labels as
+// "key:value" tags, sorted for a stable payload header.
+func aggGlobalLabelTags() []string {
+	if len(globalLabels) == 0 {
+		return nil
+	}
+	tags := make([]string, len(globalLabels))
+	for i, l := range globalLabels {
+		tags[i] = l.Key + ":" + l.Value
+	}
+	sort.Strings(tags)
+	return tags
+}
@@ -0,0 +1,104 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.atatus.com/agent/model"
+)
+
+func TestBuildAggCustomData(t *testing.T) {
+	defer func(labels model.StringMap) { globalLabels = labels }(globalLabels)
+	globalLabels = model.StringMap{{Key: "region", Value: "us"}, {Key: "tenant", Value: "global"}}
+
+	var ctx Context
+	ctx.sanitizedFieldNames = initialSanitizedFieldNames()
+	ctx.SetLabel("tenant", "acme")
+	ctx.SetLabel("beta", true)
+	ctx.SetCustom("password", "hunter2")
+	ctx.SetCustom("flags", map[string]int{"a": 1})
+	ctx.SetCustom("func", func() {})
+	ctx.SetCustom("large", strings.Repeat("x", 2*aggCustomDataMaxValueSize))
+
+	custom := buildAggCustomData(&ctx)
+	data, err := json.Marshal(custom)
+	require.NoError(t, err)
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "us", decoded["region"])
+	assert.Equal(t, "acme", decoded["tenant"])
+	assert.Equal(t, true, decoded["beta"])
+	assert.Equal(t, redacted, decoded["password"])
+	assert.Equal(t, map[string]interface{}{"a": float64(1)}, decoded["flags"])
+	assert.IsType(t, "", decoded["func"])
+	assert.Len(t, decoded["large"], stringLengthLimit)
+}
+
+func TestBuildAggCustomDataLimit(t *testing.T) {
+	defer func(labels model.StringMap) { globalLabels = labels }(globalLabels)
+	globalLabels = nil
+	assert.Nil(t, buildAggCustomData(&Context{}))
+
+	var ctx Context
+	for i := 0; i < aggCustomDataMaxKeys*2; i++ {
+		ctx.SetCustom(fmt.Sprint(i), i)
+	}
+	// Later values for existing keys still take precedence.
+	ctx.SetCustom("0", "last")
+	custom := buildAggCustomData(&ctx)
+	assert.Len(t, custom, aggCustomDataMaxKeys)
+	assert.Equal(t, "last", custom["0"])
+}
+
+func TestAggregatorCustomData(t *testing.T) {
+	defer func(labels model.StringMap) { globalLabels = labels }(globalLabels)
+	globalLabels = model.StringMap{{Key: "region", Value: "eu"}}
+
+	server := newAggRecorderServer()
+	defer server.Close()
+
+	tracer := newAggTestTracer(t, server.URL)
+	defer tracer.Close()
+
+	tx := tracer.StartTransaction("name", "type")
+	tx.Context.SetLabel("tenant", "acme")
+	e := tracer.NewError(errors.New("boom"))
+	e.SetTransaction(tx)
+	e.Context.SetLabel("feature", "checkout")
+	e.Send()
+	tx.End()
+	tracer.Flush(nil)
+
+	var payloads []errPayload
+	server.payloads(t, errorRelativePath, &payloads)
+	require.Len(t, payloads, 1)
+	assert.Equal(t, []string{"region:eu"}, payloads[0].Tags)
+	require.Len(t, payloads[0].E, 1)
+	assert.Equal(t, map[string]interface{}{
+		"region":  "eu",
+		"feature": "checkout",
+	}, payloads[0].E[0].Custom)
+}
@@ -0,0 +1,178 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// exportModeFile writes payloads to a size-rotated file.
+	exportModeFile = "file"
+
+	// exportModeStdout writes payloads to standard output.
+	exportModeStdout = "stdout"
+
+	// exportFileMaxBackups is the number of rotated export
+	// files kept, named <file>.1 (newest) to <file>.N.
+	exportFileMaxBackups = 3
+)
+
+// exportHostinfoResponse is the response to hostinfo payloads in the export
+// modes. With no server to enable features, analytics and percentiles are
+// enabled so that every kind of payload can be inspected.
+var exportHostinfoResponse = []byte(`{"analytics": true, "capturePercentiles": true}`)
+
+// exportRecord is a payload written by exportPayloadSink,
+// tagged with the path of the endpoint it would be sent to.
+type exportRecord struct {
+	Endpoint  string          `json:"endpoint"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// exportPayloadSink is a PayloadSink which writes payloads as
+// newline-delimited JSON, in place of sending them to Atatus.
+type exportPayloadSink struct {
+	mu sync.Mutex
+	w  io.Writer
+
+	// path, file and size are set in the file export mode. When
+	// writing a record would grow the file beyond maxSize bytes,
+	// the file is rotated first.
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+	closed  bool
+}
+
+// newExportPayloadSink returns a new exportPayloadSink for the given export
+// mode, writing to the file at path in the file mode.
+func newExportPayloadSink(mode, path string, maxSize int64) (*exportPayloadSink, error) {
+	switch mode {
+	case exportModeStdout:
+		return &exportPayloadSink{w: os.Stdout}, nil
+	case exportModeFile:
+		s := &exportPayloadSink{path: path, maxSize: maxSize}
+		if err := s.openFile(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, errors.Errorf("invalid export mode %q", mode)
+}
+
+func (s *exportPayloadSink) SendPayload(ctx context.Context, p Payload) (*PayloadResponse, error) {
+	record, err := json.Marshal(exportRecord{
+		Endpoint:  string(p.Kind),
+		Timestamp: time.Now().UTC(),
+		Payload:   p.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	record = append(record, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("export file closed")
+	}
+	if s.path != "" {
+		if s.file == nil {
+			// A previous rotation failed.
+			if err := s.openFile(); err != nil {
+				return nil, err
+			}
+		} else if s.size > 0 && s.size+int64(len(record)) > s.maxSize {
+			if err := s.rotate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	n, err := s.w.Write(record)
+	s.size += int64(n)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &PayloadResponse{StatusCode: http.StatusOK}
+	if p.Kind == PayloadHostinfo {
+		resp.Body = exportHostinfoResponse
+	}
+	return resp, nil
+}
+
+// close closes the export file, if any.
+func (s *exportPayloadSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *exportPayloadSink) openFile() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.w = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate renames the export file to <path>.1, shifting the existing
+// backups along and removing the oldest, and opens a new export file.
+func (s *exportPayloadSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	for i := exportFileMaxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", s.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", s.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.openFile()
+}
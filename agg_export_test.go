@@ -0,0 +1,130 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readExportRecords(t *testing.T, path string) []exportRecord {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []exportRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record exportRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestExportPayloadSinkRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atatus-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export.ndjson")
+
+	sink, err := newExportPayloadSink(exportModeFile, path, 200)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		resp, err := sink.SendPayload(context.Background(), Payload{
+			Kind: PayloadError,
+			Data: []byte(`{"errors":[]}`),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+	resp, err := sink.SendPayload(context.Background(), Payload{Kind: PayloadHostinfo, Data: []byte(`{}`)})
+	require.NoError(t, err)
+	assert.Equal(t, exportHostinfoResponse, resp.Body)
+	require.NoError(t, sink.close())
+
+	_, err = sink.SendPayload(context.Background(), Payload{Kind: PayloadError, Data: []byte(`{}`)})
+	assert.Error(t, err)
+
+	files, err := filepath.Glob(path + "*")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{path, path + ".1", path + ".2", path + ".3"}, files)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.True(t, info.Size() <= 200, "%s: %d bytes", file, info.Size())
+		for _, record := range readExportRecords(t, file) {
+			assert.Contains(t, []string{errorRelativePath, hostinfoRelativePath}, record.Endpoint)
+		}
+	}
+	records := readExportRecords(t, path)
+	assert.Equal(t, hostinfoRelativePath, records[len(records)-1].Endpoint)
+}
+
+func TestTracerExportModeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atatus-export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export.ndjson")
+
+	// Payloads are exported without a license key,
+	// as in air-gapped environments.
+	os.Unsetenv(envLicenseKey)
+	tracer, err := NewTracerOptions(TracerOptions{
+		ServiceName: "export_test",
+		ExportMode:  "file",
+		ExportFile:  path,
+	})
+	require.NoError(t, err)
+	tracer.StartTransaction("name", "type").End()
+	tracer.Close()
+
+	records := readExportRecords(t, path)
+	require.Len(t, records, 3)
+	assert.Equal(t, hostinfoRelativePath, records[0].Endpoint)
+	assert.Equal(t, txnRelativePath, records[1].Endpoint)
+	assert.Equal(t, metricsRelativePath, records[2].Endpoint)
+	for _, record := range records {
+		assert.NotContains(t, string(record.Payload), "licenseKey")
+	}
+
+	var payload txnPayload
+	require.NoError(t, json.Unmarshal(records[1].Payload, &payload))
+	assert.Equal(t, "export_test", payload.AppName)
+	require.Len(t, payload.T, 1)
+	assert.Equal(t, "name", payload.T[0].Name)
+}
+
+func TestInitialExportMode(t *testing.T) {
+	os.Setenv(envExportMode, "STDOUT")
+	defer os.Unsetenv(envExportMode)
+	mode, err := initialExportMode()
+	require.NoError(t, err)
+	assert.Equal(t, exportModeStdout, mode)
+
+	_, err = NewTracerOptions(TracerOptions{ExportMode: "syslog"})
+	assert.EqualError(t, err, `invalid ATATUS_EXPORT_MODE value "syslog", expected "file", "stdout" or "otlp"`)
+}
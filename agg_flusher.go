@@ -18,16 +18,23 @@ package atatus
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
-	"strings"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
+
+	"go.atatus.com/agent/model"
 	"go.atatus.com/agent/stacktrace"
+	"go.atatus.com/agent/transport"
 )
 
 const (
@@ -70,10 +77,57 @@ type response struct {
 	StatusCode          int
 	Response400         response400
 	HostinfoResponse200 hostinfoResponse200
+
+	// RetryAfter holds the delay requested by the
+	// response's Retry-After header, if any.
+	RetryAfter time.Duration
 }
 
-var activeAggregator bool
-var activeAggregatorCount int
+const (
+	// hostinfoRefreshInterval is the interval at which hostinfo is
+	// sent, and the server-provided features are refreshed.
+	hostinfoRefreshInterval = 30 * time.Minute
+
+	// activeAggregatorTimeout is the amount of time an aggregator is
+	// reported as active after it last started sending data.
+	activeAggregatorTimeout = 2 * time.Hour
+)
+
+// defaultNotifyTimeout is the request timeout used for sending
+// aggregated data when the HTTP client cannot be configured from
+// the environment.
+const defaultNotifyTimeout = 30 * time.Second
+
+// newNotifyHTTPClient returns the http.Client used for sending aggregated
+// data to the notify host.
+//
+// The client is configured the same way as transport.HTTPTransport's, using
+// the ATATUS_SERVER_TIMEOUT, ATATUS_SERVER_CERT, ATATUS_VERIFY_SERVER_CERT and
+// ATATUS_SERVER_CA_CERT_FILE environment variables. Requests are sent through
+// notifyProxy if it is non-empty, and otherwise through the proxy defined by
+// the HTTPS_PROXY and HTTP_PROXY environment variables.
+func newNotifyHTTPClient(notifyProxy string) (*http.Client, error) {
+	t, err := transport.NewHTTPTransport()
+	if err != nil {
+		return nil, err
+	}
+	client := t.Client
+	if notifyProxy != "" {
+		proxyURL, err := url.Parse(notifyProxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", envNotifyProxy)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, errors.Errorf("invalid %s scheme %q", envNotifyProxy, proxyURL.Scheme)
+		}
+		if tr, ok := client.Transport.(*http.Transport); ok {
+			tr.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+	return client, nil
+}
 
 func (agg *aggregator) sendToBackend(licenseKey, path string, d interface{}) (*response, error) {
 	if agg.logger != nil {
@@ -81,10 +135,12 @@ func (agg *aggregator) sendToBackend(licenseKey, path string, d interface{}) (*r
 	}
 
 	if path != hostinfoRelativePath {
-		if activeAggregator == false {
-			activeAggregator = true
-			activeAggregatorCount = 0
+		agg.mu.Lock()
+		if agg.active == false {
+			agg.active = true
+			agg.activeSince = time.Now()
 		}
+		agg.mu.Unlock()
 	}
 
 	data, err := json.Marshal(d)
@@ -95,103 +151,121 @@ func (agg *aggregator) sendToBackend(licenseKey, path string, d interface{}) (*r
 		return nil, err
 	}
 
-	var host string
-	if path == analyticsTxnRelativePath {
-		if agg.service.NotifyHost == "https://apm-rx.atatus.com" ||
-			agg.service.NotifyHost == "https://apm-rx-collector.atatus.com" {
-			host = "https://an-rx.atatus.com"
-		} else {
-			host = agg.service.NotifyHost
+	r, err := agg.sendData(licenseKey, path, data)
+	if agg.retry != nil && path != hostinfoRelativePath && shouldRetrySend(r, err) {
+		var retryAfter time.Duration
+		if r != nil {
+			retryAfter = r.RetryAfter
 		}
-	} else {
-		host = agg.service.NotifyHost
+		agg.retry.push(licenseKey, path, data, retryAfter)
 	}
+	return r, err
+}
 
-	notifyHost := strings.TrimSuffix(host, "/") + path
+// resend resends a payload queued for retrying, reporting whether the
+// payload should be removed from the queue, and if not, the delay
+// requested by the server before retrying it.
+func (agg *aggregator) resend(p *notifyPayload) (bool, time.Duration) {
+	if agg.logger != nil {
+		agg.logger.Debugf("Retrying payload for %s\n", p.path)
+	}
+	r, err := agg.sendData(p.licenseKey, p.path, p.data)
+	if !shouldRetrySend(r, err) {
+		return true, 0
+	}
+	if r != nil {
+		return false, r.RetryAfter
+	}
+	return false, 0
+}
 
-	req, err := http.NewRequest("POST", notifyHost, bytes.NewBuffer(data))
-	req.Header.Set("Content-Type", "application/json")
+// shouldRetrySend reports whether a payload should be retried, given the
+// result of sending it. Payloads are retried on network and server errors,
+// and when rate limited.
+func shouldRetrySend(r *response, err error) bool {
+	return r == nil || r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500
+}
 
-	q := req.URL.Query()
-	q.Add("license_key", agg.service.LicenseKey)
-	q.Add("agent_name", agentLanguage)
-	q.Add("agent_version", AgentVersion)
-	req.URL.RawQuery = q.Encode()
+// parseRetryAfter returns the delay requested by a Retry-After header
+// value, given in either seconds or as an HTTP date, or zero if the
+// value is empty or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
 
-	if agg.logger != nil {
-		agg.logger.Debugf("Sending to URL: %+v\n", req.URL)
-	}
-
-	var client *http.Client
-
-	// if agg.service.NotifyProxy != "" {
-	// 	if agg.logger != nil {
-	// 		agg.logger.Debugf("Notify Proxy: %s\n", agg.service.NotifyProxy)
-	// 	}
-	// 	proxyURL, err := url.Parse(agg.service.NotifyProxy)
-	// 	if err != nil {
-	// 		if agg.logger != nil {
-	// 			agg.logger.Errorf("Notify Proxy Parsing Failed: %s Error: %s\n", agg.service.NotifyProxy, err.Error())
-	// 		}
-	// 		return nil, err
-	// 	}
-	// 	if agg.logger != nil {
-	// 		agg.logger.Debugf("Notify Proxy Details: %+v, Scheme: %s\n", proxyURL, proxyURL.Scheme)
-	// 	}
-
-	// 	var tr *http.Transport
-	// 	if proxyURL.Scheme == "http" || proxyURL.Scheme == "https" {
-	// 		tr = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
-	// 		client = &http.Client{Transport: tr}
-	// 	} else {
-	// 		client = &http.Client{}
-	// 	}
-
-	// } else {
-	// 	client = &http.Client{}
-	// }
-
-	client = &http.Client{}
-
-	resp, err := client.Do(req)
+// gzipData returns data gzip-compressed.
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendData sends the encoded payload data to the payload sink. If the
+// payload could not be sent, sendData returns a nil response.
+func (agg *aggregator) sendData(licenseKey, path string, data []byte) (*response, error) {
+	resp, err := agg.sink.SendPayload(context.Background(), Payload{
+		Kind:       PayloadKind(path),
+		Data:       data,
+		LicenseKey: licenseKey,
+	})
+	size := len(data)
+	if resp != nil && resp.size > 0 {
+		size = resp.size
+	}
+	agg.recordPayload(PayloadKind(path), size, err != nil || (resp != nil && resp.StatusCode >= 400))
 	if err != nil {
 		if agg.logger != nil {
 			agg.logger.Errorf("Sending request to %s failed with error: %s\n", path, err.Error())
 		}
 		return nil, err
 	}
+	if resp == nil {
+		resp = &PayloadResponse{StatusCode: http.StatusOK}
+	}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
 	var r response
 	r.StatusCode = resp.StatusCode
-
+	r.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	var body interface{}
 	if path == hostinfoRelativePath && r.StatusCode == 200 {
-		err := json.Unmarshal(body, &r.HostinfoResponse200)
-		if err != nil {
-			if agg.logger != nil {
-				agg.logger.Errorf("Response status: %+v\n", resp.Status)
-				agg.logger.Errorf("Response body: %+v\n", string(body))
-				agg.logger.Errorf("Response JSON Unmarshaling Failed: %+v\n", err.Error())
-			}
-			return nil, err
-		}
+		body = &r.HostinfoResponse200
 	} else if r.StatusCode == 400 {
-		err := json.Unmarshal(body, &r.Response400)
-		if err != nil {
+		body = &r.Response400
+	}
+	if body != nil && len(resp.Body) > 0 {
+		if err := json.Unmarshal(resp.Body, body); err != nil {
 			if agg.logger != nil {
-				agg.logger.Errorf("Response status: %+v\n", resp.Status)
-				agg.logger.Errorf("Response body: %+v\n", string(body))
+				agg.logger.Errorf("Response status: %d\n", resp.StatusCode)
+				agg.logger.Errorf("Response body: %+v\n", string(resp.Body))
 				agg.logger.Errorf("Response JSON Unmarshaling Failed: %+v\n", err.Error())
 			}
-			return nil, err
+			return &r, err
 		}
 	}
 	return &r, nil
 }
 
-var blocked bool
-
 type agent struct {
 	Name    string `json:"name"`
 	Version string `json:"version"`
@@ -213,11 +287,55 @@ const (
 	agentLanguage string = "Go"
 )
 
+// recordPayload updates the stats for a payload of the given kind and size.
+func (agg *aggregator) recordPayload(kind PayloadKind, size int, failed bool) {
+	if agg.stats == nil {
+		return
+	}
+	stats := agg.stats.Aggregator.Payloads.kind(kind)
+	if stats == nil {
+		return
+	}
+	if failed {
+		atomic.AddUint64(&stats.Failed, 1)
+		return
+	}
+	atomic.AddUint64(&stats.Sent, 1)
+	atomic.AddUint64(&agg.stats.Aggregator.BytesSent, uint64(size))
+}
+
+// agentMetrics returns the aggregator's statistics as agent.* metrics.
+func (agg *aggregator) agentMetrics() map[string]model.Metric {
+	stats := agg.stats.Aggregator.copy()
+	payloads := stats.Payloads.total()
+	return map[string]model.Metric{
+		"agent.errors.dropped":         {Value: float64(stats.ErrorsDropped)},
+		"agent.error_requests.dropped": {Value: float64(stats.ErrorRequestsDropped)},
+		"agent.analytics.dropped":      {Value: float64(stats.AnalyticsDropped)},
+		"agent.metrics.dropped":        {Value: float64(stats.MetricsDropped)},
+		"agent.payloads.sent":          {Value: float64(payloads.Sent)},
+		"agent.payloads.failed":        {Value: float64(payloads.Failed)},
+		"agent.bytes.sent":             {Value: float64(stats.BytesSent)},
+		"agent.flush.duration":         {Value: roundThreeDecimals(timeDurationToMilliSeconds(stats.LastFlushDuration))},
+	}
+}
+
 func (agg *aggregator) flush(b *batchEvents) {
+	agg.flushMu.Lock()
+	defer agg.flushMu.Unlock()
+
+	if _, ok := agg.sink.(discardPayloadSink); ok {
+		// Telemetry is exported by the tracer's OTLP exporter instead.
+		return
+	}
+
+	// The export modes write payloads locally, for which
+	// neither a license key nor an app name is needed.
+	_, export := agg.sink.(*exportPayloadSink)
 
 	lickey_appname_not_set := false
 
-	if agg.service.LicenseKey == "" {
+	if agg.service.LicenseKey == "" && !export {
 		lickey_appname_not_set = true
 		if agg.logger != nil {
 			agg.logger.Errorf("ATATUS_LICENSE_KEY is not set! Unable to send any data.")
@@ -225,7 +343,7 @@ func (agg *aggregator) flush(b *batchEvents) {
 		fmt.Println("ATATUS_LICENSE_KEY is not set! Unable to send any data.")
 	}
 
-	if agg.service.AppName == "" {
+	if agg.service.AppName == "" && !export {
 		lickey_appname_not_set = true
 		if agg.logger != nil {
 			agg.logger.Errorf("ATATUS_APP_NAME is not set! Unable to send any data.")
@@ -242,6 +360,11 @@ func (agg *aggregator) flush(b *batchEvents) {
 		return
 	}
 
+	start := time.Now()
+	defer func() {
+		atomic.StoreInt64((*int64)(&agg.stats.Aggregator.LastFlushDuration), int64(time.Since(start)))
+	}()
+
 	var h header
 	h.Agent.Name = agentLanguage
 	h.Agent.Version = AgentVersion
@@ -249,45 +372,46 @@ func (agg *aggregator) flush(b *batchEvents) {
 	h.AppName = agg.service.AppName
 	h.AppVersion = agg.service.AppVersion
 	h.ReleaseStage = agg.service.Environment
-	h.LicenseKey = agg.service.LicenseKey
+	if !export {
+		// Keep the license key out of exported files and output.
+		h.LicenseKey = agg.service.LicenseKey
+	}
 	if agg.host.hostID != "" {
 		h.UniqueHostname = agg.host.hostID
 	} else {
 		h.UniqueHostname, _ = os.Hostname()
 	}
 	h.ContainerID = agg.host.dockerID
-	// if agg.service.Tags != nil {
-	// 	h.Tags = agg.service.Tags
-	// }
-	// h.CustomData = agg.service.CustomData
+	h.Tags = aggGlobalLabelTags()
 
-	activeAggregatorCount++
-	if activeAggregatorCount > (3600 / 30) {
-		activeAggregator = false
+	now := time.Now()
+	agg.mu.Lock()
+	if agg.active && now.Sub(agg.activeSince) > activeAggregatorTimeout {
+		agg.active = false
 	}
+	active := agg.active
+	agg.mu.Unlock()
 
-	if (agg.flushTickerCount%30) == 0 || agg.flushTickerCount == 1 { // represents 30 times * 60 seconds = 30 minutes
+	if agg.lastHostinfo.IsZero() || now.Sub(agg.lastHostinfo) >= hostinfoRefreshInterval {
 		var hp hostinfoPayload
 		hp.header = h
 		hp.hostinfo.Language = agentLanguage
 		hp.hostinfo.Timestamp = time.Now().UnixNano() / 1000000
-		hp.hostinfo.Environment.HostDetails = hostDetails
+		hp.hostinfo.Environment.HostDetails = agg.hostDetails
 		hp.hostinfo.Environment.Setting = agg.agentSettingsMap()
 		hp.hostinfo.Environment.GoLibrary = stacktrace.LibraryPackagesMap()
-		hp.hostinfo.Active = activeAggregator
+		hp.hostinfo.Active = active
 
 		r, err := agg.sendToBackend(agg.service.LicenseKey, hostinfoRelativePath, hp)
-		agg.features.blocked = false
-		agg.features.capturePercentiles = false
-		agg.features.analytics = false
-		agg.features.tracing = false
+		var f features
 		if err == nil {
+			agg.lastHostinfo = now
 			if r.StatusCode == 400 {
 				if agg.logger != nil {
 					agg.logger.Errorf("Sending LicenseKey: %s Failed with StatusCode 400: %s\n", hp.header.LicenseKey, r.Response400.Message)
 				}
-				agg.features.blocked = r.Response400.Blocked
-				if agg.features.blocked == true {
+				f.blocked = r.Response400.Blocked
+				if f.blocked == true {
 					if agg.logger != nil {
 						agg.logger.Errorf("Atatus Blocked from Sending Data: %s\n", r.Response400.Message)
 					}
@@ -297,15 +421,18 @@ func (agg *aggregator) flush(b *batchEvents) {
 					}
 				}
 			} else if r.StatusCode == 200 {
-				agg.features.capturePercentiles = r.HostinfoResponse200.CapturePercentiles
-				agg.features.analytics = r.HostinfoResponse200.Analytics
-				agg.features.tracing = r.HostinfoResponse200.Tracing
+				f.capturePercentiles = r.HostinfoResponse200.CapturePercentiles
+				f.analytics = r.HostinfoResponse200.Analytics
+				f.tracing = r.HostinfoResponse200.Tracing
+				agg.patterns.Store(newHostinfoPatterns(r.HostinfoResponse200))
 			}
 		}
+		agg.mu.Lock()
+		agg.features = f
+		agg.mu.Unlock()
 	}
-	agg.flushTickerCount++
-
-	if agg.features.blocked == true {
+	features := agg.currentFeatures()
+	if features.blocked == true {
 		return
 	}
 
@@ -336,6 +463,12 @@ func (agg *aggregator) flush(b *batchEvents) {
 				t.Layers[i] = l
 				i++
 			}
+			if features.capturePercentiles {
+				t.SetPercentiles()
+				for _, l := range t.Layers {
+					l.SetPercentiles()
+				}
+			}
 			tp.T = append(tp.T, t)
 		}
 		if len(tp.T) > 0 {
@@ -343,7 +476,7 @@ func (agg *aggregator) flush(b *batchEvents) {
 		}
 	}
 
-	if agg.features.analytics == true {
+	if features.analytics == true {
 		if len(b.txnAnalytics) > 0 {
 			var tp txnAnalyticsPayload
 			tp.EndTime = time.Now().UnixNano() / 1000000
@@ -351,7 +484,7 @@ func (agg *aggregator) flush(b *batchEvents) {
 			tp.header = h
 
 			totalSize := 0
-			totalAnalyticsPayloadSize := 6 * 1024 * 1024
+			totalAnalyticsPayloadSize := agg.limits().analyticsPayloadSize
 			startai := 0
 			ai := 0
 			if len(b.txnAnalytics) > 0 {
@@ -388,12 +521,13 @@ func (agg *aggregator) flush(b *batchEvents) {
 
 			// Copying Web Transactions Traces
 			tp.T = b.trace.PrimarySet.Traces
+			maxTraces := b.trace.PrimarySet.AllowedCount
 
-			if numTraces < 5 {
+			if numTraces < maxTraces {
 				numSecondaryTraces := len(b.trace.SecondarySet.Traces)
 				if numSecondaryTraces > 0 {
-					sort.Sort(ByTraceDuration(b.trace.SecondarySet.Traces))
-					fromSecondary := 5 - numTraces
+					sort.Sort(byTraceRank(b.trace.SecondarySet.Traces))
+					fromSecondary := maxTraces - numTraces
 					if fromSecondary >= numSecondaryTraces {
 						fromSecondary = numSecondaryTraces
 					}
@@ -403,22 +537,22 @@ func (agg *aggregator) flush(b *batchEvents) {
 
 			// Filling up Background Transactions after Web Transactions, if space is there
 			numAvailableTraces := len(tp.T)
-			if numAvailableTraces < 5 {
+			if numAvailableTraces < maxTraces {
 				numBackgroundPrimaryTraces := len(b.trace.BackgroundPrimarySet.Traces)
 				if numBackgroundPrimaryTraces > 0 {
-					sort.Sort(ByTraceDuration(b.trace.BackgroundPrimarySet.Traces))
-					fromBackgroundPrimary := 5 - numAvailableTraces
+					sort.Sort(byTraceRank(b.trace.BackgroundPrimarySet.Traces))
+					fromBackgroundPrimary := maxTraces - numAvailableTraces
 					if fromBackgroundPrimary >= numBackgroundPrimaryTraces {
 						fromBackgroundPrimary = numBackgroundPrimaryTraces
 					}
 					tp.T = append(tp.T, b.trace.BackgroundPrimarySet.Traces[:fromBackgroundPrimary]...)
 
 					numAvailableTraces = len(tp.T)
-					if numAvailableTraces < 5 {
+					if numAvailableTraces < maxTraces {
 						numBackgroundSecondaryTraces := len(b.trace.BackgroundSecondarySet.Traces)
 						if numBackgroundSecondaryTraces > 0 {
-							sort.Sort(ByTraceDuration(b.trace.BackgroundSecondarySet.Traces))
-							fromBackgroundSecondary := 5 - numAvailableTraces
+							sort.Sort(byTraceRank(b.trace.BackgroundSecondarySet.Traces))
+							fromBackgroundSecondary := maxTraces - numAvailableTraces
 							if fromBackgroundSecondary >= numBackgroundSecondaryTraces {
 								fromBackgroundSecondary = numBackgroundSecondaryTraces
 							}
@@ -457,13 +591,13 @@ func (agg *aggregator) flush(b *batchEvents) {
 		agg.sendToBackend(agg.service.LicenseKey, errorMetricRelativePath, emp)
 	}
 
-	if len(b.metrics) > 0 {
-		var mp metricsPayload
-		mp.EndTime = time.Now().UnixNano() / 1000000
-		mp.StartTime = b.begin.UnixNano() / 1000000
-		mp.header = h
-		mp.M = b.metrics
+	// The agent metrics are sent with every flush,
+	// even when no other metrics have been gathered.
+	var mp metricsPayload
+	mp.EndTime = time.Now().UnixNano() / 1000000
+	mp.StartTime = b.begin.UnixNano() / 1000000
+	mp.header = h
+	mp.M = append(b.metrics, agg.agentMetrics())
 
-		agg.sendToBackend(agg.service.LicenseKey, metricsRelativePath, mp)
-	}
+	agg.sendToBackend(agg.service.LicenseKey, metricsRelativePath, mp)
 }
@@ -0,0 +1,127 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyHTTPClientProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied = append(proxied, req.URL.String())
+		w.Write([]byte("{}"))
+	}))
+	defer proxy.Close()
+
+	tracer := newAggTestTracer(t, "http://notify.invalid")
+	defer tracer.Close()
+	tracer.Service.NotifyProxy = proxy.URL
+
+	client, err := newNotifyHTTPClient(tracer.Service.NotifyProxy)
+	require.NoError(t, err)
+	agg := &aggregator{service: &tracer.Service, sink: &httpPayloadSink{service: &tracer.Service, client: client}}
+
+	r, err := agg.sendToBackend(tracer.Service.LicenseKey, txnRelativePath, txnPayload{})
+	require.NoError(t, err)
+	assert.Equal(t, 200, r.StatusCode)
+	require.Len(t, proxied, 1)
+	assert.Contains(t, proxied[0], "http://notify.invalid"+txnRelativePath)
+}
+
+func TestNotifyHTTPClientInvalidProxy(t *testing.T) {
+	_, err := newNotifyHTTPClient("ftp://proxy.invalid")
+	assert.EqualError(t, err, `invalid ATATUS_NOTIFY_PROXY scheme "ftp"`)
+}
+
+func TestNotifyHTTPClientVerifyServerCert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	client, err := newNotifyHTTPClient("")
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	assert.Error(t, err)
+
+	os.Setenv("ATATUS_VERIFY_SERVER_CERT", "false")
+	defer os.Unsetenv("ATATUS_VERIFY_SERVER_CERT")
+	client, err = newNotifyHTTPClient("")
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestSendToBackendCompression(t *testing.T) {
+	type request struct {
+		contentEncoding string
+		payload         errPayload
+	}
+	var requests []request
+	var bytesSent int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var r request
+		bytesSent += req.ContentLength
+		r.contentEncoding = req.Header.Get("Content-Encoding")
+		body := req.Body
+		if r.contentEncoding == "gzip" {
+			zr, err := gzip.NewReader(req.Body)
+			require.NoError(t, err)
+			body = ioutil.NopCloser(zr)
+		}
+		require.NoError(t, json.NewDecoder(body).Decode(&r.payload))
+		requests = append(requests, r)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	service := tracerService{NotifyHost: server.URL}
+	sink := &httpPayloadSink{service: &service, client: server.Client()}
+	sink.opts.compress = true
+	sink.opts.compressMinSize = 1024
+	agg := &aggregator{service: &service, sink: sink, stats: &TracerStats{}}
+
+	small := errPayload{header: header{AppName: "small"}}
+	large := errPayload{header: header{AppName: strings.Repeat("x", 2048)}}
+	agg.sendToBackend("", errorRelativePath, small)
+	agg.sendToBackend("", errorRelativePath, large)
+	sink.opts.compress = false
+	agg.sendToBackend("", errorRelativePath, large)
+
+	require.Len(t, requests, 3)
+	assert.Equal(t, "", requests[0].contentEncoding)
+	assert.Equal(t, "small", requests[0].payload.AppName)
+	assert.Equal(t, "gzip", requests[1].contentEncoding)
+	assert.Equal(t, large.AppName, requests[1].payload.AppName)
+	assert.Equal(t, "", requests[2].contentEncoding)
+	assert.Equal(t, large.AppName, requests[2].payload.AppName)
+
+	// BytesSent counts the compressed size of compressed payloads.
+	assert.Equal(t, uint64(bytesSent), agg.stats.Aggregator.BytesSent)
+}
@@ -0,0 +1,153 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// histogramRelativeAccuracy is the maximum relative error
+	// of the quantiles computed from a durationHistogram.
+	histogramRelativeAccuracy = 0.01
+
+	// histogramMaxBuckets bounds the number of buckets held by a
+	// durationHistogram. When exceeded, the lowest buckets are
+	// collapsed, trading accuracy of the low quantiles for memory.
+	histogramMaxBuckets = 2048
+
+	// histogramMinDuration is the smallest duration, in milliseconds,
+	// which is distinguished from zero.
+	histogramMinDuration = 1e-3
+)
+
+var (
+	histogramGamma    = (1 + histogramRelativeAccuracy) / (1 - histogramRelativeAccuracy)
+	histogramLogGamma = math.Log(histogramGamma)
+)
+
+// durationHistogram is a mergeable histogram of durations in milliseconds,
+// with logarithmically sized buckets so that quantiles have a bounded
+// relative error, in the style of DDSketch.
+type durationHistogram struct {
+	count     uint64
+	zeroCount uint64
+	buckets   map[int]uint64
+}
+
+func newDurationHistogram() *durationHistogram {
+	return &durationHistogram{buckets: make(map[int]uint64)}
+}
+
+// record records a duration in milliseconds.
+func (h *durationHistogram) record(d float64) {
+	h.count++
+	if d < histogramMinDuration {
+		h.zeroCount++
+		return
+	}
+	h.buckets[int(math.Ceil(math.Log(d)/histogramLogGamma))]++
+	h.collapse()
+}
+
+// merge adds the durations recorded in other to h.
+func (h *durationHistogram) merge(other *durationHistogram) {
+	if other == nil {
+		return
+	}
+	h.count += other.count
+	h.zeroCount += other.zeroCount
+	for i, n := range other.buckets {
+		h.buckets[i] += n
+	}
+	h.collapse()
+}
+
+func (h *durationHistogram) clone() *durationHistogram {
+	if h == nil {
+		return nil
+	}
+	c := newDurationHistogram()
+	c.merge(h)
+	return c
+}
+
+// collapse merges the lowest buckets until there are
+// at most histogramMaxBuckets.
+func (h *durationHistogram) collapse() {
+	if len(h.buckets) <= histogramMaxBuckets {
+		return
+	}
+	indexes := h.sortedIndexes()
+	excess := len(indexes) - histogramMaxBuckets
+	target := indexes[excess]
+	for _, i := range indexes[:excess] {
+		h.buckets[target] += h.buckets[i]
+		delete(h.buckets, i)
+	}
+}
+
+func (h *durationHistogram) sortedIndexes() []int {
+	indexes := make([]int, 0, len(h.buckets))
+	for i := range h.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// quantile returns an estimate of the q-quantile of the recorded
+// durations, for q in the range [0,1].
+func (h *durationHistogram) quantile(q float64) float64 {
+	if h == nil || h.count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.count-1))
+	cumulative := h.zeroCount
+	if cumulative > rank {
+		return 0
+	}
+	for _, i := range h.sortedIndexes() {
+		cumulative += h.buckets[i]
+		if cumulative > rank {
+			return 2 * math.Pow(histogramGamma, float64(i)) / (histogramGamma + 1)
+		}
+	}
+	return 0
+}
+
+// percentiles holds the latency percentiles in milliseconds,
+// reported when percentiles are enabled by the server.
+type percentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+func (h *durationHistogram) percentiles() *percentiles {
+	if h == nil || h.count == 0 {
+		return nil
+	}
+	return &percentiles{
+		P50: roundThreeDecimals(h.quantile(0.50)),
+		P90: roundThreeDecimals(h.quantile(0.90)),
+		P95: roundThreeDecimals(h.quantile(0.95)),
+		P99: roundThreeDecimals(h.quantile(0.99)),
+	}
+}
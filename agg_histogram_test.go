@@ -0,0 +1,116 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurationHistogramQuantiles(t *testing.T) {
+	h := newDurationHistogram()
+	for i := 1; i <= 10000; i++ {
+		h.record(float64(i) / 10)
+	}
+	for q, expected := range map[float64]float64{
+		0.5:  500,
+		0.9:  900,
+		0.95: 950,
+		0.99: 990,
+	} {
+		assert.InEpsilon(t, expected, h.quantile(q), histogramRelativeAccuracy*1.01, "q=%v", q)
+	}
+	assert.Equal(t, float64(0), newDurationHistogram().quantile(0.5))
+}
+
+func TestDurationHistogramMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(0))
+	all := newDurationHistogram()
+	a := newDurationHistogram()
+	b := newDurationHistogram()
+	for i := 0; i < 1000; i++ {
+		d := rng.ExpFloat64() * 100
+		all.record(d)
+		if i%2 == 0 {
+			a.record(d)
+		} else {
+			b.record(d)
+		}
+	}
+	a.merge(b)
+	assert.Equal(t, all.percentiles(), a.percentiles())
+}
+
+func TestDurationHistogramBounded(t *testing.T) {
+	h := newDurationHistogram()
+	d := histogramMinDuration
+	for i := 0; i < histogramMaxBuckets*2; i++ {
+		h.record(d)
+		d *= histogramGamma
+	}
+	assert.Len(t, h.buckets, histogramMaxBuckets)
+	assert.Equal(t, uint64(histogramMaxBuckets*2), h.count)
+	// The high quantiles are unaffected by collapsing the lowest buckets.
+	assert.InEpsilon(t, d/histogramGamma, h.quantile(1), histogramRelativeAccuracy*1.01)
+}
+
+func TestLayerPercentiles(t *testing.T) {
+	var l1, l2 layer
+	l1.SetDuration(10)
+	l2.SetDuration(200 * 1000)
+	l1.SetPercentiles()
+	assert.Nil(t, l1.Percentiles) // no histogram recorded
+
+	l1.recordHistogram()
+	l2.recordHistogram()
+	l1.Add(&l2)
+	require.Equal(t, float64(2), l1.Durations[0])
+	l1.SetPercentiles()
+	require.NotNil(t, l1.Percentiles)
+	assert.InEpsilon(t, 10, l1.Percentiles.P50, histogramRelativeAccuracy*1.01)
+	assert.InEpsilon(t, 200*1000, l1.hist.quantile(1), histogramRelativeAccuracy*1.01)
+}
+
+func TestAggregatorPercentiles(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+	server.hostinfo = []byte(`{"capturePercentiles": true}`)
+
+	tracer := newAggTestTracer(t, server.URL)
+	defer tracer.Close()
+
+	// Histograms are only recorded once the server has
+	// enabled percentiles, in response to the first flush.
+	tracer.StartTransaction("name", "type").End()
+	tracer.Flush(nil)
+	tracer.StartTransaction("name", "type").End()
+	tracer.Flush(nil)
+
+	var txns []txnPayload
+	server.payloads(t, txnRelativePath, &txns)
+	require.Len(t, txns, 2)
+	require.Len(t, txns[0].T, 1)
+	assert.Nil(t, txns[0].T[0].Percentiles)
+	require.Len(t, txns[1].T, 1)
+	assert.NotNil(t, txns[1].T[0].Percentiles)
+	for _, l := range txns[1].T[0].Layers {
+		assert.NotNil(t, l.Percentiles)
+	}
+}
@@ -0,0 +1,115 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"strconv"
+	"strings"
+
+	"go.atatus.com/agent/internal/configutil"
+	"go.atatus.com/agent/internal/wildcard"
+)
+
+// hostinfoPatterns holds the compiled patterns provided by the server in
+// the hostinfo response, used for ignoring aggregated data.
+type hostinfoPatterns struct {
+	txnNames     wildcard.Matchers
+	httpFailures []httpFailurePattern
+	exceptions   []exceptionPattern
+}
+
+// httpFailurePattern matches HTTP failures with a status code matching
+// statusCode, in transactions with a name matching any of txnNames. If
+// txnNames is empty, failures in all transactions are matched.
+type httpFailurePattern struct {
+	statusCode *wildcard.Matcher
+	txnNames   wildcard.Matchers
+}
+
+// exceptionPattern matches exceptions with a class matching class, and
+// a message matching any of messages. If messages is empty, exceptions
+// with any message are matched.
+type exceptionPattern struct {
+	class    *wildcard.Matcher
+	messages wildcard.Matchers
+}
+
+func newHostinfoPatterns(r hostinfoResponse200) *hostinfoPatterns {
+	var p hostinfoPatterns
+	p.txnNames = parseWildcardPatternList(r.IgnoreTxnNamePatterns)
+	for statusCode, txnNames := range r.IgnoreHTTPFailuresPatterns {
+		if statusCode = strings.TrimSpace(statusCode); statusCode != "" {
+			p.httpFailures = append(p.httpFailures, httpFailurePattern{
+				statusCode: configutil.ParseWildcardPattern(statusCode),
+				txnNames:   parseWildcardPatternList(txnNames),
+			})
+		}
+	}
+	for class, messages := range r.IgnoreExceptionPatterns {
+		if class = strings.TrimSpace(class); class != "" {
+			p.exceptions = append(p.exceptions, exceptionPattern{
+				class:    configutil.ParseWildcardPattern(class),
+				messages: parseWildcardPatternList(messages),
+			})
+		}
+	}
+	return &p
+}
+
+func parseWildcardPatternList(patterns []string) wildcard.Matchers {
+	var matchers wildcard.Matchers
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			matchers = append(matchers, configutil.ParseWildcardPattern(pattern))
+		}
+	}
+	return matchers
+}
+
+// ignoreTxn reports whether the transaction with the given name is ignored.
+func (p *hostinfoPatterns) ignoreTxn(name string) bool {
+	return p != nil && p.txnNames.MatchAny(name)
+}
+
+// ignoreHTTPFailure reports whether the HTTP failure with the given status
+// code, in the transaction with the given name, is ignored.
+func (p *hostinfoPatterns) ignoreHTTPFailure(statusCode int, txnName string) bool {
+	if p == nil {
+		return false
+	}
+	code := strconv.Itoa(statusCode)
+	for _, f := range p.httpFailures {
+		if f.statusCode.Match(code) && (len(f.txnNames) == 0 || f.txnNames.MatchAny(txnName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreException reports whether the exception with the given class and
+// message is ignored.
+func (p *hostinfoPatterns) ignoreException(class, message string) bool {
+	if p == nil {
+		return false
+	}
+	for _, e := range p.exceptions {
+		if e.class.Match(class) && (len(e.messages) == 0 || e.messages.MatchAny(message)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostinfoPatterns(t *testing.T) {
+	p := newHostinfoPatterns(hostinfoResponse200{
+		IgnoreTxnNamePatterns: []string{"GET /health*", " "},
+		IgnoreHTTPFailuresPatterns: map[string][]string{
+			"401": nil,
+			"5*":  {"POST /upload"},
+		},
+		IgnoreExceptionPatterns: map[string][]string{
+			"*net.OpError":        nil,
+			"*errors.errorString": {"context canceled", "*broken pipe"},
+		},
+	})
+
+	assert.True(t, p.ignoreTxn("GET /healthz"))
+	assert.False(t, p.ignoreTxn("GET /users"))
+
+	assert.True(t, p.ignoreHTTPFailure(401, "GET /users"))
+	assert.True(t, p.ignoreHTTPFailure(503, "POST /upload"))
+	assert.False(t, p.ignoreHTTPFailure(503, "GET /users"))
+	assert.False(t, p.ignoreHTTPFailure(400, "POST /upload"))
+
+	assert.True(t, p.ignoreException("*net.OpError", "dial tcp: i/o timeout"))
+	assert.True(t, p.ignoreException("*errors.errorString", "write: broken pipe"))
+	assert.False(t, p.ignoreException("*errors.errorString", "boom"))
+
+	var nilPatterns *hostinfoPatterns
+	assert.False(t, nilPatterns.ignoreTxn("GET /healthz"))
+	assert.False(t, nilPatterns.ignoreHTTPFailure(500, "GET /healthz"))
+	assert.False(t, nilPatterns.ignoreException("Error", "boom"))
+}
+
+func TestAggregatorHostinfoPatterns(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+	server.hostinfo = []byte(`{
+		"ignoreTxnNamePatterns": ["ignored*"],
+		"ignoreExceptionPatterns": {"*": ["ignored*"]}
+	}`)
+
+	tracer := newAggTestTracer(t, server.URL)
+	defer tracer.Close()
+
+	// The patterns take effect once the hostinfo response has been received.
+	tracer.StartTransaction("first", "type").End()
+	tracer.Flush(nil)
+	tracer.StartTransaction("ignored", "type").End()
+	tracer.StartTransaction("kept", "type").End()
+	tracer.NewError(errors.New("ignored error")).Send()
+	tracer.NewError(errors.New("kept error")).Send()
+	tracer.Flush(nil)
+
+	var txns []txnPayload
+	server.payloads(t, txnRelativePath, &txns)
+	if assert.Len(t, txns, 2) && assert.Len(t, txns[1].T, 1) {
+		assert.Equal(t, "kept", txns[1].T[0].Name)
+	}
+
+	var errs []struct {
+		E []aggError `json:"errors"`
+	}
+	server.payloads(t, errorRelativePath, &errs)
+	if assert.Len(t, errs, 1) && assert.Len(t, errs[0].E, 1) {
+		assert.Equal(t, "kept error", errs[0].E[0].StackTraces[0].Message)
+	}
+}
+
+func TestTracerHostinfoPatternsEndToEnd(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+	server.hostinfo = []byte(`{
+		"tracing": true,
+		"ignoreTxnNamePatterns": ["ignored*"],
+		"ignoreHTTPFailurePatterns": {"500": ["GET /ignored-failure"]}
+	}`)
+
+	os.Setenv(envTracing, "true")
+	defer os.Unsetenv(envTracing)
+
+	var stream streamRecorder
+	tracer, err := NewTracerOptions(TracerOptions{
+		ServiceName: "aggregator_test",
+		LicenseKey:  "license_key",
+		NotifyHost:  server.URL,
+		Transport:   &stream,
+	})
+	require.NoError(t, err)
+	defer tracer.Close()
+
+	// The patterns take effect once the hostinfo response has been received.
+	tracer.StartTransaction("first", "request").End()
+	tracer.Flush(nil)
+
+	for _, name := range []string{"ignored", "kept"} {
+		tx := tracer.StartTransaction(name, "request")
+		tx.StartSpan(name+" span", "db.sql", nil).End()
+		tx.End()
+	}
+	for _, name := range []string{"GET /ignored-failure", "GET /failure"} {
+		tx := tracer.StartTransaction(name, "request")
+		tx.Context.SetHTTPStatusCode(500)
+		tx.End()
+	}
+	tracer.Flush(nil)
+
+	// Events of ignored transactions are neither aggregated nor streamed,
+	// while transactions with ignored HTTP failures are both, but are not
+	// reported as failures.
+	var txns []txnPayload
+	server.payloads(t, txnRelativePath, &txns)
+	require.Len(t, txns, 2)
+	var names []string
+	for _, txn := range txns[1].T {
+		names = append(names, txn.Name)
+	}
+	assert.ElementsMatch(t, []string{"kept", "GET /ignored-failure", "GET /failure"}, names)
+	assert.ElementsMatch(t, []string{
+		"transaction:kept", "span:kept span",
+		"transaction:GET /ignored-failure", "transaction:GET /failure",
+	}, stream.events())
+
+	var errMetrics []errMetricPayload
+	server.payloads(t, errorMetricRelativePath, &errMetrics)
+	if assert.Len(t, errMetrics, 1) {
+		if assert.Len(t, errMetrics[0].M, 1) {
+			assert.Equal(t, "GET /failure", errMetrics[0].M[0].Name)
+		}
+		if assert.Len(t, errMetrics[0].R, 1) {
+			assert.Equal(t, "GET /failure", errMetrics[0].R[0].Name)
+		}
+	}
+}
+
+// streamRecorder is a Transport recording the kind
+// and name of the events in the streams sent.
+type streamRecorder struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *streamRecorder) SendStream(ctx context.Context, stream io.Reader) error {
+	zr, err := zlib.NewReader(stream)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(zr)
+	for {
+		var event map[string]struct {
+			Name string `json:"name"`
+		}
+		if err := decoder.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		for kind, v := range event {
+			if kind != "metadata" {
+				r.names = append(r.names, kind+":"+v.Name)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *streamRecorder) SetNotifyURL(notifyHost, licenseKey, appName, agentVersion string) error {
+	return nil
+}
+
+func (r *streamRecorder) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.names...)
+}
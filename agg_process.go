@@ -23,6 +23,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.atatus.com/agent/model"
@@ -79,7 +80,7 @@ func buildAggTxn(tx *Transaction, td *TransactionData, analytics bool) (*aggTxn,
 		mta.RequestName = mt.aggTxnID.Name
 		mta.Duration = mt.Durations[1]
 
-		mta.CustomData = make(map[string]interface{})
+		mta.CustomData = buildAggCustomData(&td.Context)
 
 		mta.TxnID = tx.traceContext.Span.String()
 		mta.TraceID = tx.traceContext.Trace.String()
@@ -145,23 +146,36 @@ func buildAggTxn(tx *Transaction, td *TransactionData, analytics bool) (*aggTxn,
 	return &mt, &mta, statusCode, &agReq
 }
 
+// isHTTPFailure reports whether a transaction with the given HTTP status
+// code is reported as an HTTP failure: client and server errors are
+// failures, except 404, which is usually caused by the client.
+func isHTTPFailure(statusCode int) bool {
+	return statusCode >= 400 && statusCode != http.StatusNotFound
+}
+
 func (agg *aggregator) processTxn(tx *Transaction, td *TransactionData) {
 
 	if td == nil {
 		return
 	}
 
-	analytics := agg.features.analytics
-	if agg.service.Analytics == false {
-		analytics = false
+	patterns := agg.hostinfoPatterns()
+	if patterns.ignoreTxn(td.Name) {
+		delete(agg.b.txnSpan, tx.traceContext.Span.String())
+		td.reset(tx.tracer)
+		return
 	}
 
-	tracing := agg.features.tracing
-	if agg.service.Tracing == false {
-		tracing = false
+	features := agg.currentFeatures()
+	analytics := features.analytics
+	if agg.service.Analytics == false {
+		analytics = false
 	}
 
 	mt, mta, statusCode, agReq := buildAggTxn(tx, td, analytics)
+	if features.capturePercentiles {
+		mt.recordHistogram()
+	}
 
 	txnSpans, ok := agg.b.txnSpan[tx.traceContext.Span.String()]
 	if ok {
@@ -169,7 +183,11 @@ func (agg *aggregator) processTxn(tx *Transaction, td *TransactionData) {
 			spanID := ts.layer.Key()
 			span, ok := mt.Layers[spanID]
 			if !ok {
-				mt.Layers[spanID] = &ts.layer
+				// Copy the layer so that merging other spans into
+				// it does not alter the span's own trace entry.
+				l := ts.layer
+				l.hist = ts.layer.hist.clone()
+				mt.Layers[spanID] = &l
 			} else {
 				span.Add(&ts.layer)
 			}
@@ -187,20 +205,27 @@ func (agg *aggregator) processTxn(tx *Transaction, td *TransactionData) {
 		txn.Add(mt)
 	}
 
-	if mt.Durations[1] > float64(agg.service.TraceThreshold) {
+	httpFailure := isHTTPFailure(statusCode) && !patterns.ignoreHTTPFailure(statusCode, mt.Name)
+	reason := agg.opts.traceRules.traceReason(
+		float64(agg.service.TraceThreshold), mt.Durations[1],
+		td.errorCaptured, httpFailure, txnSpans,
+	)
+	if reason != "" {
 
 		var trace aggTrace
 
 		trace.aggTxnID = mt.aggTxnID
+		trace.Reason = reason
 		trace.StartTime = timeToMilliSeconds(td.timestamp)
 		trace.Duration = mt.Durations[1]
 		trace.R = agReq
+		trace.Custom = buildAggCustomData(&td.Context)
 		trace.Entries = make([]aggTraceEntry, len(txnSpans))
 		trace.Funcs = make([]string, 0)
 		funcMap := make(map[string]int)
-		for i, ts := range txnSpans {
-			// spanID := ts.aggLayer.Key()
-			trace.Entries[i].Level = 1
+		for i, node := range orderAggSpans(tx.traceContext.Span, txnSpans) {
+			ts := node.span
+			trace.Entries[i].Level = float64(node.level)
 
 			if ts.Timestamp.After(td.timestamp) {
 				trace.Entries[i].StartOffset = timeDurationToMilliSeconds(ts.Timestamp.Sub(td.timestamp))
@@ -231,14 +256,15 @@ func (agg *aggregator) processTxn(tx *Transaction, td *TransactionData) {
 	// Custom
 	// if msg.txnData.isBackgroundTxn() == false {
 	if analytics == true {
-		const txnAnalyticsAllowedCount int = 10000
 		txnAnalyticsCount := len(agg.b.txnAnalytics)
-		if txnAnalyticsCount < txnAnalyticsAllowedCount {
+		if txnAnalyticsCount < agg.limits().analyticsEvents {
 			agg.b.txnAnalytics = append(agg.b.txnAnalytics, mta)
+		} else {
+			atomic.AddUint64(&agg.stats.Aggregator.AnalyticsDropped, 1)
 		}
 	}
 
-	if statusCode >= 400 && statusCode != 404 {
+	if httpFailure {
 
 		_, ok := agg.b.errMetric[txnkey]
 		if !ok {
@@ -252,19 +278,17 @@ func (agg *aggregator) processTxn(tx *Transaction, td *TransactionData) {
 		agg.b.errMetric[txnkey].StatusCode[errMetricString]++
 
 		httpErrorRequestCount := len(agg.b.errRequest)
-		if httpErrorRequestCount <= 20 {
+		if httpErrorRequestCount < agg.limits().errorRequests {
 			var hr httpErrorRequest
 			hr.aggTxnID = mt.aggTxnID
 			hr.R = agReq
-			// hr.Custom = msg.httpErrorData.Custom
+			hr.Custom = buildAggCustomData(&td.Context)
 			agg.b.errRequest = append(agg.b.errRequest, hr)
+		} else {
+			atomic.AddUint64(&agg.stats.Aggregator.ErrorRequestsDropped, 1)
 		}
 	}
 
-	if agg.modelWriter != nil && tracing == true { // at_handling send stream
-		agg.modelWriter.writeTransaction(tx, td) // at_handling send stream
-	}
-
 	td.reset(tx.tracer)
 }
 
@@ -330,6 +354,8 @@ func buildAggSpan(s *Span, sd *SpanData) *aggLayer {
 	mp.layer.Kind = mapSpanKind(sd.Type)
 
 	mp.Timestamp = sd.timestamp
+	mp.id = s.traceContext.Span
+	mp.parentID = s.parentID
 	if sd.Context.model.Database != nil {
 		mp.Context.Database = new(model.DatabaseSpanContext)
 		mp.Context.Database.Instance = sd.Context.model.Database.Instance
@@ -350,19 +376,13 @@ func buildAggSpan(s *Span, sd *SpanData) *aggLayer {
 func (agg *aggregator) processSpan(s *Span, sd *SpanData) {
 
 	if s.transactionID.Validate() == nil {
-		tracing := agg.features.tracing
-		if agg.service.Tracing == false {
-			tracing = false
-		}
-
 		mp := buildAggSpan(s, sd)
+		if agg.currentFeatures().capturePercentiles {
+			mp.layer.recordHistogram()
+		}
 		txnid := s.transactionID.String()
 
 		agg.b.txnSpan[txnid] = append(agg.b.txnSpan[txnid], mp)
-
-		if agg.modelWriter != nil && tracing == true { // at_handling send stream
-			agg.modelWriter.writeSpan(s, sd) // at_handling send stream
-		}
 	}
 
 	sd.reset(s.tracer)
@@ -474,16 +494,22 @@ func buildAggError(e *ErrorData) *aggError {
 
 	agErr.Request = buildAggContextRequest(e.Context)
 
-	agErr.StackTraces = make([]stackTrace, 1)
-	agErr.StackTraces[0].Message = e.exception.message
+	agErr.StackTraces = appendAggStackTraces(make([]stackTrace, 0, 1), &e.exception)
+	agErr.Custom = buildAggCustomData(&e.Context)
 
-	agErr.StackTraces[0].Class = e.exception.Type.Name
-	if agErr.StackTraces[0].Class == "" {
-		agErr.StackTraces[0].Class = "Error"
-	}
-	agErr.StackTraces[0].Frames = make([]frame, 0)
+	return &agErr
+}
+
+// appendAggStackTraces appends the stack trace of the exception,
+// followed by those of its causes, depth first.
+func appendAggStackTraces(out []stackTrace, ex *exceptionData) []stackTrace {
+	var st stackTrace
+	st.Message = ex.message
 
-	for _, v := range e.exception.stacktrace {
+	st.Class = aggErrorClass(ex)
+	st.Frames = make([]frame, 0, len(ex.stacktrace))
+
+	for _, v := range ex.stacktrace {
 		var f frame
 
 		var abspath string
@@ -504,27 +530,40 @@ func buildAggError(e *ErrorData) *aggError {
 		packagePath, _ := stacktrace.SplitFunctionName(v.Function)
 		f.InProject = stacktrace.IsLibraryPackage(packagePath)
 
-		agErr.StackTraces[0].Frames = append(agErr.StackTraces[0].Frames, f)
+		st.Frames = append(st.Frames, f)
 	}
-	// agErr.Custom
+	out = append(out, st)
 
-	return &agErr
+	for i := range ex.cause {
+		out = appendAggStackTraces(out, &ex.cause[i])
+	}
+	return out
 }
 
-func (agg *aggregator) processError(e *ErrorData) {
+// aggErrorClass returns the class reported for the exception.
+func aggErrorClass(ex *exceptionData) string {
+	if ex.Type.Name == "" {
+		return "Error"
+	}
+	return ex.Type.Name
+}
 
-	agErr := buildAggError(e)
-	if len(agg.b.err) <= 20 {
-		tracing := agg.features.tracing
-		if agg.service.Tracing == false {
-			tracing = false
-		}
+// ignoreError reports whether the error matches the
+// ignored exception patterns from hostinfo.
+func (agg *aggregator) ignoreError(e *ErrorData) bool {
+	return agg.hostinfoPatterns().ignoreException(aggErrorClass(&e.exception), e.exception.message)
+}
 
-		agg.b.err = append(agg.b.err, agErr)
+func (agg *aggregator) processError(e *ErrorData) {
 
-		if agg.modelWriter != nil && tracing == true { // at_handling send stream
-			agg.modelWriter.writeError(e) // at_handling send stream
-		}
+	if agg.ignoreError(e) {
+		e.reset()
+		return
+	}
+	if len(agg.b.err) < agg.limits().errors {
+		agg.b.err = append(agg.b.err, buildAggError(e))
+	} else {
+		atomic.AddUint64(&agg.stats.Aggregator.ErrorsDropped, 1)
 	}
 
 	e.reset()
@@ -543,8 +582,10 @@ func buildAggMetrics(m *Metrics) map[string]model.Metric {
 func (agg *aggregator) processMetrics(m *Metrics) {
 
 	agMetric := buildAggMetrics(m)
-	if len(agg.b.metrics) <= 20 {
+	if len(agg.b.metrics) < agg.limits().metrics {
 		agg.b.metrics = append(agg.b.metrics, agMetric)
+	} else {
+		atomic.AddUint64(&agg.stats.Aggregator.MetricsDropped, 1)
 	}
 
 	m.reset()
@@ -0,0 +1,58 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregatorErrorCauses(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+
+	tracer := newAggTestTracer(t, server.URL)
+	defer tracer.Close()
+
+	root := errors.New("connection refused")
+	tracer.NewError(fmt.Errorf("query failed: %w", root)).Send()
+	tracer.Flush(nil)
+
+	var payloads []errPayload
+	server.payloads(t, errorRelativePath, &payloads)
+	require.Len(t, payloads, 1)
+	require.Len(t, payloads[0].E, 1)
+
+	var messages []string
+	for _, st := range payloads[0].E[0].StackTraces {
+		messages = append(messages, st.Message)
+	}
+	assert.Equal(t, []string{
+		"query failed: connection refused",
+		"connection refused",
+	}, messages)
+
+	stackTraces := payloads[0].E[0].StackTraces
+	assert.Equal(t, "wrapError", stackTraces[0].Class)
+	assert.Equal(t, "fundamental", stackTraces[1].Class)
+	require.NotEmpty(t, stackTraces[1].Frames)
+	assert.Equal(t, "go.atatus.com/agent.TestAggregatorErrorCauses", stackTraces[1].Frames[0].Method)
+}
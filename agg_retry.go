@@ -0,0 +1,444 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifyRetryMinBackoff = 5 * time.Second
+	notifyRetryMaxBackoff = 5 * time.Minute
+
+	notifySpoolFileSuffix = ".json"
+	notifySpoolLockFile   = "lock"
+)
+
+// errNotifySpoolLocked is returned by newNotifySpool when the spool
+// directory is in use by another process or tracer.
+var errNotifySpoolLocked = errors.New("spool directory is in use by another process")
+
+// notifyPayload holds an encoded payload which failed to be sent,
+// and is queued for retrying.
+type notifyPayload struct {
+	licenseKey string
+	path       string
+	data       []byte
+	created    time.Time
+	attempts   int
+	next       time.Time
+
+	// file holds the name of the spool file holding the payload,
+	// if the payload has been spooled.
+	file string
+}
+
+// notifyRetryQueue holds payloads that failed to be sent due to a network
+// error or server error, and retries them with jittered exponential backoff.
+//
+// The queue is bounded, dropping the oldest payload when full. If a spool is
+// configured, queued payloads are also written to disk, and are replayed the
+// next time a queue is created with the same spool.
+type notifyRetryQueue struct {
+	mu       sync.Mutex
+	pending  []*notifyPayload
+	maxItems int
+	rng      *rand.Rand
+
+	// minBackoff and maxBackoff bound the backoff between attempts,
+	// which doubles after each failed attempt.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	spool  *notifySpool
+	logger WarningLogger
+	wake   chan struct{}
+}
+
+func newNotifyRetryQueue(maxItems int, spool *notifySpool, logger WarningLogger) *notifyRetryQueue {
+	q := &notifyRetryQueue{
+		maxItems:   maxItems,
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		minBackoff: notifyRetryMinBackoff,
+		maxBackoff: notifyRetryMaxBackoff,
+		spool:      spool,
+		logger:     logger,
+		wake:       make(chan struct{}, 1),
+	}
+	if spool != nil {
+		payloads, err := spool.load()
+		if err != nil && logger != nil {
+			logger.Errorf("Loading spooled payloads failed: %s\n", err.Error())
+		}
+		for _, p := range payloads {
+			q.add(p)
+		}
+	}
+	return q
+}
+
+// push queues the encoded payload for path to be retried, no sooner
+// than retryAfter from now.
+func (q *notifyRetryQueue) push(licenseKey, path string, data []byte, retryAfter time.Duration) {
+	now := time.Now()
+	p := &notifyPayload{licenseKey: licenseKey, path: path, data: data, created: now}
+	q.mu.Lock()
+	p.next = now.Add(durationMax(q.backoff(0), retryAfter))
+	q.mu.Unlock()
+	if q.spool != nil {
+		if err := q.spool.write(p); err != nil && q.logger != nil {
+			q.logger.Errorf("Spooling payload for %s failed: %s\n", path, err.Error())
+		}
+	}
+	q.add(p)
+}
+
+func (q *notifyRetryQueue) add(p *notifyPayload) {
+	q.mu.Lock()
+	if q.maxItems > 0 && len(q.pending) >= q.maxItems {
+		dropped := q.pending[0]
+		q.pending = q.pending[1:]
+		q.remove(dropped)
+		if q.logger != nil {
+			q.logger.Warningf("Retry queue is full, dropping payload for %s\n", dropped.path)
+		}
+	}
+	q.pending = append(q.pending, p)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// remove removes p's spool file, if any.
+func (q *notifyRetryQueue) remove(p *notifyPayload) {
+	if q.spool != nil && p.file != "" {
+		q.spool.remove(p)
+	}
+}
+
+func (q *notifyRetryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// backoff returns the jittered backoff duration for a payload
+// which has been attempted the given number of times. backoff
+// must be called with q.mu held, as it uses q.rng.
+func (q *notifyRetryQueue) backoff(attempts int) time.Duration {
+	d := q.minBackoff
+	for i := 0; i < attempts && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.maxBackoff {
+		d = q.maxBackoff
+	}
+	return jitterDuration(d, q.rng, gracePeriodJitter)
+}
+
+func durationMax(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// notifySendFunc sends a queued payload, reporting whether the payload was
+// sent or should otherwise be dropped, and if not, the minimum time to wait
+// before retrying it.
+type notifySendFunc func(p *notifyPayload) (done bool, retryAfter time.Duration)
+
+// run retries queued payloads as they become due, until done is signaled.
+func (q *notifyRetryQueue) run(send notifySendFunc, done <-chan struct{}) {
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+	for {
+		if next, ok := q.nextAttempt(); ok {
+			timer.Reset(time.Until(next))
+		}
+		select {
+		case <-done:
+			return
+		case <-q.wake:
+		case <-timer.C:
+			q.retryDue(send, done)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+func (q *notifyRetryQueue) nextAttempt() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next time.Time
+	for _, p := range q.pending {
+		if next.IsZero() || p.next.Before(next) {
+			next = p.next
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// retryDue sends the due payloads in the order they were queued. If sending
+// a payload fails, the remaining due payloads are rescheduled along with it,
+// rather than being attempted against an unreachable server.
+func (q *notifyRetryQueue) retryDue(send notifySendFunc, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		q.mu.Lock()
+		now := time.Now()
+		q.dropExpired(now)
+		var p *notifyPayload
+		for i, pending := range q.pending {
+			if !pending.next.After(now) {
+				p = pending
+				q.pending = append(q.pending[:i:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		q.mu.Unlock()
+		if p == nil {
+			return
+		}
+
+		sent, retryAfter := send(p)
+		if sent {
+			q.mu.Lock()
+			q.remove(p)
+			q.mu.Unlock()
+			continue
+		}
+
+		q.mu.Lock()
+		p.attempts++
+		p.next = now.Add(durationMax(q.backoff(p.attempts), retryAfter))
+		for _, pending := range q.pending {
+			if pending.next.Before(p.next) {
+				pending.next = p.next
+			}
+		}
+		q.pending = append([]*notifyPayload{p}, q.pending...)
+		q.mu.Unlock()
+		return
+	}
+}
+
+// dropExpired drops spooled payloads older than the spool's maximum age.
+// dropExpired must be called with q.mu held.
+func (q *notifyRetryQueue) dropExpired(now time.Time) {
+	if q.spool == nil || q.spool.maxAge <= 0 {
+		return
+	}
+	pending := q.pending[:0]
+	for _, p := range q.pending {
+		if now.Sub(p.created) > q.spool.maxAge {
+			q.remove(p)
+			continue
+		}
+		pending = append(pending, p)
+	}
+	q.pending = pending
+}
+
+// notifySpool persists queued payloads in a directory, so they
+// survive process restarts.
+//
+// The spool holds a lock on the directory while it is open, so that
+// payloads are replayed by only one process.
+type notifySpool struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	lock    *os.File
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+type notifySpoolRecord struct {
+	LicenseKey string          `json:"licenseKey"`
+	Path       string          `json:"path"`
+	Created    int64           `json:"created"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// notifySpoolSubdir returns the name of the subdirectory of the spool
+// directory holding the payloads of the given app, so that apps sharing
+// a spool directory replay only their own payloads. The name is a hash,
+// to avoid exposing the license key in the file system.
+func notifySpoolSubdir(appName, licenseKey string) string {
+	h := sha256.Sum256([]byte(appName + "\x00" + licenseKey))
+	return hex.EncodeToString(h[:8])
+}
+
+// newNotifySpool returns a spool persisting payloads in dir, creating
+// it if necessary. If dir is in use by another spool, in this process
+// or another, newNotifySpool returns errNotifySpoolLocked.
+func newNotifySpool(dir string, maxSize int64, maxAge time.Duration) (*notifySpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lock, err := lockSpoolFile(filepath.Join(dir, notifySpoolLockFile))
+	if err != nil {
+		return nil, err
+	}
+	return &notifySpool{dir: dir, maxSize: maxSize, maxAge: maxAge, lock: lock}, nil
+}
+
+// close releases the spool's lock on its directory.
+func (s *notifySpool) close() error {
+	return s.lock.Close()
+}
+
+// write writes p to a new spool file, and then removes the oldest
+// spool files until the spool is within its maximum size.
+func (s *notifySpool) write(p *notifyPayload) error {
+	data, err := json.Marshal(notifySpoolRecord{
+		LicenseKey: p.licenseKey,
+		Path:       p.path,
+		Created:    p.created.UnixNano(),
+		Payload:    p.data,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", p.created.UnixNano(), s.seq%1000000, notifySpoolFileSuffix)
+	if err := ioutil.WriteFile(filepath.Join(s.dir, name), data, 0600); err != nil {
+		return err
+	}
+	p.file = name
+	return s.truncate()
+}
+
+// truncate removes the oldest spool files until the total size of the
+// spool is within s.maxSize. truncate must be called with s.mu held.
+func (s *notifySpool) truncate() error {
+	if s.maxSize <= 0 {
+		return nil
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, f := range files {
+		size += f.Size()
+	}
+	for _, f := range files {
+		if size <= s.maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		size -= f.Size()
+	}
+	return nil
+}
+
+// files returns the spool files, oldest first.
+func (s *notifySpool) files() ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := infos[:0]
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), notifySpoolFileSuffix) {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+func (s *notifySpool) remove(p *notifyPayload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	os.Remove(filepath.Join(s.dir, p.file))
+}
+
+// load returns the spooled payloads, oldest first, removing any spool
+// files that are older than s.maxAge or cannot be decoded.
+func (s *notifySpool) load() ([]*notifyPayload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var payloads []*notifyPayload
+	for _, f := range files {
+		filename := filepath.Join(s.dir, f.Name())
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		var record notifySpoolRecord
+		if err := json.Unmarshal(data, &record); err != nil || record.Path == "" {
+			os.Remove(filename)
+			continue
+		}
+		created := time.Unix(0, record.Created)
+		if s.maxAge > 0 && now.Sub(created) > s.maxAge {
+			os.Remove(filename)
+			continue
+		}
+		payloads = append(payloads, &notifyPayload{
+			licenseKey: record.LicenseKey,
+			path:       record.Path,
+			data:       record.Payload,
+			created:    created,
+			next:       now,
+			file:       f.Name(),
+		})
+	}
+	return payloads, nil
+}
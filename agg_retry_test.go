@@ -0,0 +1,263 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestNotifyRetryQueue(maxItems int, spool *notifySpool) *notifyRetryQueue {
+	q := newNotifyRetryQueue(maxItems, spool, nil)
+	q.minBackoff = time.Millisecond
+	q.maxBackoff = 10 * time.Millisecond
+	return q
+}
+
+func TestNotifyRetryQueueRetries(t *testing.T) {
+	q := newTestNotifyRetryQueue(10, nil)
+
+	var mu sync.Mutex
+	var attempts int
+	var sent []string
+	send := func(p *notifyPayload) (bool, time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts <= 3 {
+			return false, 0
+		}
+		sent = append(sent, p.path+" "+string(p.data))
+		return true, 0
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go q.run(send, done)
+
+	q.push("", txnRelativePath, []byte(`{"a":1}`), 0)
+	q.push("", errorRelativePath, []byte(`{"b":2}`), 0)
+	assert.Eventually(t, func() bool { return q.len() == 0 }, 10*time.Second, time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{
+		txnRelativePath + ` {"a":1}`,
+		errorRelativePath + ` {"b":2}`,
+	}, sent)
+}
+
+func TestNotifyRetryQueueConcurrentPush(t *testing.T) {
+	q := newTestNotifyRetryQueue(100, nil)
+	var attempts int64
+	send := func(p *notifyPayload) (bool, time.Duration) {
+		// Fail the first attempt of each payload, so the
+		// retry loop computes backoffs while pushes continue.
+		return atomic.AddInt64(&attempts, 1)%2 == 0, 0
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go q.run(send, done)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				q.push("", txnRelativePath, []byte(`{}`), 0)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Eventually(t, func() bool { return q.len() == 0 }, 10*time.Second, time.Millisecond)
+}
+
+func TestNotifyRetryQueueBounded(t *testing.T) {
+	q := newTestNotifyRetryQueue(2, nil)
+	q.push("", "/1", []byte("1"), 0)
+	q.push("", "/2", []byte("2"), 0)
+	q.push("", "/3", []byte("3"), 0)
+	require.Equal(t, 2, q.len())
+	assert.Equal(t, "/2", q.pending[0].path)
+	assert.Equal(t, "/3", q.pending[1].path)
+}
+
+func TestNotifyRetryQueueBackoff(t *testing.T) {
+	q := newNotifyRetryQueue(1, nil, nil)
+	for attempts, expected := range []time.Duration{
+		5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second,
+		80 * time.Second, 160 * time.Second, 300 * time.Second, 300 * time.Second,
+	} {
+		d := q.backoff(attempts)
+		assert.InDelta(t, expected, d, float64(expected)*gracePeriodJitter)
+	}
+}
+
+func TestNotifySpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atatus-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newNotifySpool(dir, 1024*1024, time.Hour)
+	require.NoError(t, err)
+	q := newTestNotifyRetryQueue(10, spool)
+	q.push("key1", txnRelativePath, []byte(`{"transactions":[]}`), 0)
+	q.push("key2", traceRelativePath, []byte(`{"traces":[]}`), 0)
+
+	// A new queue with the same spool replays the payloads with
+	// the license keys they were created with, removing the spool
+	// files once they have been sent.
+	q = newTestNotifyRetryQueue(10, spool)
+	require.Equal(t, 2, q.len())
+
+	var sent []string
+	q.retryDue(func(p *notifyPayload) (bool, time.Duration) {
+		sent = append(sent, p.licenseKey+" "+p.path+" "+string(p.data))
+		return true, 0
+	}, nil)
+	assert.Equal(t, []string{
+		"key1 " + txnRelativePath + ` {"transactions":[]}`,
+		"key2 " + traceRelativePath + ` {"traces":[]}`,
+	}, sent)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+notifySpoolFileSuffix))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestNotifySpoolLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atatus-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newNotifySpool(dir, 1024*1024, time.Hour)
+	require.NoError(t, err)
+
+	// Only one spool may use a directory at a time,
+	// so that its payloads are replayed only once.
+	_, err = newNotifySpool(dir, 1024*1024, time.Hour)
+	assert.Equal(t, errNotifySpoolLocked, err)
+
+	require.NoError(t, spool.close())
+	spool, err = newNotifySpool(dir, 1024*1024, time.Hour)
+	require.NoError(t, err)
+	spool.close()
+
+	assert.NotEqual(t, notifySpoolSubdir("app", "key1"), notifySpoolSubdir("app", "key2"))
+	assert.NotEqual(t, notifySpoolSubdir("app1", "key"), notifySpoolSubdir("app2", "key"))
+}
+
+func TestNotifySpoolLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atatus-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spool, err := newNotifySpool(dir, 200, time.Hour)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, spool.write(&notifyPayload{
+			path:    txnRelativePath,
+			data:    []byte(`{"transactions":[]}`),
+			created: time.Now(),
+		}))
+	}
+	files, err := spool.files()
+	require.NoError(t, err)
+	var size int64
+	for _, f := range files {
+		size += f.Size()
+	}
+	assert.True(t, size <= 200, size)
+	assert.NotEmpty(t, files)
+
+	require.NoError(t, spool.write(&notifyPayload{
+		path:    errorRelativePath,
+		data:    []byte(`{}`),
+		created: time.Now().Add(-2 * time.Hour),
+	}))
+	payloads, err := spool.load()
+	require.NoError(t, err)
+	for _, p := range payloads {
+		assert.Equal(t, txnRelativePath, p.path)
+	}
+}
+
+func TestSendToBackendQueuesFailedPayloads(t *testing.T) {
+	var statusCode = http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(statusCode)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	service := tracerService{NotifyHost: server.URL}
+	agg := &aggregator{service: &service, sink: &httpPayloadSink{service: &service, client: server.Client()}}
+	agg.retry = newTestNotifyRetryQueue(10, nil)
+
+	agg.sendToBackend("", hostinfoRelativePath, hostinfoPayload{})
+	assert.Equal(t, 0, agg.retry.len())
+	agg.sendToBackend("", txnRelativePath, txnPayload{})
+	assert.Equal(t, 1, agg.retry.len())
+
+	statusCode = http.StatusBadRequest
+	agg.sendToBackend("", errorRelativePath, errPayload{})
+	assert.Equal(t, 1, agg.retry.len())
+}
+
+func TestSendToBackendRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "key", req.URL.Query().Get("license_key"))
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	service := tracerService{NotifyHost: server.URL, LicenseKey: "other"}
+	agg := &aggregator{service: &service, sink: &httpPayloadSink{service: &service, client: server.Client()}}
+	agg.retry = newTestNotifyRetryQueue(10, nil)
+
+	before := time.Now()
+	agg.sendToBackend("key", txnRelativePath, txnPayload{})
+	require.Equal(t, 1, agg.retry.len())
+	p := agg.retry.pending[0]
+	assert.Equal(t, "key", p.licenseKey)
+	assert.False(t, p.next.Before(before.Add(120*time.Second)))
+
+	sent, retryAfter := agg.resend(p)
+	assert.False(t, sent)
+	assert.Equal(t, 120*time.Second, retryAfter)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30", now))
+	assert.Equal(t, time.Minute, parseRetryAfter("Wed, 01 Jan 2020 00:01:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Tue, 31 Dec 2019 23:59:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
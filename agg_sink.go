@@ -0,0 +1,171 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// PayloadKind identifies the kind of an aggregated payload. Its value is the
+// path of the Atatus endpoint that receives payloads of that kind.
+type PayloadKind string
+
+const (
+	// PayloadHostinfo identifies payloads describing the host and agent.
+	PayloadHostinfo PayloadKind = PayloadKind(hostinfoRelativePath)
+
+	// PayloadTransaction identifies payloads of aggregated transaction
+	// and layer durations.
+	PayloadTransaction PayloadKind = PayloadKind(txnRelativePath)
+
+	// PayloadTrace identifies payloads holding a single transaction trace.
+	PayloadTrace PayloadKind = PayloadKind(traceRelativePath)
+
+	// PayloadError identifies payloads of errors.
+	PayloadError PayloadKind = PayloadKind(errorRelativePath)
+
+	// PayloadErrorMetric identifies payloads of HTTP failure counts
+	// and the requests that failed.
+	PayloadErrorMetric PayloadKind = PayloadKind(errorMetricRelativePath)
+
+	// PayloadMetric identifies payloads of metrics.
+	PayloadMetric PayloadKind = PayloadKind(metricsRelativePath)
+
+	// PayloadAnalytics identifies payloads of request analytics.
+	PayloadAnalytics PayloadKind = PayloadKind(analyticsTxnRelativePath)
+)
+
+// Payload is an aggregated payload, as sent to Atatus.
+type Payload struct {
+	// Kind identifies the kind of the payload.
+	Kind PayloadKind
+
+	// Data holds the JSON encoding of the payload.
+	Data []byte
+
+	// LicenseKey holds the license key of the tracer that created the
+	// payload, which may differ from the current tracer's license key
+	// for payloads replayed from the spool directory.
+	LicenseKey string
+}
+
+// PayloadResponse holds the response to a payload.
+type PayloadResponse struct {
+	// StatusCode holds the HTTP status code of the response.
+	StatusCode int
+
+	// Body holds the response body. For PayloadHostinfo payloads
+	// this may hold the features and patterns to apply.
+	Body []byte
+
+	// Header holds the response headers. A Retry-After header
+	// delays the retrying of a payload.
+	Header http.Header
+
+	// size holds the number of bytes sent for the payload,
+	// if different from the size of its data, e.g. when the
+	// payload was compressed.
+	size int
+}
+
+// PayloadSink is an interface for receiving the payloads aggregated by
+// the tracer, in place of sending them to Atatus over HTTP.
+//
+// SendPayload must be safe for concurrent use. A nil response with a nil
+// error is treated as a successful response with an empty body. Payloads
+// are queued for retrying when SendPayload returns an error, or a response
+// with a 429 or 5xx status code.
+type PayloadSink interface {
+	SendPayload(ctx context.Context, p Payload) (*PayloadResponse, error)
+}
+
+// httpPayloadSink is the default PayloadSink, which
+// sends payloads to the notify host over HTTP.
+type httpPayloadSink struct {
+	service *tracerService
+	client  *http.Client
+	opts    aggregatorOptions
+	logger  WarningLogger
+}
+
+func (s *httpPayloadSink) SendPayload(ctx context.Context, p Payload) (*PayloadResponse, error) {
+	path := string(p.Kind)
+	data := p.Data
+
+	var host string
+	if p.Kind == PayloadAnalytics {
+		if s.service.NotifyHost == "https://apm-rx.atatus.com" ||
+			s.service.NotifyHost == "https://apm-rx-collector.atatus.com" {
+			host = "https://an-rx.atatus.com"
+		} else {
+			host = s.service.NotifyHost
+		}
+	} else {
+		host = s.service.NotifyHost
+	}
+
+	notifyHost := strings.TrimSuffix(host, "/") + path
+
+	var contentEncoding string
+	if s.opts.compress && len(data) >= s.opts.compressMinSize {
+		compressed, err := gzipData(data)
+		if err != nil {
+			if s.logger != nil {
+				s.logger.Errorf("Compressing payload for %s failed with error: %s\n", path, err.Error())
+			}
+		} else {
+			data = compressed
+			contentEncoding = "gzip"
+		}
+	}
+
+	req, err := http.NewRequest("POST", notifyHost, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+
+	q := req.URL.Query()
+	licenseKey := p.LicenseKey
+	if licenseKey == "" {
+		licenseKey = s.service.LicenseKey
+	}
+	q.Add("license_key", licenseKey)
+	q.Add("agent_name", agentLanguage)
+	q.Add("agent_version", AgentVersion)
+	req.URL.RawQuery = q.Encode()
+
+	if s.logger != nil {
+		s.logger.Debugf("Sending to URL: %+v\n", req.URL)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return &PayloadResponse{StatusCode: resp.StatusCode, Body: body, Header: resp.Header, size: len(data)}, nil
+}
@@ -0,0 +1,45 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build !windows && !aix
+// +build !windows,!aix
+
+package atatus // import "go.atatus.com/agent"
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockSpoolFile takes an exclusive lock on the named file, creating it
+// if necessary, returning errNotifySpoolLocked if the lock is held by
+// another process or tracer. The lock is released when the returned
+// file is closed, or when the process exits.
+func lockSpoolFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, errNotifySpoolLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
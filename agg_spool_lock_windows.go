@@ -0,0 +1,50 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus // import "go.atatus.com/agent"
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockSpoolFile opens the named file for exclusive access, creating it
+// if necessary, returning errNotifySpoolLocked if it is held open by
+// another process or tracer. The lock is released when the returned
+// file is closed, or when the process exits.
+func lockSpoolFile(name string) (*os.File, error) {
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFile(
+		path,
+		windows.GENERIC_READ|windows.GENERIC_WRITE,
+		0, // no sharing
+		nil,
+		windows.OPEN_ALWAYS,
+		windows.FILE_ATTRIBUTE_NORMAL,
+		0,
+	)
+	if err != nil {
+		if err == windows.ERROR_SHARING_VIOLATION {
+			return nil, errNotifySpoolLocked
+		}
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), name), nil
+}
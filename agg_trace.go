@@ -16,6 +16,11 @@
 
 package atatus
 
+import (
+	"sort"
+	"strings"
+)
+
 type aggTraceLayer struct {
 	aggTxnID
 }
@@ -39,6 +44,130 @@ type aggTrace struct {
 	Funcs     []string               `json:"funcs"`
 	Partial   bool                   `json:"partial"`
 	Custom    map[string]interface{} `json:"customData,omitempty"`
+
+	// Reason records why the trace was retained.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Reasons for retaining a trace, from the lowest to the highest rank.
+const (
+	traceReasonSlow        = "slow"
+	traceReasonSlowSpan    = "slow_span"
+	traceReasonHTTPFailure = "http_failure"
+	traceReasonError       = "error"
+)
+
+var traceReasonRanks = map[string]int{
+	traceReasonSlow:        0,
+	traceReasonSlowSpan:    1,
+	traceReasonHTTPFailure: 2,
+	traceReasonError:       3,
+}
+
+// outranks reports whether t should be kept in preference to other:
+// traces retained for a failure outrank slow traces, and traces
+// retained for the same reason are ranked by duration.
+func (t *aggTrace) outranks(other *aggTrace) bool {
+	rank, otherRank := traceReasonRanks[t.Reason], traceReasonRanks[other.Reason]
+	if rank != otherRank {
+		return rank > otherRank
+	}
+	return t.Duration > other.Duration
+}
+
+// traceRules holds the rules for retaining the trace of a transaction
+// that is faster than the trace threshold.
+type traceRules struct {
+	// errors retains traces of transactions with an error.
+	errors bool
+
+	// httpFailures retains traces of transactions reported
+	// as HTTP failures, as defined by isHTTPFailure.
+	httpFailures bool
+
+	// spanThresholds holds the duration in milliseconds, by span kind,
+	// above which a span's transaction trace is retained.
+	spanThresholds map[string]float64
+}
+
+// traceReason returns the reason for retaining the trace of a transaction
+// of the given duration in milliseconds, or an empty string if the trace
+// should not be retained.
+func (r *traceRules) traceReason(threshold, duration float64, errorCaptured, httpFailure bool, spans []*aggLayer) string {
+	if r.errors && errorCaptured {
+		return traceReasonError
+	}
+	if r.httpFailures && httpFailure {
+		return traceReasonHTTPFailure
+	}
+	if duration > threshold {
+		return traceReasonSlow
+	}
+	for _, s := range spans {
+		if max, ok := r.spanThresholds[strings.ToLower(s.layer.Kind)]; ok && s.Durations[1] > max {
+			return traceReasonSlowSpan
+		}
+	}
+	return ""
+}
+
+// aggSpanNode is a span placed in its transaction's call tree.
+type aggSpanNode struct {
+	span  *aggLayer
+	level int
+}
+
+// orderAggSpans returns the spans of the transaction identified by txnID
+// in call tree order: each span is followed by its descendants, and
+// siblings are ordered by start time. Spans whose parent is the
+// transaction are at level 1. Orphaned spans, whose parent was dropped
+// or did not end before the transaction, are placed at level 1.
+func orderAggSpans(txnID SpanID, spans []*aggLayer) []aggSpanNode {
+	byID := make(map[SpanID]*aggLayer, len(spans))
+	for _, s := range spans {
+		byID[s.id] = s
+	}
+
+	var roots []*aggLayer
+	children := make(map[SpanID][]*aggLayer)
+	for _, s := range spans {
+		if _, ok := byID[s.parentID]; !ok || s.parentID == txnID || s.parentID == s.id {
+			roots = append(roots, s)
+		} else {
+			children[s.parentID] = append(children[s.parentID], s)
+		}
+	}
+	sortByStart := func(s []*aggLayer) {
+		sort.SliceStable(s, func(i, j int) bool {
+			return s[i].Timestamp.Before(s[j].Timestamp)
+		})
+	}
+
+	nodes := make([]aggSpanNode, 0, len(spans))
+	visited := make(map[*aggLayer]bool, len(spans))
+	var visit func(s *aggLayer, level int)
+	visit = func(s *aggLayer, level int) {
+		if visited[s] {
+			return
+		}
+		visited[s] = true
+		nodes = append(nodes, aggSpanNode{span: s, level: level})
+		c := children[s.id]
+		sortByStart(c)
+		for _, child := range c {
+			visit(child, level+1)
+		}
+	}
+	sortByStart(roots)
+	for _, s := range roots {
+		visit(s, 1)
+	}
+	// Spans that are only reachable through a parent cycle
+	// are treated as orphans.
+	for _, s := range spans {
+		visit(s, 1)
+	}
+	return nodes
 }
 
 type aggTraceBatch struct {
@@ -48,11 +177,14 @@ type aggTraceBatch struct {
 	BackgroundSecondarySet aggTraceSet
 }
 
-func (b *aggTraceBatch) Init() {
-	b.PrimarySet.Init("primary", 5, true)
-	b.SecondarySet.Init("secondary", 4, false)
-	b.BackgroundPrimarySet.Init("backgroudPrimary", 5, true)
-	b.BackgroundSecondarySet.Init("backgroundSecondary", 4, false)
+// Init initializes the trace sets, keeping at most primary unique
+// traces, and secondary traces of transactions already in the
+// primary set.
+func (b *aggTraceBatch) Init(primary, secondary int) {
+	b.PrimarySet.Init("primary", primary, true)
+	b.SecondarySet.Init("secondary", secondary, false)
+	b.BackgroundPrimarySet.Init("backgroudPrimary", primary, true)
+	b.BackgroundSecondarySet.Init("backgroundSecondary", secondary, false)
 }
 
 func (b *aggTraceBatch) Add(key string, trace *aggTrace) {
@@ -65,9 +197,9 @@ func (b *aggTraceBatch) Add(key string, trace *aggTrace) {
 			if b.PrimarySet.SavedCount < b.PrimarySet.AllowedCount {
 				b.SecondarySet.Add(key, trace)
 			} else {
-				// if it is greater than 5, then we are going to send this set in all cases,
+				// if the primary set is full, then we are going to send this set in all cases,
 				// so no need to replace or check the secondary set
-				if trace.Duration > b.PrimarySet.Traces[index].Duration {
+				if trace.outranks(&b.PrimarySet.Traces[index]) {
 					b.PrimarySet.Traces[index] = *trace
 				}
 			}
@@ -80,9 +212,9 @@ func (b *aggTraceBatch) Add(key string, trace *aggTrace) {
 			if b.BackgroundPrimarySet.SavedCount < b.BackgroundPrimarySet.AllowedCount {
 				b.BackgroundSecondarySet.Add(key, trace)
 			} else {
-				// if it is greater than 5, then we are going to send this set in all cases,
+				// if the primary set is full, then we are going to send this set in all cases,
 				// so no need to replace or check the secondary set
-				if trace.Duration > b.BackgroundPrimarySet.Traces[index].Duration {
+				if trace.outranks(&b.BackgroundPrimarySet.Traces[index]) {
 					b.BackgroundPrimarySet.Traces[index] = *trace
 				}
 			}
@@ -91,14 +223,13 @@ func (b *aggTraceBatch) Add(key string, trace *aggTrace) {
 }
 
 type aggTraceSet struct {
-	Name           string
-	UniqueTraces   bool
-	AllowedCount   int
-	Stat           map[string]int
-	SavedCount     int
-	Traces         []aggTrace
-	LowestDuration float64
-	LowestIndex    int
+	Name         string
+	UniqueTraces bool
+	AllowedCount int
+	Stat         map[string]int
+	SavedCount   int
+	Traces       []aggTrace
+	LowestIndex  int
 }
 
 // ByTraceDuration implements sort.Interface for []aggTrace based on
@@ -109,6 +240,14 @@ func (a ByTraceDuration) Len() int           { return len(a) }
 func (a ByTraceDuration) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByTraceDuration) Less(i, j int) bool { return a[i].Duration > a[j].Duration }
 
+// byTraceRank implements sort.Interface for []aggTrace,
+// ordering the highest ranked traces first.
+type byTraceRank []aggTrace
+
+func (a byTraceRank) Len() int           { return len(a) }
+func (a byTraceRank) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTraceRank) Less(i, j int) bool { return a[i].outranks(&a[j]) }
+
 func (m *aggTraceSet) Init(name string, count int, uniqueTraces bool) {
 	m.Name = name
 	m.Traces = make([]aggTrace, 0, count)
@@ -122,34 +261,26 @@ func (m *aggTraceSet) Init(name string, count int, uniqueTraces bool) {
 func (m *aggTraceSet) Add(key string, trace *aggTrace) {
 	if m.SavedCount < m.AllowedCount {
 
-		if m.SavedCount == 0 {
-			m.LowestDuration = trace.Duration
-			m.LowestIndex = 0
-		}
-
 		m.Traces = append(m.Traces, *trace)
 		m.SavedCount++
 		if m.UniqueTraces {
 			m.Stat[key] = len(m.Traces) - 1
 		}
 
-		if trace.Duration < m.LowestDuration {
-			m.LowestDuration = trace.Duration
+		if m.SavedCount == 1 || m.Traces[m.LowestIndex].outranks(trace) {
 			m.LowestIndex = len(m.Traces) - 1
 		}
 
 	} else {
-		if trace.Duration > m.LowestDuration {
+		if trace.outranks(&m.Traces[m.LowestIndex]) {
 			if m.UniqueTraces {
 				delete(m.Stat, m.Traces[m.LowestIndex].Key())
 				m.Stat[key] = m.LowestIndex
 			}
 
 			m.Traces[m.LowestIndex] = *trace
-			m.LowestDuration = trace.Duration
 			for i := range m.Traces {
-				if m.Traces[i].Duration < m.LowestDuration {
-					m.LowestDuration = m.Traces[i].Duration
+				if m.Traces[m.LowestIndex].outranks(&m.Traces[i]) {
 					m.LowestIndex = i
 				}
 			}
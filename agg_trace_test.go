@@ -0,0 +1,204 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderAggSpans(t *testing.T) {
+	start := time.Unix(0, 0)
+	txnID := SpanID{1}
+	newSpan := func(id, parentID byte, offset time.Duration) *aggLayer {
+		s := &aggLayer{id: SpanID{id}, parentID: SpanID{parentID}, Timestamp: start.Add(offset)}
+		s.Name = string('a' + id)
+		return s
+	}
+	spans := []*aggLayer{
+		newSpan(4, 3, 3*time.Millisecond),  // grandchild, ends first
+		newSpan(3, 2, 2*time.Millisecond),  // child
+		newSpan(5, 1, 10*time.Millisecond), // second top-level span
+		newSpan(2, 1, 1*time.Millisecond),  // first top-level span
+		newSpan(6, 9, 5*time.Millisecond),  // orphan
+		newSpan(7, 8, 0),                   // cycle
+		newSpan(8, 7, 0),                   // cycle
+	}
+
+	var names []string
+	var levels []int
+	for _, node := range orderAggSpans(txnID, spans) {
+		names = append(names, node.span.Name)
+		levels = append(levels, node.level)
+	}
+	assert.Equal(t, []string{"c", "d", "e", "g", "f", "h", "i"}, names)
+	assert.Equal(t, []int{1, 2, 3, 1, 1, 1, 2}, levels)
+}
+
+func TestAggregatorTraceHierarchy(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+
+	tracer := newAggTestTracer(t, server.URL)
+	defer tracer.Close()
+
+	start := time.Now().Add(-3 * time.Second)
+	tx := tracer.StartTransactionOptions("name", "type", TransactionOptions{Start: start})
+	handler := tx.StartSpanOptions("handler", "app", SpanOptions{Start: start.Add(time.Millisecond)})
+	client := tx.StartSpanOptions("GET example.com", "external.http", SpanOptions{
+		Parent: handler.TraceContext(),
+		Start:  start.Add(2 * time.Millisecond),
+	})
+	redis := tx.StartSpanOptions("GET", "cache.redis", SpanOptions{
+		Parent: client.TraceContext(),
+		Start:  start.Add(3 * time.Millisecond),
+	})
+	redis.Duration = time.Millisecond
+	redis.End()
+	client.Duration = 5 * time.Millisecond
+	client.End()
+	handler.Duration = 10 * time.Millisecond
+	handler.End()
+	tx.End()
+	tracer.Flush(nil)
+
+	var traces []tracePayload
+	server.payloads(t, traceRelativePath, &traces)
+	require.Len(t, traces, 1)
+	require.Len(t, traces[0].T, 1)
+	entries := traces[0].T[0].Entries
+	require.Len(t, entries, 3)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, traces[0].T[0].Funcs[e.Index])
+	}
+	assert.Equal(t, []string{"handler", "GET example.com", "GET"}, names)
+	assert.Equal(t, []float64{1, 2, 3}, []float64{entries[0].Level, entries[1].Level, entries[2].Level})
+	assert.Equal(t, []float64{10, 5, 1}, []float64{entries[0].Duration, entries[1].Duration, entries[2].Duration})
+}
+
+func TestTraceRulesReason(t *testing.T) {
+	rules := traceRules{
+		errors:         true,
+		httpFailures:   true,
+		spanThresholds: map[string]float64{"database": 500},
+	}
+	query := &aggLayer{}
+	query.Kind = database
+	query.SetDuration(600)
+
+	assert.Equal(t, "", rules.traceReason(2000, 100, false, false, nil))
+	assert.Equal(t, traceReasonSlow, rules.traceReason(2000, 2500, false, false, nil))
+	assert.Equal(t, traceReasonError, rules.traceReason(2000, 2500, true, false, nil))
+	assert.Equal(t, traceReasonHTTPFailure, rules.traceReason(2000, 100, false, true, nil))
+	assert.Equal(t, traceReasonSlowSpan, rules.traceReason(2000, 700, false, false, []*aggLayer{query}))
+
+	query.SetDuration(400)
+	assert.Equal(t, "", rules.traceReason(2000, 700, false, false, []*aggLayer{query}))
+
+	rules = traceRules{}
+	assert.Equal(t, "", rules.traceReason(2000, 100, true, true, nil))
+}
+
+func TestIsHTTPFailure(t *testing.T) {
+	for statusCode, expected := range map[int]bool{
+		0:   false,
+		200: false,
+		302: false,
+		400: true,
+		404: false,
+		429: true,
+		503: true,
+	} {
+		assert.Equal(t, expected, isHTTPFailure(statusCode), statusCode)
+	}
+}
+
+func TestAggTraceSetRank(t *testing.T) {
+	var set aggTraceSet
+	set.Init("primary", 2, true)
+	newTrace := func(name, reason string, duration float64) *aggTrace {
+		trace := &aggTrace{Reason: reason, Duration: duration}
+		trace.Name = name
+		return trace
+	}
+	for _, trace := range []*aggTrace{
+		newTrace("a", traceReasonSlow, 3000),
+		newTrace("b", traceReasonSlow, 5000),
+		newTrace("c", traceReasonError, 10),
+		newTrace("d", traceReasonSlow, 4000),
+	} {
+		set.Add(trace.Key(), trace)
+	}
+
+	// Failing traces are not displaced by slower traces.
+	sort.Sort(byTraceRank(set.Traces))
+	require.Len(t, set.Traces, 2)
+	assert.Equal(t, "c", set.Traces[0].Name)
+	assert.Equal(t, "b", set.Traces[1].Name)
+}
+
+func TestAggregatorTraceRetention(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+
+	tracer := newAggTestTracer(t, server.URL)
+	defer tracer.Close()
+
+	tx := tracer.StartTransaction("error", "request")
+	e := tracer.NewError(assert.AnError)
+	e.SetTransaction(tx)
+	e.Send()
+	tx.End()
+
+	tx = tracer.StartTransaction("unavailable", "request")
+	tx.Context.SetHTTPStatusCode(503)
+	tx.End()
+
+	tracer.StartTransaction("fast", "request").End()
+	tracer.Flush(nil)
+
+	var traces []tracePayload
+	server.payloads(t, traceRelativePath, &traces)
+	reasons := make(map[string]string)
+	for _, p := range traces {
+		for _, trace := range p.T {
+			reasons[trace.Name] = trace.Reason
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"error":       traceReasonError,
+		"unavailable": traceReasonHTTPFailure,
+	}, reasons)
+}
+
+func TestParseTraceSpanThresholds(t *testing.T) {
+	thresholds, err := parseTraceSpanThresholds("db=500ms, external=1s")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"database": 500, "remote": 1000}, thresholds)
+
+	_, err = parseTraceSpanThresholds("db")
+	assert.EqualError(t, err, `invalid ATATUS_TRACE_SPAN_THRESHOLDS value "db", expected kind=duration`)
+
+	_, err = parseTraceSpanThresholds("db=fast")
+	assert.Error(t, err)
+}
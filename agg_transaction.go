@@ -17,6 +17,7 @@
 package atatus
 
 import (
+	"encoding/json"
 	"fmt"
 	// "net"
 	// "net/url"
@@ -44,13 +45,19 @@ type aggTxnID struct {
 
 type layer struct {
 	aggTxnID
-	Durations [4]float64 `json:"durations"`
+	Durations   [4]float64   `json:"durations"`
+	Percentiles *percentiles `json:"percentiles,omitempty"`
+
+	hist *durationHistogram
 }
 
 type aggLayer struct {
 	layer
 	Timestamp time.Time
 	Context   model.SpanContext
+
+	id       SpanID
+	parentID SpanID
 }
 
 type layerMap map[string]*layer
@@ -138,10 +145,12 @@ func (r *aggTxnAnalytics) TotalSize() int {
 
 	for k, v := range r.CustomData {
 		l = l + len(k)
-		vs, ok := v.(string)
-		if ok {
-			l = l + len(vs)
-		} else {
+		switch v := v.(type) {
+		case string:
+			l = l + len(v)
+		case json.RawMessage:
+			l = l + len(v)
+		default:
 			l = l + 4
 		}
 	}
@@ -162,6 +171,14 @@ func (mp *layer) SetDuration(dur float64) {
 	mp.Durations[3] = dur
 }
 
+// recordHistogram records the layer's duration in a new histogram,
+// from which its percentiles are computed. Histograms are recorded
+// only while percentiles are enabled by the server.
+func (mp *layer) recordHistogram() {
+	mp.hist = newDurationHistogram()
+	mp.hist.record(mp.Durations[1])
+}
+
 func (mp *layer) SetAllValues(dur float64, min float64, max float64, count float64) {
 	mp.Durations[0] = count
 	mp.Durations[1] = dur
@@ -178,6 +195,17 @@ func (mp *layer) Add(amp *layer) {
 	if mp.Durations[3] < amp.Durations[3] {
 		mp.Durations[3] = amp.Durations[3]
 	}
+	if mp.hist == nil {
+		mp.hist = amp.hist.clone()
+	} else {
+		mp.hist.merge(amp.hist)
+	}
+}
+
+// SetPercentiles sets the layer's reported percentiles
+// from the durations recorded in its histogram.
+func (mp *layer) SetPercentiles() {
+	mp.Percentiles = mp.hist.percentiles()
 }
 
 func (mp *layer) String() string {
@@ -188,10 +216,6 @@ func (m *aggTxnID) isBackgroundTxn() bool {
 	return m.BackgroundTxn
 }
 
-func (mp *aggTxn) isValidHistogramDuration() bool {
-	return (mp.Durations[1] <= 150*1000.0)
-}
-
 func (mp *aggTxn) Add(amp *aggTxn) {
 	mp.layer.Add(&amp.layer)
 	for key := range amp.Layers {
@@ -236,6 +260,9 @@ func (mp *aggTxn) SetGoCodeTiming() {
 		languageLayer.Type = golang
 		languageLayer.Kind = golang
 		languageLayer.SetDuration(roundThreeDecimals(txnDuration - layersDuration))
+		if mp.hist != nil {
+			languageLayer.recordHistogram()
+		}
 		key := languageLayer.Key()
 		layer, ok := mp.Layers[key]
 		if !ok {
@@ -17,6 +17,10 @@
 package atatus // import "go.atatus.com/agent"
 
 import (
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.atatus.com/agent/internal/apmlog"
@@ -55,31 +59,115 @@ type features struct {
 	tracing            bool
 }
 
+// aggregatorOptions holds options for sending the aggregator's payloads.
+type aggregatorOptions struct {
+	// retryQueueSize is the maximum number of failed payloads
+	// queued for retrying. If zero, failed payloads are dropped.
+	retryQueueSize int
+
+	// spoolDir, if non-empty, is the directory in which queued
+	// payloads are persisted, limited to spoolMaxSize bytes and
+	// payloads no older than spoolMaxAge. Payloads are persisted
+	// in a subdirectory per app name and license key.
+	spoolDir     string
+	spoolMaxSize int64
+	spoolMaxAge  time.Duration
+
+	// compress controls whether payloads of at least compressMinSize
+	// bytes are gzip-compressed.
+	compress        bool
+	compressMinSize int
+
+	// sink, if non-nil, receives the payloads in place
+	// of the notify host.
+	sink PayloadSink
+
+	// stats, if non-nil, holds the tracer stats
+	// updated with the aggregator's statistics.
+	stats *TracerStats
+
+	// traceRules holds the rules for retaining traces of
+	// transactions faster than the trace threshold.
+	traceRules traceRules
+
+	// limits, if non-nil, returns the current batch limits.
+	// If nil, defaultBatchLimits is used.
+	limits func() batchLimits
+}
+
+// batchLimits holds the maximum number of events of each
+// kind kept in a batch, and the maximum size of the
+// analytics payloads.
+type batchLimits struct {
+	errors               int
+	errorRequests        int
+	traces               int
+	secondaryTraces      int
+	analyticsEvents      int
+	analyticsPayloadSize int
+	metrics              int
+}
+
+var defaultBatchLimits = batchLimits{
+	errors:               defaultMaxErrors,
+	errorRequests:        defaultMaxErrorRequests,
+	traces:               defaultMaxTraces,
+	secondaryTraces:      defaultMaxSecondaryTraces,
+	analyticsEvents:      defaultMaxAnalyticsEvents,
+	analyticsPayloadSize: int(defaultMaxAnalyticsPayloadSize),
+	metrics:              defaultMaxMetrics,
+}
+
 type aggregator struct {
 	// config  configuration
 	service *tracerService
+	opts    aggregatorOptions
 
 	b *batchEvents
 
 	c aggChannels
 
-	flushTicker      *time.Ticker
-	flushTickerCount int
+	flushTicker    *time.Ticker
+	intervalChange chan time.Duration
+
+	process     *model.Process
+	system      *model.System
+	host        hostInfo
+	hostDetails map[string]interface{}
 
-	process *model.Process
-	system  *model.System
-	host    hostInfo
+	// flushMu serializes flushes, and protects lastHostinfo.
+	flushMu      sync.Mutex
+	lastHostinfo time.Time
 
-	features features
+	// flushes tracks the batches being flushed in the background,
+	// which must complete before the aggregator is closed.
+	flushes sync.WaitGroup
+
+	// mu protects features, and the state reported as
+	// active in hostinfo.
+	mu          sync.RWMutex
+	features    features
+	active      bool
+	activeSince time.Time
+
+	// patterns holds the *hostinfoPatterns from the most
+	// recent successful hostinfo response.
+	patterns atomic.Value
 
 	savedFramework string
 
 	logger WarningLogger
 
-	modelWriter *modelWriter // at_handling send stream
+	sink  PayloadSink
+	retry *notifyRetryQueue
+	stats *TracerStats
+
+	forceFlush chan chan<- struct{}
+	closing    chan struct{}
+	closed     chan struct{}
 }
 
-func newBatch() *batchEvents {
+func newBatch(limits batchLimits) *batchEvents {
 	var b batchEvents
 	b.begin = time.Now()
 
@@ -87,7 +175,7 @@ func newBatch() *batchEvents {
 	b.txnSpan = make(aggTxnLayerMap, 0)
 	b.txnAnalytics = make([]*aggTxnAnalytics, 0)
 	b.trace = new(aggTraceBatch)
-	b.trace.Init()
+	b.trace.Init(limits.traces, limits.secondaryTraces)
 	b.errMetric = make(httpErrorMetricMap)
 	b.errRequest = make([]httpErrorRequest, 0)
 	b.err = make([]*aggError, 0)
@@ -95,14 +183,23 @@ func newBatch() *batchEvents {
 	return &b
 }
 
-var hostDetails map[string]interface{}
+func (b *batchEvents) isEmpty() bool {
+	return len(b.txn) == 0 &&
+		len(b.txnAnalytics) == 0 &&
+		len(b.trace.PrimarySet.Traces) == 0 &&
+		len(b.trace.BackgroundPrimarySet.Traces) == 0 &&
+		len(b.errMetric) == 0 &&
+		len(b.err) == 0 &&
+		len(b.metrics) == 0
+}
 
-func newAggregator(service *tracerService) *aggregator {
+func newAggregator(service *tracerService, opts aggregatorOptions) *aggregator {
 
 	config := newConfiguration(*service)
 
 	agg := aggregator{
 		service: service,
+		opts:    opts,
 		// config:  config,
 		process: &currentProcess,
 		system:  &localSystem,
@@ -112,17 +209,58 @@ func newAggregator(service *tracerService) *aggregator {
 		agg.logger = apmlog.DefaultLogger
 	}
 
-	timeout := 60
-	agg.flushTicker = time.NewTicker(time.Duration(timeout) * time.Second)
+	agg.stats = opts.stats
+	if agg.stats == nil {
+		agg.stats = &TracerStats{}
+	}
+	agg.sink = opts.sink
+	if agg.sink == nil {
+		client, err := newNotifyHTTPClient(service.NotifyProxy)
+		if err != nil {
+			if agg.logger != nil {
+				agg.logger.Errorf("Configuring notify HTTP client failed: %s\n", err.Error())
+			}
+			client = &http.Client{Timeout: defaultNotifyTimeout}
+		}
+		agg.sink = &httpPayloadSink{
+			service: service,
+			client:  client,
+			opts:    opts,
+			logger:  agg.logger,
+		}
+	}
+
+	if opts.retryQueueSize > 0 {
+		var spool *notifySpool
+		if opts.spoolDir != "" {
+			var err error
+			dir := filepath.Join(opts.spoolDir, notifySpoolSubdir(service.AppName, service.LicenseKey))
+			spool, err = newNotifySpool(dir, opts.spoolMaxSize, opts.spoolMaxAge)
+			if err == errNotifySpoolLocked && agg.logger != nil {
+				agg.logger.Warningf("Spool directory %s is in use by another process, failed payloads will not be spooled\n", dir)
+			} else if err != nil && agg.logger != nil {
+				agg.logger.Errorf("Opening spool directory %s failed: %s\n", dir, err.Error())
+			}
+		}
+		agg.retry = newNotifyRetryQueue(opts.retryQueueSize, spool, agg.logger)
+	}
+
+	agg.flushTicker = time.NewTicker(defaultNotifyInterval)
+	agg.intervalChange = make(chan time.Duration)
 
 	agg.c.txnChan = make(chan tracerEvent, tracerEventChannelCap)
 	agg.c.spanChan = make(chan tracerEvent, tracerEventChannelCap)
 	agg.c.errChan = make(chan tracerEvent, tracerEventChannelCap)
 	agg.c.metricsChan = make(chan *Metrics, tracerEventChannelCap)
 
+	agg.forceFlush = make(chan chan<- struct{})
+	agg.closing = make(chan struct{})
+	agg.closed = make(chan struct{})
+
 	agg.savedFramework = ""
 
-	hostDetails, _ = sysinfo.Host()
+	hostDetails, _ := sysinfo.Host()
+	agg.hostDetails = hostDetails
 
 	if agg.host.hostID == "" {
 		if val, ok := hostDetails["bootId"]; ok {
@@ -173,21 +311,87 @@ func newAggregator(service *tracerService) *aggregator {
 		agg.host.dockerID = val.(string)
 	}
 
-	agg.b = newBatch()
+	agg.b = newBatch(agg.limits())
 
 	go agg.processEvents()
+	if agg.retry != nil {
+		go agg.retry.run(agg.resend, agg.closed)
+	}
 
 	return &agg
 }
 
-func (agg *aggregator) setModelWriter(m *modelWriter) { // at_handling send stream
-	agg.modelWriter = m // at_handling send stream
+// hostinfoPatterns returns the patterns from the most recent successful
+// hostinfo response, or nil if there has been none.
+func (agg *aggregator) hostinfoPatterns() *hostinfoPatterns {
+	p, _ := agg.patterns.Load().(*hostinfoPatterns)
+	return p
+}
+
+// limits returns the current batch limits.
+func (agg *aggregator) limits() batchLimits {
+	if agg.opts.limits == nil {
+		return defaultBatchLimits
+	}
+	return agg.opts.limits()
+}
+
+// currentFeatures returns the features enabled by
+// the most recent hostinfo response.
+func (agg *aggregator) currentFeatures() features {
+	agg.mu.RLock()
+	defer agg.mu.RUnlock()
+	return agg.features
+}
+
+// streaming reports whether events are also sent
+// to the server as a stream.
+func (agg *aggregator) streaming() bool {
+	return agg.service.Tracing && agg.currentFeatures().tracing
+}
+
+// requestFlush requests that the aggregator process any queued events and
+// send its current batch. A value is sent on flushed once the batch has been
+// sent, or immediately if there was nothing to send.
+func (agg *aggregator) requestFlush(flushed chan<- struct{}) {
+	select {
+	case agg.forceFlush <- flushed:
+	case <-agg.closed:
+		flushed <- struct{}{}
+	}
+}
+
+// setNotifyInterval sets the interval at which the aggregator sends its
+// batch. The next batch is sent one full interval after the change.
+func (agg *aggregator) setNotifyInterval(d time.Duration) {
+	select {
+	case agg.intervalChange <- d:
+	case <-agg.closed:
+	}
+}
+
+// close sends the current batch and stops the aggregator, blocking until
+// the final flush has completed.
+func (agg *aggregator) close() {
+	select {
+	case <-agg.closing:
+	default:
+		close(agg.closing)
+	}
+	<-agg.closed
 }
 
 func (agg *aggregator) processEvents() {
+	defer close(agg.closed)
+	defer func() {
+		agg.flushTicker.Stop()
+	}()
 	for {
 		select {
 		case event := <-agg.c.txnChan:
+			// A transaction's spans are queued before the transaction
+			// ends, so process them first to attribute them to it.
+			agg.processQueuedSpans()
 			agg.processTxn(event.tx.Transaction, event.tx.TransactionData)
 		case event := <-agg.c.spanChan:
 			agg.processSpan(event.span.Span, event.span.SpanData)
@@ -196,8 +400,71 @@ func (agg *aggregator) processEvents() {
 		case metrics := <-agg.c.metricsChan:
 			agg.processMetrics(metrics)
 		case <-agg.flushTicker.C:
-			go agg.flush(agg.b)
-			agg.b = newBatch()
+			b := agg.b
+			agg.b = newBatch(agg.limits())
+			agg.flushes.Add(1)
+			go func() {
+				defer agg.flushes.Done()
+				agg.flush(b)
+			}()
+		case d := <-agg.intervalChange:
+			agg.flushTicker.Stop()
+			agg.flushTicker = time.NewTicker(d)
+		case flushed := <-agg.forceFlush:
+			agg.processQueuedEvents()
+			if agg.b.isEmpty() {
+				flushed <- struct{}{}
+				continue
+			}
+			b := agg.b
+			agg.b = newBatch(agg.limits())
+			agg.flushes.Add(1)
+			go func() {
+				defer agg.flushes.Done()
+				agg.flush(b)
+				flushed <- struct{}{}
+			}()
+		case <-agg.closing:
+			agg.processQueuedEvents()
+			if !agg.b.isEmpty() {
+				agg.flush(agg.b)
+			}
+			agg.flushes.Wait()
+			agg.b = newBatch(agg.limits())
+			if sink, ok := agg.sink.(*exportPayloadSink); ok {
+				sink.close()
+			}
+			if agg.retry != nil && agg.retry.spool != nil {
+				agg.retry.spool.close()
+			}
+			return
 		}
 	}
 }
+
+// processQueuedEvents processes the events already queued in the
+// aggregator's channels. Spans are processed before transactions,
+// so they are attributed to the transaction's layers and trace.
+func (agg *aggregator) processQueuedEvents() {
+	agg.processQueuedSpans()
+	for n := len(agg.c.txnChan); n > 0; n-- {
+		event := <-agg.c.txnChan
+		agg.processTxn(event.tx.Transaction, event.tx.TransactionData)
+	}
+	for n := len(agg.c.errChan); n > 0; n-- {
+		event := <-agg.c.errChan
+		agg.processError(event.err)
+	}
+	for n := len(agg.c.metricsChan); n > 0; n-- {
+		agg.processMetrics(<-agg.c.metricsChan)
+	}
+}
+
+// processQueuedSpans processes the spans already queued
+// in the aggregator's span channel.
+func (agg *aggregator) processQueuedSpans() {
+	for n := len(agg.c.spanChan); n > 0; n-- {
+		event := <-agg.c.spanChan
+		agg.processSpan(event.span.Span, event.span.SpanData)
+	}
+}
@@ -0,0 +1,385 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.atatus.com/agent/transport"
+)
+
+type aggRecorderServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	paths    []string
+	bodies   [][]byte
+	hostinfo []byte
+}
+
+func newAggRecorderServer() *aggRecorderServer {
+	s := &aggRecorderServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body := req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			body, _ = gzip.NewReader(req.Body)
+		}
+		data, _ := ioutil.ReadAll(body)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.paths = append(s.paths, req.URL.Path)
+		s.bodies = append(s.bodies, data)
+		if req.URL.Path == hostinfoRelativePath && s.hostinfo != nil {
+			w.Write(s.hostinfo)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	return s
+}
+
+// payloads decodes the payloads received for path into out, which must
+// be a pointer to a slice.
+func (s *aggRecorderServer) payloads(t *testing.T, path string, out interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var raw []json.RawMessage
+	for i, p := range s.paths {
+		if p == path {
+			raw = append(raw, s.bodies[i])
+		}
+	}
+	data, err := json.Marshal(raw)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, out))
+}
+
+func (s *aggRecorderServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for _, p := range s.paths {
+		if p == path {
+			n++
+		}
+	}
+	return n
+}
+
+func newAggTestTracer(t *testing.T, notifyHost string) *Tracer {
+	tracer, err := NewTracerOptions(TracerOptions{
+		ServiceName: "aggregator_test",
+		LicenseKey:  "license_key",
+		NotifyHost:  notifyHost,
+		Transport:   transport.Discard,
+	})
+	require.NoError(t, err)
+	return tracer
+}
+
+func TestTracerFlushAggregator(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+
+	tracer := newAggTestTracer(t, server.URL)
+	defer tracer.Close()
+
+	tracer.StartTransaction("name", "type").End()
+	tracer.Flush(nil)
+	assert.Equal(t, 1, server.count(hostinfoRelativePath))
+	assert.Equal(t, 1, server.count(txnRelativePath))
+
+	// Flushing an empty batch sends nothing.
+	tracer.Flush(nil)
+	assert.Equal(t, 1, server.count(txnRelativePath))
+}
+
+func TestTracerConcurrentFlush(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Delay responses, so later Flush calls arrive
+		// while the aggregator is still flushing.
+		time.Sleep(50 * time.Millisecond)
+		server.Config.Handler.ServeHTTP(w, req)
+	}))
+	defer slow.Close()
+
+	tracer := newAggTestTracer(t, slow.URL)
+	defer tracer.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tracer.StartTransaction("name", "type").End()
+			tracer.Flush(nil)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for Flush calls to return")
+	}
+	assert.NotZero(t, server.count(txnRelativePath))
+}
+
+func TestTracerCloseFlushesAggregator(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+
+	tracer := newAggTestTracer(t, server.URL)
+	tracer.StartTransaction("name", "type").End()
+	e := tracer.NewError(assert.AnError)
+	e.Send()
+	tracer.Close()
+
+	assert.Equal(t, 1, server.count(txnRelativePath))
+	assert.Equal(t, 1, server.count(errorRelativePath))
+
+	// Flush must not block once the tracer has been closed.
+	tracer.Flush(nil)
+}
+
+func TestTracerSetNotifyInterval(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+
+	tracer := newAggTestTracer(t, server.URL)
+	defer tracer.Close()
+	tracer.SetNotifyInterval(10 * time.Millisecond)
+
+	tracer.StartTransaction("name", "type").End()
+	assert.Eventually(t, func() bool {
+		return server.count(txnRelativePath) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestInitialNotifyInterval(t *testing.T) {
+	os.Setenv(envNotifyInterval, "5s")
+	defer os.Unsetenv(envNotifyInterval)
+	interval, err := initialNotifyInterval()
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, interval)
+
+	os.Setenv(envNotifyInterval, "10ms")
+	_, err = initialNotifyInterval()
+	assert.EqualError(t, err, "ATATUS_NOTIFY_INTERVAL must be at least 1s, got 10ms")
+}
+
+func TestAggregatorMultipleTracers(t *testing.T) {
+	const n = 4
+	var wg sync.WaitGroup
+	servers := make([]*aggRecorderServer, n)
+	for i := range servers {
+		servers[i] = newAggRecorderServer()
+		servers[i].hostinfo = []byte(`{"analytics": true, "tracing": true}`)
+		defer servers[i].Close()
+
+		tracer, err := NewTracerOptions(TracerOptions{
+			ServiceName: fmt.Sprintf("aggregator_test_%d", i),
+			LicenseKey:  "license_key",
+			NotifyHost:  servers[i].URL,
+			Transport:   transport.Discard,
+		})
+		require.NoError(t, err)
+		tracer.SetNotifyInterval(time.Millisecond)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer tracer.Close()
+			for j := 0; j < 50; j++ {
+				tx := tracer.StartTransaction("name", "type")
+				tx.StartSpan("span", "db.sql", nil).End()
+				e := tracer.NewError(assert.AnError)
+				e.SetTransaction(tx)
+				e.Send()
+				tx.End()
+				if j%10 == 0 {
+					tracer.Flush(nil)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, server := range servers {
+		var hostinfos []hostinfoPayload
+		server.payloads(t, hostinfoRelativePath, &hostinfos)
+		require.NotEmpty(t, hostinfos)
+		// Each aggregator reports itself as inactive until it has sent data.
+		assert.False(t, hostinfos[0].Active)
+
+		var txns []txnPayload
+		server.payloads(t, txnRelativePath, &txns)
+		var count float64
+		for _, p := range txns {
+			assert.Equal(t, fmt.Sprintf("aggregator_test_%d", i), p.AppName)
+			for _, txn := range p.T {
+				count += txn.Durations[0]
+			}
+		}
+		assert.Equal(t, float64(50), count)
+	}
+}
+
+func TestTracerStatsAggregator(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+
+	tracer := newAggTestTracer(t, server.URL)
+	defer tracer.Close()
+
+	for i := 0; i < 25; i++ {
+		tracer.NewError(assert.AnError).Send()
+	}
+	tracer.SendMetrics(nil)
+	tracer.Flush(nil)
+
+	stats := tracer.Stats().Aggregator
+	assert.Equal(t, uint64(5), stats.ErrorsDropped)
+	assert.Equal(t, TracerStatsPayload{Sent: 1}, stats.Payloads.Hostinfo)
+	assert.Equal(t, TracerStatsPayload{Sent: 1}, stats.Payloads.Errors)
+	assert.Equal(t, TracerStatsPayload{Sent: 1}, stats.Payloads.Metrics)
+	assert.NotZero(t, stats.BytesSent)
+	assert.NotZero(t, stats.LastFlushDuration)
+
+	var metrics []metricsPayload
+	server.payloads(t, metricsRelativePath, &metrics)
+	require.Len(t, metrics, 1)
+	agentMetrics := metrics[0].M[len(metrics[0].M)-1]
+	assert.Equal(t, float64(5), agentMetrics["agent.errors.dropped"].Value)
+	assert.Equal(t, float64(2), agentMetrics["agent.payloads.sent"].Value)
+
+	server.Close()
+	tracer.NewError(assert.AnError).Send()
+	tracer.Flush(nil)
+	stats = tracer.Stats().Aggregator
+	assert.Equal(t, TracerStatsPayload{Sent: 1, Failed: 1}, stats.Payloads.Errors)
+}
+
+func TestTracerBatchLimits(t *testing.T) {
+	server := newAggRecorderServer()
+	defer server.Close()
+
+	tracer, err := NewTracerOptions(TracerOptions{
+		ServiceName: "aggregator_test",
+		LicenseKey:  "license_key",
+		NotifyHost:  server.URL,
+		Transport:   transport.Discard,
+		MaxErrors:   2,
+		MaxTraces:   2,
+	})
+	require.NoError(t, err)
+	defer tracer.Close()
+
+	start := time.Now().Add(-3 * time.Second)
+	for i := 0; i < 3; i++ {
+		tracer.StartTransactionOptions(fmt.Sprintf("name%d", i), "type", TransactionOptions{Start: start}).End()
+		tracer.NewError(assert.AnError).Send()
+	}
+	tracer.Flush(nil)
+
+	var errs []errPayload
+	server.payloads(t, errorRelativePath, &errs)
+	require.Len(t, errs, 1)
+	assert.Len(t, errs[0].E, 2)
+	assert.Equal(t, 2, server.count(traceRelativePath))
+
+	// Limits set through central config take precedence,
+	// until they are removed.
+	tracer.updateRemoteConfig(nil, nil, map[string]string{"max_errors": "1"})
+	for i := 0; i < 3; i++ {
+		tracer.NewError(assert.AnError).Send()
+	}
+	tracer.Flush(nil)
+	tracer.updateRemoteConfig(nil, map[string]string{"max_errors": "1"}, map[string]string{})
+	for i := 0; i < 3; i++ {
+		tracer.NewError(assert.AnError).Send()
+	}
+	tracer.Flush(nil)
+
+	errs = nil
+	server.payloads(t, errorRelativePath, &errs)
+	require.Len(t, errs, 3)
+	assert.Len(t, errs[1].E, 1)
+	assert.Len(t, errs[2].E, 2)
+}
+
+func TestAggregatorMetricsLimit(t *testing.T) {
+	limits := defaultBatchLimits
+	limits.metrics = 2
+	agg := &aggregator{
+		opts:  aggregatorOptions{limits: func() batchLimits { return limits }},
+		b:     newBatch(limits),
+		stats: &TracerStats{},
+	}
+	for i := 0; i < 3; i++ {
+		var m Metrics
+		m.Add("metric", nil, float64(i))
+		agg.processMetrics(&m)
+	}
+	assert.Len(t, agg.b.metrics, 2)
+	assert.Equal(t, uint64(1), agg.stats.Aggregator.MetricsDropped)
+}
+
+func TestInitialBatchLimits(t *testing.T) {
+	os.Setenv(envMaxErrors, "100")
+	defer os.Unsetenv(envMaxErrors)
+	limit, err := initialMaxErrors()
+	require.NoError(t, err)
+	assert.Equal(t, 100, limit)
+
+	os.Setenv(envMaxErrors, "0")
+	_, err = initialMaxErrors()
+	assert.EqualError(t, err, "ATATUS_MAX_ERRORS must be greater than zero, got 0")
+
+	os.Setenv(envMaxMetrics, "50")
+	defer os.Unsetenv(envMaxMetrics)
+	limit, err = initialMaxMetrics()
+	require.NoError(t, err)
+	assert.Equal(t, 50, limit)
+
+	os.Setenv(envMaxAnalyticsPayloadSize, "1MB")
+	defer os.Unsetenv(envMaxAnalyticsPayloadSize)
+	size, err := initialMaxAnalyticsPayloadSize()
+	require.NoError(t, err)
+	assert.Equal(t, 1024*1024, size)
+
+	os.Setenv(envMaxAnalyticsPayloadSize, "lots")
+	_, err = initialMaxAnalyticsPayloadSize()
+	assert.Error(t, err)
+}
@@ -0,0 +1,104 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmtest // import "go.atatus.com/agent/apmtest"
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	atatus "go.atatus.com/agent"
+)
+
+// DefaultHostinfoResponse is the response body PayloadRecorder sends for
+// hostinfo payloads when its HostinfoResponse field is nil. It enables
+// analytics and percentiles, so that all payload kinds are recorded.
+var DefaultHostinfoResponse = []byte(`{"analytics": true, "capturePercentiles": true}`)
+
+// PayloadRecorder implements atatus.PayloadSink, recording the aggregated
+// payloads in memory. The payloads can be retrieved using the Payloads and
+// DecodePayloads methods.
+type PayloadRecorder struct {
+	// HostinfoResponse, if non-nil, holds the response body sent
+	// for hostinfo payloads in place of DefaultHostinfoResponse.
+	HostinfoResponse []byte
+
+	mu       sync.Mutex
+	payloads []atatus.Payload
+}
+
+// SendPayload records p, responding with a 200 status code.
+func (r *PayloadRecorder) SendPayload(ctx context.Context, p atatus.Payload) (*atatus.PayloadResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payloads = append(r.payloads, p)
+	resp := &atatus.PayloadResponse{StatusCode: http.StatusOK}
+	if p.Kind == atatus.PayloadHostinfo {
+		resp.Body = r.HostinfoResponse
+		if resp.Body == nil {
+			resp.Body = DefaultHostinfoResponse
+		}
+	}
+	return resp, nil
+}
+
+// Payloads returns the recorded payloads of the given kinds, in the order
+// they were sent. If no kinds are specified, all payloads are returned.
+func (r *PayloadRecorder) Payloads(kinds ...atatus.PayloadKind) []atatus.Payload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var payloads []atatus.Payload
+	for _, p := range r.payloads {
+		if len(kinds) == 0 || containsPayloadKind(kinds, p.Kind) {
+			payloads = append(payloads, p)
+		}
+	}
+	return payloads
+}
+
+// DecodePayloads decodes the recorded payloads of the given kind into out,
+// which must be a pointer to a slice of a type to decode each payload into,
+// such as *[]map[string]interface{}.
+func (r *PayloadRecorder) DecodePayloads(kind atatus.PayloadKind, out interface{}) error {
+	payloads := r.Payloads(kind)
+	data := make([]json.RawMessage, len(payloads))
+	for i, p := range payloads {
+		data[i] = p.Data
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, out)
+}
+
+// ResetPayloads clears out any recorded payloads.
+func (r *PayloadRecorder) ResetPayloads() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payloads = nil
+}
+
+func containsPayloadKind(kinds []atatus.PayloadKind, kind atatus.PayloadKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
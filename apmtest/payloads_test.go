@@ -0,0 +1,71 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package apmtest_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	atatus "go.atatus.com/agent"
+	"go.atatus.com/agent/apmtest"
+)
+
+func TestRecordingTracerAggregatedPayloads(t *testing.T) {
+	os.Setenv("ATATUS_ANALYTICS", "true")
+	defer os.Unsetenv("ATATUS_ANALYTICS")
+	r := apmtest.NewRecordingTracer()
+	defer r.Close()
+
+	// Analytics are enabled by the hostinfo response,
+	// which is received with the first payloads.
+	r.StartTransaction("warmup", "request").End()
+	r.Flush(nil)
+	require.Len(t, r.AggregatedPayloads.Payloads(atatus.PayloadHostinfo), 1)
+	r.AggregatedPayloads.ResetPayloads()
+
+	tx := r.StartTransaction("GET /", "request")
+	r.NewError(errors.New("boom")).Send()
+	tx.End()
+	r.Flush(nil)
+
+	kinds := make(map[atatus.PayloadKind]int)
+	for _, p := range r.AggregatedPayloads.Payloads() {
+		kinds[p.Kind]++
+	}
+	assert.Equal(t, 1, kinds[atatus.PayloadTransaction])
+	assert.Equal(t, 1, kinds[atatus.PayloadError])
+	assert.Equal(t, 1, kinds[atatus.PayloadAnalytics])
+
+	var txns []struct {
+		Transactions []struct {
+			Name        string                 `json:"name"`
+			Percentiles map[string]interface{} `json:"percentiles"`
+		} `json:"transactions"`
+	}
+	require.NoError(t, r.AggregatedPayloads.DecodePayloads(atatus.PayloadTransaction, &txns))
+	require.Len(t, txns, 1)
+	require.Len(t, txns[0].Transactions, 1)
+	assert.Equal(t, "GET /", txns[0].Transactions[0].Name)
+	assert.NotNil(t, txns[0].Transactions[0].Percentiles)
+
+	r.AggregatedPayloads.ResetPayloads()
+	assert.Empty(t, r.AggregatedPayloads.Payloads(atatus.PayloadError))
+}
@@ -27,11 +27,13 @@ import (
 )
 
 // NewRecordingTracer returns a new RecordingTracer, containing a new
-// Tracer using the RecorderTransport stored inside.
+// Tracer using the RecorderTransport and PayloadRecorder stored inside.
 func NewRecordingTracer() *RecordingTracer {
 	var result RecordingTracer
 	tracer, err := atatus.NewTracerOptions(atatus.TracerOptions{
-		Transport: &result.RecorderTransport,
+		LicenseKey:  "apmtest",
+		Transport:   &result.RecorderTransport,
+		PayloadSink: &result.AggregatedPayloads,
 	})
 	if err != nil {
 		panic(err)
@@ -40,10 +42,12 @@ func NewRecordingTracer() *RecordingTracer {
 	return &result
 }
 
-// RecordingTracer holds an atatus.Tracer and transporttest.RecorderTransport.
+// RecordingTracer holds an atatus.Tracer, transporttest.RecorderTransport,
+// and the PayloadRecorder receiving the tracer's aggregated payloads.
 type RecordingTracer struct {
 	*atatus.Tracer
 	transporttest.RecorderTransport
+	AggregatedPayloads PayloadRecorder
 }
 
 // WithTransaction calls rt.WithTransactionOptions with a zero atatus.TransactionOptions.
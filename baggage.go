@@ -0,0 +1,306 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus // import "go.atatus.com/agent"
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxBaggageMembers is the maximum number of members allowed
+	// in baggage, as defined by the W3C Baggage specification.
+	maxBaggageMembers = 180
+
+	// maxBaggageSize is the maximum size in bytes of the encoded
+	// baggage, as defined by the W3C Baggage specification.
+	maxBaggageSize = 8192
+)
+
+// Baggage holds W3C Baggage: a set of application-defined key/value
+// pairs, propagated across service boundaries alongside the trace
+// context. Baggage can be used, for example, to carry a tenant ID set
+// at the edge of a system to every downstream service.
+//
+// Baggage is immutable; Set, SetMember, and Delete return modified
+// copies, leaving the receiver unchanged.
+type Baggage struct {
+	members []BaggageMember
+}
+
+// BaggageMember holds a baggage member: a key/value pair, with
+// optional properties.
+type BaggageMember struct {
+	// Key holds the member's key, which must be a valid HTTP token.
+	Key string
+
+	// Value holds the member's value. Values may hold any string;
+	// characters not permitted in the baggage header are
+	// percent-encoded during propagation.
+	Value string
+
+	// Properties holds optional metadata for the member, in the
+	// form of semicolon-separated "key" or "key=value" properties.
+	Properties string
+}
+
+// NewBaggage returns a Baggage holding members. If multiple members
+// have the same key, the last one is kept.
+//
+// The returned Baggage is not necessarily valid. Use Baggage.Validate
+// to validate the baggage as required.
+func NewBaggage(members ...BaggageMember) Baggage {
+	var out Baggage
+	for _, m := range members {
+		out = out.set(m)
+	}
+	return out
+}
+
+// Len returns the number of members in b.
+func (b Baggage) Len() int {
+	return len(b.members)
+}
+
+// Members returns a copy of the members of b.
+func (b Baggage) Members() []BaggageMember {
+	if len(b.members) == 0 {
+		return nil
+	}
+	return append([]BaggageMember(nil), b.members...)
+}
+
+// Member returns the member of b with the given key, and a boolean
+// indicating whether or not the member exists.
+func (b Baggage) Member(key string) (BaggageMember, bool) {
+	for _, m := range b.members {
+		if m.Key == key {
+			return m, true
+		}
+	}
+	return BaggageMember{}, false
+}
+
+// Get returns the value of the member of b with the given key,
+// or the empty string if there is no such member.
+func (b Baggage) Get(key string) string {
+	m, _ := b.Member(key)
+	return m.Value
+}
+
+// Set returns a copy of b with the member for key set to value,
+// replacing any existing member with the same key.
+//
+// Set returns an error, and b unmodified, if the key is invalid,
+// or if the resulting baggage would exceed the W3C Baggage limits.
+func (b Baggage) Set(key, value string) (Baggage, error) {
+	return b.SetMember(BaggageMember{Key: key, Value: value})
+}
+
+// SetMember returns a copy of b with m added, replacing any existing
+// member with the same key.
+//
+// SetMember returns an error, and b unmodified, if m is invalid, or
+// if the resulting baggage would exceed the W3C Baggage limits.
+func (b Baggage) SetMember(m BaggageMember) (Baggage, error) {
+	if err := m.Validate(); err != nil {
+		return b, err
+	}
+	out := b.set(m)
+	if err := out.validateLimits(); err != nil {
+		return b, err
+	}
+	return out, nil
+}
+
+// Delete returns a copy of b without the member for key.
+func (b Baggage) Delete(key string) Baggage {
+	for i, m := range b.members {
+		if m.Key == key {
+			members := make([]BaggageMember, 0, len(b.members)-1)
+			members = append(members, b.members[:i]...)
+			members = append(members, b.members[i+1:]...)
+			return Baggage{members: members}
+		}
+	}
+	return b
+}
+
+func (b Baggage) set(m BaggageMember) Baggage {
+	members := make([]BaggageMember, 0, len(b.members)+1)
+	for _, existing := range b.members {
+		if existing.Key != m.Key {
+			members = append(members, existing)
+		}
+	}
+	return Baggage{members: append(members, m)}
+}
+
+// String returns b encoded as a W3C baggage header value.
+func (b Baggage) String() string {
+	if len(b.members) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	for i, m := range b.members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		m.writeBuf(&buf)
+	}
+	return buf.String()
+}
+
+// Validate validates the baggage.
+//
+// This will return non-nil if any members are invalid, or if
+// the baggage exceeds the W3C Baggage limits: 180 members, and
+// 8192 bytes once encoded.
+func (b Baggage) Validate() error {
+	for i, m := range b.members {
+		if err := m.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid baggage member at position %d", i)
+		}
+	}
+	return b.validateLimits()
+}
+
+func (b Baggage) validateLimits() error {
+	if n := len(b.members); n > maxBaggageMembers {
+		return errors.Errorf("baggage contains %d members, maximum allowed is %d", n, maxBaggageMembers)
+	}
+	if n := len(b.String()); n > maxBaggageSize {
+		return errors.Errorf("baggage is %d bytes, maximum allowed is %d", n, maxBaggageSize)
+	}
+	return nil
+}
+
+func (m *BaggageMember) writeBuf(buf *bytes.Buffer) {
+	buf.WriteString(m.Key)
+	buf.WriteByte('=')
+	for i := 0; i < len(m.Value); i++ {
+		if c := m.Value[i]; isBaggageOctet(c) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	if m.Properties != "" {
+		buf.WriteByte(';')
+		buf.WriteString(m.Properties)
+	}
+}
+
+// Validate validates the baggage member.
+//
+// This will return non-nil if either the key or properties are invalid.
+func (m *BaggageMember) Validate() error {
+	if !isBaggageToken(m.Key) {
+		return fmt.Errorf("invalid key %q", m.Key)
+	}
+	if m.Properties != "" {
+		for _, p := range strings.Split(m.Properties, ";") {
+			k, v := p, ""
+			if equal := strings.IndexRune(p, '='); equal != -1 {
+				k, v = p[:equal], p[equal+1:]
+			}
+			if !isBaggageToken(strings.TrimSpace(k)) {
+				return fmt.Errorf("invalid property %q for key %q", p, m.Key)
+			}
+			if _, err := unescapeBaggageValue(strings.TrimSpace(v)); err != nil {
+				return errors.Wrapf(err, "invalid property %q for key %q", p, m.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// unescapeBaggageValue decodes a percent-encoded baggage value,
+// returning an error if it contains characters which are not
+// permitted in the baggage header.
+func unescapeBaggageValue(v string) (string, error) {
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c != '%' && !isBaggageOctet(c) {
+			return "", errors.Errorf("value contains invalid character %q", c)
+		}
+	}
+	return url.PathUnescape(v)
+}
+
+// isBaggageToken reports whether s is a valid baggage key:
+// a non-empty RFC 7230 token.
+func isBaggageToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isBaggageOctet reports whether c may appear unencoded in a
+// baggage value:
+//
+//	baggage-octet = %x21 / %x23-2B / %x2D-3A / %x3C-5B / %x5D-7E
+//
+// '%' is excluded, so that it is always percent-encoded.
+func isBaggageOctet(c byte) bool {
+	switch {
+	case c == '%':
+		return false
+	case c == 0x21, 0x23 <= c && c <= 0x2B, 0x2D <= c && c <= 0x3A,
+		0x3C <= c && c <= 0x5B, 0x5D <= c && c <= 0x7E:
+		return true
+	}
+	return false
+}
+
+// ParseBaggageMember parses a single baggage member in the W3C
+// Baggage format, "key=value;properties", decoding the value.
+//
+// The returned member is not necessarily valid. Use
+// BaggageMember.Validate to validate it as required.
+func ParseBaggageMember(s string) (BaggageMember, error) {
+	var m BaggageMember
+	kv := s
+	if semi := strings.IndexRune(s, ';'); semi != -1 {
+		kv = s[:semi]
+		m.Properties = strings.TrimSpace(s[semi+1:])
+	}
+	equal := strings.IndexRune(kv, '=')
+	if equal == -1 {
+		return BaggageMember{}, errors.New("missing '=' in baggage member")
+	}
+	m.Key = strings.TrimSpace(kv[:equal])
+	value, err := unescapeBaggageValue(strings.TrimSpace(kv[equal+1:]))
+	if err != nil {
+		return BaggageMember{}, errors.Wrapf(err, "invalid value for key %q", m.Key)
+	}
+	m.Value = value
+	return m, nil
+}
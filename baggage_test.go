@@ -0,0 +1,109 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.atatus.com/agent/model"
+)
+
+func TestBaggageSetGetDelete(t *testing.T) {
+	var baggage Baggage
+	baggage, err := baggage.Set("tenant_id", "acme")
+	require.NoError(t, err)
+	baggage, err = baggage.Set("user", "bob smith, esq.")
+	require.NoError(t, err)
+	assert.Equal(t, "acme", baggage.Get("tenant_id"))
+	assert.Equal(t, "bob smith, esq.", baggage.Get("user"))
+	assert.Equal(t, "tenant_id=acme,user=bob%20smith%2C%20esq.", baggage.String())
+
+	updated, err := baggage.Set("tenant_id", "globex")
+	require.NoError(t, err)
+	assert.Equal(t, "user=bob%20smith%2C%20esq.,tenant_id=globex", updated.String())
+	assert.Equal(t, "acme", baggage.Get("tenant_id")) // unmodified
+
+	deleted := updated.Delete("user")
+	assert.Equal(t, "tenant_id=globex", deleted.String())
+	assert.Equal(t, 2, updated.Len())
+	_, ok := deleted.Member("user")
+	assert.False(t, ok)
+	assert.Equal(t, "", deleted.Get("user"))
+}
+
+func TestBaggageValidate(t *testing.T) {
+	var baggage Baggage
+	_, err := baggage.Set("", "value")
+	assert.EqualError(t, err, `invalid key ""`)
+	_, err = baggage.Set("a b", "value")
+	assert.EqualError(t, err, `invalid key "a b"`)
+	_, err = baggage.SetMember(BaggageMember{Key: "k", Value: "v", Properties: "a b"})
+	assert.EqualError(t, err, `invalid property "a b" for key "k"`)
+	_, err = baggage.SetMember(BaggageMember{Key: "k", Value: "v", Properties: "ttl=60;secret"})
+	assert.NoError(t, err)
+
+	for i := 0; i < maxBaggageMembers; i++ {
+		baggage, err = baggage.Set(fmt.Sprintf("k%d", i), "v")
+		require.NoError(t, err)
+	}
+	_, err = baggage.Set("one_too_many", "v")
+	assert.EqualError(t, err, "baggage contains 181 members, maximum allowed is 180")
+	assert.Equal(t, maxBaggageMembers, baggage.Len())
+
+	_, err = Baggage{}.Set("big", strings.Repeat("x", maxBaggageSize))
+	assert.EqualError(t, err, "baggage is 8196 bytes, maximum allowed is 8192")
+
+	invalid := NewBaggage(BaggageMember{Key: "ok", Value: "v"}, BaggageMember{Key: "not ok", Value: "v"})
+	assert.EqualError(t, invalid.Validate(), `invalid baggage member at position 1: invalid key "not ok"`)
+}
+
+func TestBaggageContext(t *testing.T) {
+	assert.Equal(t, 0, BaggageFromContext(context.Background()).Len())
+
+	baggage, err := Baggage{}.Set("tenant_id", "acme")
+	require.NoError(t, err)
+	ctx := ContextWithBaggage(context.Background(), baggage)
+	assert.Equal(t, baggage, BaggageFromContext(ctx))
+	assert.Equal(t, baggage, BaggageFromContext(DetachedContext(ctx)))
+}
+
+func TestTransactionBaggageToLabels(t *testing.T) {
+	os.Setenv(envBaggageToLabels, "tenant_*")
+	defer os.Unsetenv(envBaggageToLabels)
+	tracer := newAggTestTracer(t, "http://server.invalid")
+	defer tracer.Close()
+
+	baggage := NewBaggage(
+		BaggageMember{Key: "tenant_id", Value: "acme"},
+		BaggageMember{Key: "user", Value: "bob"},
+	)
+	tx := tracer.StartTransactionOptions("name", "type", TransactionOptions{Baggage: baggage})
+	assert.Equal(t, model.IfaceMap{{Key: "tenant_id", Value: "acme"}}, tx.Context.model.Tags)
+	tx.Discard()
+
+	tracer.SetBaggageToLabels()
+	tx = tracer.StartTransactionOptions("name", "type", TransactionOptions{Baggage: baggage})
+	assert.Empty(t, tx.Context.model.Tags)
+	tx.Discard()
+}
@@ -18,6 +18,7 @@
 package atatus // import "go.atatus.com/agent"
 
 import (
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -40,17 +41,48 @@ const (
 	envMetricsInterval            = "ATATUS_METRICS_INTERVAL"
 	envMaxSpans                   = "ATATUS_TRANSACTION_MAX_SPANS"
 	envTransactionSampleRate      = "ATATUS_TRANSACTION_SAMPLE_RATE"
+	envTransactionSampler         = "ATATUS_TRANSACTION_SAMPLER"
+	envTransactionSampleTarget    = "ATATUS_TRANSACTION_SAMPLE_TARGET"
+	envTransactionSampleInterval  = "ATATUS_TRANSACTION_SAMPLE_INTERVAL"
+	envTransactionSampleRules     = "ATATUS_TRANSACTION_SAMPLE_RULES"
+	envParentSampling             = "ATATUS_PARENT_SAMPLING_POLICY"
+	envUntrustedParentSampling    = "ATATUS_UNTRUSTED_PARENT_SAMPLING_POLICY"
 	envSanitizeFieldNames         = "ATATUS_SANITIZE_FIELD_NAMES"
+	envBaggageToLabels            = "ATATUS_BAGGAGE_TO_LABELS"
 	envCaptureHeaders             = "ATATUS_CAPTURE_HEADERS"
 	envCaptureBody                = "ATATUS_CAPTURE_BODY"
 	envServiceName                = "ATATUS_APP_NAME"
 	envServiceNotifyHost          = "ATATUS_NOTIFY_HOST"
+	envNotifyProxy                = "ATATUS_NOTIFY_PROXY"
+	envNotifyRetryQueueSize       = "ATATUS_NOTIFY_RETRY_QUEUE_SIZE"
+	envNotifySpoolDir             = "ATATUS_NOTIFY_SPOOL_DIR"
+	envNotifySpoolMaxSize         = "ATATUS_NOTIFY_SPOOL_MAX_SIZE"
+	envNotifySpoolMaxAge          = "ATATUS_NOTIFY_SPOOL_MAX_AGE"
+	envNotifyCompression          = "ATATUS_NOTIFY_COMPRESSION"
+	envNotifyCompressionMinSize   = "ATATUS_NOTIFY_COMPRESSION_MIN_SIZE"
+	envExportMode                 = "ATATUS_EXPORT_MODE"
+	envExportFile                 = "ATATUS_EXPORT_FILE"
+	envExportFileMaxSize          = "ATATUS_EXPORT_FILE_MAX_SIZE"
+	envOTLPEndpoint               = "ATATUS_OTLP_ENDPOINT"
+	envOTLPProtocol               = "ATATUS_OTLP_PROTOCOL"
+	envOTLPHeaders                = "ATATUS_OTLP_HEADERS"
+	envMaxErrors                  = "ATATUS_MAX_ERRORS"
+	envMaxErrorRequests           = "ATATUS_MAX_ERROR_REQUESTS"
+	envMaxTraces                  = "ATATUS_MAX_TRACES"
+	envMaxSecondaryTraces         = "ATATUS_MAX_SECONDARY_TRACES"
+	envMaxAnalyticsEvents         = "ATATUS_MAX_ANALYTICS_EVENTS"
+	envMaxAnalyticsPayloadSize    = "ATATUS_MAX_ANALYTICS_PAYLOAD_SIZE"
+	envMaxMetrics                 = "ATATUS_MAX_METRICS"
 	envServiceVersion             = "ATATUS_APP_VERSION"
 	envEnvironment                = "ATATUS_ENVIRONMENT"
 	envLicenseKey                 = "ATATUS_LICENSE_KEY"
 	envAnalytics                  = "ATATUS_ANALYTICS"
 	envTracing                    = "ATATUS_TRACING"
 	envTraceThreshold             = "ATATUS_TRACE_THRESHOLD"
+	envTraceErrors                = "ATATUS_TRACE_ERRORS"
+	envTraceHTTPFailures          = "ATATUS_TRACE_HTTP_FAILURES"
+	envTraceSpanThresholds        = "ATATUS_TRACE_SPAN_THRESHOLDS"
+	envNotifyInterval             = "ATATUS_NOTIFY_INTERVAL"
 	envSpanFramesMinDuration      = "ATATUS_SPAN_FRAMES_MIN_DURATION"
 	envActive                     = "ATATUS_ACTIVE"
 	envRecording                  = "ATATUS_RECORDING"
@@ -66,6 +98,7 @@ const (
 	envCentralConfig              = "ATATUS_CENTRAL_CONFIG"
 	envBreakdownMetrics           = "ATATUS_BREAKDOWN_METRICS"
 	envUseAtatusTraceparentHeader = "ATATUS_USE_TRACEPARENT_HEADER"
+	envPropagators                = "ATATUS_PROPAGATORS"
 	envCloudProvider              = "ATATUS_CLOUD_PROVIDER"
 
 	// NOTE(marclop) Experimental settings
@@ -82,9 +115,14 @@ const (
 	// NOTE(axw) profiling environment variables are experimental.
 	// They may be removed in a future minor version without being
 	// considered a breaking change.
-	envCPUProfileInterval  = "ATATUS_CPU_PROFILE_INTERVAL"
-	envCPUProfileDuration  = "ATATUS_CPU_PROFILE_DURATION"
-	envHeapProfileInterval = "ATATUS_HEAP_PROFILE_INTERVAL"
+	envCPUProfileInterval       = "ATATUS_CPU_PROFILE_INTERVAL"
+	envCPUProfileDuration       = "ATATUS_CPU_PROFILE_DURATION"
+	envHeapProfileInterval      = "ATATUS_HEAP_PROFILE_INTERVAL"
+	envGoroutineProfileInterval = "ATATUS_GOROUTINE_PROFILE_INTERVAL"
+	envMutexProfileInterval     = "ATATUS_MUTEX_PROFILE_INTERVAL"
+	envMutexProfileDuration     = "ATATUS_MUTEX_PROFILE_DURATION"
+	envBlockProfileInterval     = "ATATUS_BLOCK_PROFILE_INTERVAL"
+	envBlockProfileDuration     = "ATATUS_BLOCK_PROFILE_DURATION"
 
 	defaultAPIRequestSize    = 750 * configutil.KByte
 	defaultAPIRequestTime    = 10 * time.Second
@@ -98,7 +136,40 @@ const (
 	defaultSpanFramesMinDuration = 5 * time.Millisecond
 	defaultStackTraceLimit       = 50
 
-	defaultTraceThreshold = 2000
+	defaultSampleTarget   = 10
+	defaultSampleInterval = 10 * time.Second
+
+	samplerRatio        = "ratio"
+	samplerRateLimiting = "rate_limiting"
+	samplerAdaptive     = "adaptive"
+
+	defaultTraceThreshold    = 2000
+	defaultTraceErrors       = true
+	defaultTraceHTTPFailures = true
+
+	defaultNotifyInterval = 60 * time.Second
+	minNotifyInterval     = 1 * time.Second
+
+	defaultNotifyRetryQueueSize = 100
+	defaultNotifySpoolMaxSize   = 50 * configutil.MByte
+	defaultNotifySpoolMaxAge    = 24 * time.Hour
+
+	defaultNotifyCompression        = true
+	defaultNotifyCompressionMinSize = 1 * configutil.KByte
+
+	defaultExportFile        = "atatus-export.ndjson"
+	defaultExportFileMaxSize = 10 * configutil.MByte
+
+	defaultOTLPEndpoint = "http://localhost:4318"
+	defaultOTLPProtocol = otlpProtocolProtobuf
+
+	defaultMaxErrors               = 20
+	defaultMaxErrorRequests        = 20
+	defaultMaxTraces               = 5
+	defaultMaxSecondaryTraces      = 4
+	defaultMaxAnalyticsEvents      = 10000
+	defaultMaxAnalyticsPayloadSize = 6 * configutil.MByte
+	defaultMaxMetrics              = 20
 
 	defaultExitSpanMinDuration = 0 * time.Millisecond
 
@@ -208,34 +279,265 @@ func initialMaxSpans() (int, error) {
 	return max, nil
 }
 
-// initialSampler returns a nil Sampler if all transactions should be sampled.
-func initialSampler() (Sampler, error) {
-	value := os.Getenv(envTransactionSampleRate)
-	return parseSampleRate(envTransactionSampleRate, value)
+// samplerConfig holds the configuration from which
+// the tracer's Sampler is built.
+type samplerConfig struct {
+	// kind holds the kind of sampler: ratio, rate_limiting, or adaptive.
+	kind string
+
+	// rate holds the ratio of transactions sampled by the ratio sampler.
+	rate float64
+
+	// target holds the number of transactions per second sampled
+	// by the rate_limiting and adaptive samplers.
+	target float64
+
+	// interval holds the interval at which the
+	// adaptive sampler adjusts its sample rate.
+	interval time.Duration
+
+	// rules holds the rules for sampling transactions by
+	// name or type, falling back to the sampler kind.
+	rules []SamplerRule
+
+	// custom records whether sampler, set by Tracer.SetSampler,
+	// is used in place of the sampler kind.
+	custom  bool
+	sampler Sampler
+}
+
+var defaultSamplerConfig = samplerConfig{
+	kind:     samplerRatio,
+	rate:     1,
+	target:   defaultSampleTarget,
+	interval: defaultSampleInterval,
 }
 
-// parseSampleRate parses a numeric sampling rate in the range [0,1.0], returning a Sampler.
-func parseSampleRate(name, value string) (Sampler, error) {
+// newSampler returns a new Sampler for the configuration,
+// or nil if all transactions should be sampled.
+func (c *samplerConfig) newSampler() Sampler {
+	var sampler Sampler
+	switch {
+	case c.custom:
+		sampler = c.sampler
+	case c.kind == samplerRateLimiting:
+		sampler = NewRateLimitingSampler(c.target)
+	case c.kind == samplerAdaptive:
+		interval := c.interval
+		if interval <= 0 {
+			interval = defaultSampleInterval
+		}
+		sampler = NewAdaptiveSampler(c.target, interval)
+	default:
+		sampler = NewRatioSampler(c.rate)
+	}
+	if len(c.rules) > 0 {
+		sampler = NewRuleSampler(c.rules, sampler)
+	}
+	return sampler
+}
+
+// equal reports whether c and other build equivalent samplers, ignoring
+// the parameters not used by their kind. Configurations with a custom
+// sampler are never equal, as Samplers may not be comparable.
+func (c *samplerConfig) equal(other *samplerConfig) bool {
+	if c.custom || other.custom || c.kind != other.kind || !sameSamplerRules(c.rules, other.rules) {
+		return false
+	}
+	switch c.kind {
+	case samplerRateLimiting:
+		return c.target == other.target
+	case samplerAdaptive:
+		return c.target == other.target && c.interval == other.interval
+	default:
+		return c.rate == other.rate
+	}
+}
+
+// sameSamplerRules reports whether a and b hold equal rules. The rules
+// parsed from configuration hold ratio samplers, which are compared by
+// their ratio; rules holding any other Sampler are never equal, as
+// Samplers may not be comparable.
+func sameSamplerRules(a, b []SamplerRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].TransactionName != b[i].TransactionName || a[i].TransactionType != b[i].TransactionType {
+			return false
+		}
+		switch sa := a[i].Sampler.(type) {
+		case nil:
+			if b[i].Sampler != nil {
+				return false
+			}
+		case ratioSampler:
+			if sb, ok := b[i].Sampler.(ratioSampler); !ok || sa.ratio != sb.ratio {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setSamplerConfig updates the sampler configuration with f, and replaces
+// the sampler with one built from the result if the update changes the
+// sampler built. The sampler is otherwise kept, so that the state of the
+// rate limiting and adaptive samplers survives unrelated updates.
+func (cfg *instrumentationConfigValues) setSamplerConfig(f func(c *samplerConfig)) {
+	old := cfg.samplerConfig
+	f(&cfg.samplerConfig)
+	if cfg.sampler != nil && cfg.samplerConfig.equal(&old) {
+		return
+	}
+	cfg.sampler = cfg.samplerConfig.newSampler()
+	cfg.extendedSampler, _ = cfg.sampler.(ExtendedSampler)
+}
+
+func initialSamplerConfig() (samplerConfig, error) {
+	c := defaultSamplerConfig
+	var err error
+	if c.rate, err = parseSampleRate(envTransactionSampleRate, os.Getenv(envTransactionSampleRate)); err != nil {
+		return defaultSamplerConfig, err
+	}
+	if value := os.Getenv(envTransactionSampler); value != "" {
+		if c.kind, err = parseSamplerKind(envTransactionSampler, value); err != nil {
+			return defaultSamplerConfig, err
+		}
+	}
+	if value := os.Getenv(envTransactionSampleTarget); value != "" {
+		if c.target, err = parseSampleTarget(envTransactionSampleTarget, value); err != nil {
+			return defaultSamplerConfig, err
+		}
+	}
+	if value := os.Getenv(envTransactionSampleInterval); value != "" {
+		if c.interval, err = parseSampleInterval(envTransactionSampleInterval, value); err != nil {
+			return defaultSamplerConfig, err
+		}
+	}
+	if c.rules, err = parseSampleRules(envTransactionSampleRules, os.Getenv(envTransactionSampleRules)); err != nil {
+		return defaultSamplerConfig, err
+	}
+	return c, nil
+}
+
+// parseSampleRate parses a numeric sampling rate in the range [0,1.0].
+func parseSampleRate(name, value string) (float64, error) {
 	if value == "" {
 		value = "1"
 	}
 	ratio, err := strconv.ParseFloat(value, 64)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to parse %s", name)
+		return 0, errors.Wrapf(err, "failed to parse %s", name)
 	}
 	if ratio < 0.0 || ratio > 1.0 {
-		return nil, errors.Errorf(
+		return 0, errors.Errorf(
 			"invalid value for %s: %s (out of range [0,1.0])",
 			name, value,
 		)
 	}
-	return NewRatioSampler(ratio), nil
+	return ratio, nil
+}
+
+func initialParentSampling() (parentSamplingPolicies, error) {
+	var policies parentSamplingPolicies
+	var err error
+	if policies.trusted, err = parseParentSamplingPolicy(envParentSampling, os.Getenv(envParentSampling)); err != nil {
+		return parentSamplingPolicies{}, err
+	}
+	if policies.untrusted, err = parseParentSamplingPolicy(envUntrustedParentSampling, os.Getenv(envUntrustedParentSampling)); err != nil {
+		return parentSamplingPolicies{}, err
+	}
+	return policies, nil
+}
+
+func parseParentSamplingPolicy(name, value string) (ParentSamplingPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", "parent":
+		return ParentSamplingRespect, nil
+	case "always":
+		return ParentSamplingAlways, nil
+	case "resample":
+		return ParentSamplingResample, nil
+	}
+	return ParentSamplingRespect, errors.Errorf(
+		"invalid value for %s: %s (expected %q, %q or %q)",
+		name, value, "parent", "always", "resample",
+	)
+}
+
+func parseSamplerKind(name, value string) (string, error) {
+	switch kind := strings.ToLower(strings.TrimSpace(value)); kind {
+	case samplerRatio, samplerRateLimiting, samplerAdaptive:
+		return kind, nil
+	}
+	return "", errors.Errorf(
+		"invalid value for %s: %s (expected %q, %q or %q)",
+		name, value, samplerRatio, samplerRateLimiting, samplerAdaptive,
+	)
+}
+
+func parseSampleTarget(name, value string) (float64, error) {
+	target, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", name)
+	}
+	if target < 0 {
+		return 0, errors.Errorf("invalid value for %s: %s (must not be negative)", name, value)
+	}
+	return target, nil
+}
+
+func parseSampleInterval(name, value string) (time.Duration, error) {
+	interval, err := configutil.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", name)
+	}
+	if interval <= 0 {
+		return 0, errors.Errorf("invalid value for %s: %s (must be positive)", name, value)
+	}
+	return interval, nil
+}
+
+// parseSampleRules parses a comma-separated list of sampling rules of the
+// form "name:<pattern>=<rate>" or "type:<type>=<rate>", such as
+// "name:GET /healthz=0,type:request=0.5".
+func parseSampleRules(name, value string) ([]SamplerRule, error) {
+	var rules []SamplerRule
+	for _, item := range configutil.ParseList(value, ",") {
+		i := strings.LastIndex(item, "=")
+		j := strings.Index(item, ":")
+		if i < 0 || j < 0 || j > i {
+			return nil, errors.Errorf("invalid value for %s: %q (expected name:<pattern>=<rate> or type:<type>=<rate>)", name, item)
+		}
+		rate, err := parseSampleRate(name, strings.TrimSpace(item[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		rule := SamplerRule{Sampler: NewRatioSampler(rate)}
+		switch match := strings.TrimSpace(item[j+1 : i]); strings.ToLower(strings.TrimSpace(item[:j])) {
+		case "name":
+			rule.TransactionName = match
+		case "type":
+			rule.TransactionType = match
+		default:
+			return nil, errors.Errorf("invalid value for %s: %q (expected name:<pattern>=<rate> or type:<type>=<rate>)", name, item)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
 }
 
 func initialSanitizedFieldNames() wildcard.Matchers {
 	return configutil.ParseWildcardPatternsEnv(envSanitizeFieldNames, defaultSanitizedFieldNames)
 }
 
+func initialBaggageToLabels() wildcard.Matchers {
+	return configutil.ParseWildcardPatternsEnv(envBaggageToLabels, nil)
+}
+
 func initialCaptureHeaders() (bool, error) {
 	return configutil.ParseBoolEnv(envCaptureHeaders, defaultCaptureHeaders)
 }
@@ -272,6 +574,201 @@ func initialNotifyHost() (host string) {
 	return host
 }
 
+func initialNotifyProxy() (proxy string) {
+	proxy = os.Getenv(envNotifyProxy)
+	return proxy
+}
+
+func initialNotifyRetryQueueSize() (int, error) {
+	value := os.Getenv(envNotifyRetryQueueSize)
+	if value == "" {
+		return defaultNotifyRetryQueueSize, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", envNotifyRetryQueueSize)
+	}
+	return size, nil
+}
+
+func initialNotifySpoolDir() (dir string) {
+	dir = os.Getenv(envNotifySpoolDir)
+	return dir
+}
+
+func initialNotifySpoolMaxSize() (int64, error) {
+	size, err := configutil.ParseSizeEnv(envNotifySpoolMaxSize, defaultNotifySpoolMaxSize)
+	if err != nil {
+		return 0, err
+	}
+	return size.Bytes(), nil
+}
+
+func initialNotifySpoolMaxAge() (time.Duration, error) {
+	return configutil.ParseDurationEnv(envNotifySpoolMaxAge, defaultNotifySpoolMaxAge)
+}
+
+func initialNotifyCompression() (bool, error) {
+	return configutil.ParseBoolEnv(envNotifyCompression, defaultNotifyCompression)
+}
+
+func initialNotifyCompressionMinSize() (int, error) {
+	size, err := configutil.ParseSizeEnv(envNotifyCompressionMinSize, defaultNotifyCompressionMinSize)
+	if err != nil {
+		return 0, err
+	}
+	return int(size), nil
+}
+
+func initialExportMode() (string, error) {
+	return parseExportMode(os.Getenv(envExportMode))
+}
+
+func parseExportMode(value string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(value)); mode {
+	case "", exportModeFile, exportModeStdout, exportModeOTLP:
+		return mode, nil
+	}
+	return "", errors.Errorf(
+		"invalid %s value %q, expected %q, %q or %q",
+		envExportMode, value, exportModeFile, exportModeStdout, exportModeOTLP,
+	)
+}
+
+func initialExportFile() string {
+	if file := os.Getenv(envExportFile); file != "" {
+		return file
+	}
+	return defaultExportFile
+}
+
+func initialExportFileMaxSize() (int64, error) {
+	size, err := configutil.ParseSizeEnv(envExportFileMaxSize, defaultExportFileMaxSize)
+	if err != nil {
+		return 0, err
+	}
+	return size.Bytes(), nil
+}
+
+func initialOTLPEndpoint() string {
+	return strings.TrimSpace(os.Getenv(envOTLPEndpoint))
+}
+
+func initialOTLPProtocol() (string, error) {
+	switch protocol := strings.ToLower(strings.TrimSpace(os.Getenv(envOTLPProtocol))); protocol {
+	case "":
+		return defaultOTLPProtocol, nil
+	case otlpProtocolProtobuf, otlpProtocolJSON:
+		return protocol, nil
+	}
+	return "", errors.Errorf(
+		"invalid %s value %q, expected %q or %q",
+		envOTLPProtocol, os.Getenv(envOTLPProtocol), otlpProtocolProtobuf, otlpProtocolJSON,
+	)
+}
+
+// initialOTLPHeaders parses the comma-separated key=value pairs in
+// ATATUS_OTLP_HEADERS, which are sent with each OTLP export request.
+func initialOTLPHeaders() (http.Header, error) {
+	value := os.Getenv(envOTLPHeaders)
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	headers := make(http.Header)
+	for _, field := range strings.Split(value, ",") {
+		i := strings.IndexRune(field, '=')
+		if i < 0 || strings.TrimSpace(field[:i]) == "" {
+			return nil, errors.Errorf("invalid %s value %q: expected key=value pairs", envOTLPHeaders, value)
+		}
+		headers.Add(strings.TrimSpace(field[:i]), strings.TrimSpace(field[i+1:]))
+	}
+	return headers, nil
+}
+
+func initialMaxErrors() (int, error) {
+	return parseBatchLimitEnv(envMaxErrors, defaultMaxErrors)
+}
+
+func initialMaxErrorRequests() (int, error) {
+	return parseBatchLimitEnv(envMaxErrorRequests, defaultMaxErrorRequests)
+}
+
+func initialMaxTraces() (int, error) {
+	return parseBatchLimitEnv(envMaxTraces, defaultMaxTraces)
+}
+
+func initialMaxSecondaryTraces() (int, error) {
+	return parseBatchLimitEnv(envMaxSecondaryTraces, defaultMaxSecondaryTraces)
+}
+
+func initialMaxAnalyticsEvents() (int, error) {
+	return parseBatchLimitEnv(envMaxAnalyticsEvents, defaultMaxAnalyticsEvents)
+}
+
+func initialMaxMetrics() (int, error) {
+	return parseBatchLimitEnv(envMaxMetrics, defaultMaxMetrics)
+}
+
+func initialMaxAnalyticsPayloadSize() (int, error) {
+	value := os.Getenv(envMaxAnalyticsPayloadSize)
+	if value == "" {
+		return int(defaultMaxAnalyticsPayloadSize), nil
+	}
+	return parseMaxAnalyticsPayloadSize(envMaxAnalyticsPayloadSize, value)
+}
+
+func parseBatchLimitEnv(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return parseBatchLimit(name, value)
+}
+
+// parseBatchLimit parses the maximum number of events
+// of a kind kept in each aggregated batch.
+func parseBatchLimit(name, value string) (int, error) {
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", name)
+	}
+	if limit <= 0 {
+		return 0, errors.Errorf("%s must be greater than zero, got %d", name, limit)
+	}
+	return limit, nil
+}
+
+// set sets the limit defined by the environment variable name.
+func (l *batchLimits) set(name string, limit int) {
+	switch name {
+	case envMaxErrors:
+		l.errors = limit
+	case envMaxErrorRequests:
+		l.errorRequests = limit
+	case envMaxTraces:
+		l.traces = limit
+	case envMaxSecondaryTraces:
+		l.secondaryTraces = limit
+	case envMaxAnalyticsEvents:
+		l.analyticsEvents = limit
+	case envMaxAnalyticsPayloadSize:
+		l.analyticsPayloadSize = limit
+	case envMaxMetrics:
+		l.metrics = limit
+	}
+}
+
+func parseMaxAnalyticsPayloadSize(name, value string) (int, error) {
+	size, err := configutil.ParseSize(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", name)
+	}
+	if size <= 0 {
+		return 0, errors.Errorf("%s must be greater than zero, got %s", name, size)
+	}
+	return int(size), nil
+}
+
 func initialAnalytics() (bool, error) {
 	return configutil.ParseBoolEnv(envAnalytics, false)
 }
@@ -292,6 +789,58 @@ func initialTraceThreshold() (int, error) {
 	return threshold, nil
 }
 
+func initialTraceRules() (traceRules, error) {
+	var rules traceRules
+	var err error
+	if rules.errors, err = configutil.ParseBoolEnv(envTraceErrors, defaultTraceErrors); err != nil {
+		return traceRules{}, err
+	}
+	if rules.httpFailures, err = configutil.ParseBoolEnv(envTraceHTTPFailures, defaultTraceHTTPFailures); err != nil {
+		return traceRules{}, err
+	}
+	if rules.spanThresholds, err = parseTraceSpanThresholds(os.Getenv(envTraceSpanThresholds)); err != nil {
+		return traceRules{}, err
+	}
+	return rules, nil
+}
+
+// parseTraceSpanThresholds parses a comma-separated list of span kinds
+// and durations, such as "db=500ms,external=1s", returning the durations
+// in milliseconds keyed by the lower-cased aggregated span kind.
+func parseTraceSpanThresholds(value string) (map[string]float64, error) {
+	var thresholds map[string]float64
+	for _, kv := range configutil.ParseList(value, ",") {
+		i := strings.IndexRune(kv, '=')
+		if i <= 0 {
+			return nil, errors.Errorf("invalid %s value %q, expected kind=duration", envTraceSpanThresholds, kv)
+		}
+		kind, value := strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+		d, err := configutil.ParseDuration(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", envTraceSpanThresholds)
+		}
+		if thresholds == nil {
+			thresholds = make(map[string]float64)
+		}
+		thresholds[strings.ToLower(mapSpanKind(kind))] = timeDurationToMilliSeconds(d)
+	}
+	return thresholds, nil
+}
+
+func initialNotifyInterval() (time.Duration, error) {
+	interval, err := configutil.ParseDurationEnv(envNotifyInterval, defaultNotifyInterval)
+	if err != nil {
+		return 0, err
+	}
+	if interval < minNotifyInterval {
+		return 0, errors.Errorf(
+			"%s must be at least %s, got %s",
+			envNotifyInterval, minNotifyInterval, interval,
+		)
+	}
+	return interval, nil
+}
+
 func initialService() (name, version, environment string) {
 	name = os.Getenv(envServiceName)
 	version = os.Getenv(envServiceVersion)
@@ -354,6 +903,42 @@ func initialUseAtatusTraceparentHeader() (bool, error) {
 	return configutil.ParseBoolEnv(envUseAtatusTraceparentHeader, true)
 }
 
+// defaultPropagators holds the default propagation formats:
+// W3C Trace Context only.
+var defaultPropagators = []string{"tracecontext"}
+
+func initialPropagators() ([]string, error) {
+	value := os.Getenv(envPropagators)
+	if value == "" {
+		return defaultPropagators, nil
+	}
+	return parsePropagators(envPropagators, value)
+}
+
+// parsePropagators parses a comma-separated list of trace context
+// propagation formats: "tracecontext" (W3C Trace Context), "b3"
+// (Zipkin B3 single header), "b3multi" (Zipkin B3 multiple headers),
+// and "jaeger" (Jaeger uber-trace-id). Instrumentation injects all of
+// the listed formats, and extracts the first one found in that order.
+func parsePropagators(name, value string) ([]string, error) {
+	var propagators []string
+	for _, field := range strings.Split(value, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		switch field {
+		case "":
+			continue
+		case "tracecontext", "b3", "b3multi", "jaeger":
+		default:
+			return nil, errors.Errorf("invalid %s value %q: unknown propagator %q", name, value, field)
+		}
+		propagators = append(propagators, field)
+	}
+	if len(propagators) == 0 {
+		return nil, errors.Errorf("invalid %s value %q: no propagators specified", name, value)
+	}
+	return propagators, nil
+}
+
 func initialSpanCompressionEnabled() (bool, error) {
 	return configutil.ParseBoolEnv(envSpanCompressionEnabled,
 		defaultSpanCompressionEnabled,
@@ -390,6 +975,54 @@ func initialHeapProfileInterval() (time.Duration, error) {
 	return configutil.ParseDurationEnv(envHeapProfileInterval, 0)
 }
 
+func initialGoroutineProfileInterval() (time.Duration, error) {
+	return configutil.ParseDurationEnv(envGoroutineProfileInterval, 0)
+}
+
+func initialMutexProfileIntervalDuration() (time.Duration, time.Duration, error) {
+	return initialContentionProfileIntervalDuration(envMutexProfileInterval, envMutexProfileDuration)
+}
+
+func initialBlockProfileIntervalDuration() (time.Duration, time.Duration, error) {
+	return initialContentionProfileIntervalDuration(envBlockProfileInterval, envBlockProfileDuration)
+}
+
+func initialContentionProfileIntervalDuration(intervalEnv, durationEnv string) (time.Duration, time.Duration, error) {
+	interval, err := configutil.ParseDurationEnv(intervalEnv, 0)
+	if err != nil || interval <= 0 {
+		return 0, 0, err
+	}
+	duration, err := configutil.ParseDurationEnv(durationEnv, defaultContentionProfileDuration)
+	if err != nil {
+		return 0, 0, err
+	}
+	if duration <= 0 {
+		return 0, 0, errors.Errorf("%s must be greater than zero, got %s", durationEnv, duration)
+	}
+	return interval, duration, nil
+}
+
+func (c *profilingConfig) set(name string, d time.Duration) {
+	switch name {
+	case envCPUProfileInterval:
+		c.cpuInterval = d
+	case envCPUProfileDuration:
+		c.cpuDuration = d
+	case envHeapProfileInterval:
+		c.heapInterval = d
+	case envGoroutineProfileInterval:
+		c.goroutineInterval = d
+	case envMutexProfileInterval:
+		c.mutexInterval = d
+	case envMutexProfileDuration:
+		c.mutexDuration = d
+	case envBlockProfileInterval:
+		c.blockInterval = d
+	case envBlockProfileDuration:
+		c.blockDuration = d
+	}
+}
+
 func initialExitSpanMinDuration() (time.Duration, error) {
 	return configutil.ParseDurationEnvOptions(
 		envExitSpanMinDuration, defaultExitSpanMinDuration,
@@ -413,6 +1046,15 @@ func (t *Tracer) updateRemoteConfig(logger WarningLogger, old, attrs map[string]
 	envName := func(k string) string {
 		return "ATATUS_" + strings.ToUpper(k)
 	}
+	// customSampler reports whether a Sampler set by Tracer.SetSampler
+	// is in use, in place of the sampler kind, target and interval. A
+	// centrally configured sample rate replaces the custom Sampler.
+	customSampler := func() bool {
+		if _, ok := attrs[strings.ToLower(strings.TrimPrefix(envTransactionSampleRate, "ATATUS_"))]; ok {
+			return false
+		}
+		return t.instrumentationConfig().samplerConfig.custom
+	}
 
 	var updates []func(cfg *instrumentationConfig)
 	for k, v := range attrs {
@@ -454,6 +1096,38 @@ func (t *Tracer) updateRemoteConfig(logger WarningLogger, old, attrs map[string]
 			updates = append(updates, func(cfg *instrumentationConfig) {
 				cfg.exitSpanMinDuration = duration
 			})
+		case envMaxErrors, envMaxErrorRequests, envMaxTraces, envMaxSecondaryTraces, envMaxAnalyticsEvents, envMaxMetrics:
+			limit, err := parseBatchLimit(k, v)
+			if err != nil {
+				errorf("central config failure: %s", err)
+				delete(attrs, k)
+				continue
+			}
+			key := envName(k)
+			updates = append(updates, func(cfg *instrumentationConfig) {
+				cfg.batchLimits.set(key, limit)
+			})
+		case envMaxAnalyticsPayloadSize:
+			size, err := parseMaxAnalyticsPayloadSize(k, v)
+			if err != nil {
+				errorf("central config failure: %s", err)
+				delete(attrs, k)
+				continue
+			}
+			updates = append(updates, func(cfg *instrumentationConfig) {
+				cfg.batchLimits.analyticsPayloadSize = size
+			})
+		case envPropagators:
+			propagators, err := parsePropagators(k, v)
+			if err != nil {
+				errorf("central config failure: %s", err)
+				delete(attrs, k)
+				continue
+			} else {
+				updates = append(updates, func(cfg *instrumentationConfig) {
+					cfg.propagators = propagators
+				})
+			}
 		case envIgnoreURLs:
 			matchers := configutil.ParseWildcardPatterns(v)
 			updates = append(updates, func(cfg *instrumentationConfig) {
@@ -475,6 +1149,23 @@ func (t *Tracer) updateRemoteConfig(logger WarningLogger, old, attrs map[string]
 			updates = append(updates, func(cfg *instrumentationConfig) {
 				cfg.sanitizedFieldNames = matchers
 			})
+		case envBaggageToLabels:
+			matchers := configutil.ParseWildcardPatterns(v)
+			updates = append(updates, func(cfg *instrumentationConfig) {
+				cfg.baggageToLabels = matchers
+			})
+		case envCPUProfileInterval, envCPUProfileDuration, envHeapProfileInterval, envGoroutineProfileInterval,
+			envMutexProfileInterval, envMutexProfileDuration, envBlockProfileInterval, envBlockProfileDuration:
+			duration, err := configutil.ParseDuration(v)
+			if err != nil {
+				errorf("central config failure: failed to parse %s: %s", k, err)
+				delete(attrs, k)
+				continue
+			}
+			name := envName(k)
+			updates = append(updates, func(cfg *instrumentationConfig) {
+				cfg.profiling.set(name, duration)
+			})
 		case envSpanFramesMinDuration:
 			duration, err := configutil.ParseDuration(v)
 			if err != nil {
@@ -498,17 +1189,91 @@ func (t *Tracer) updateRemoteConfig(logger WarningLogger, old, attrs map[string]
 				})
 			}
 		case envTransactionSampleRate:
-			sampler, err := parseSampleRate(k, v)
+			rate, err := parseSampleRate(k, v)
 			if err != nil {
 				errorf("central config failure: %s", err)
 				delete(attrs, k)
 				continue
 			} else {
 				updates = append(updates, func(cfg *instrumentationConfig) {
-					cfg.sampler = sampler
-					cfg.extendedSampler, _ = sampler.(ExtendedSampler)
+					cfg.setSamplerConfig(func(c *samplerConfig) {
+						c.custom = false
+						c.rate = rate
+					})
+				})
+			}
+		case envTransactionSampler:
+			kind, err := parseSamplerKind(k, v)
+			if err != nil {
+				errorf("central config failure: %s", err)
+				delete(attrs, k)
+				continue
+			}
+			if customSampler() {
+				warningf("central config %s set to %s, but not in effect while a custom sampler is in use", k, v)
+			}
+			updates = append(updates, func(cfg *instrumentationConfig) {
+				cfg.setSamplerConfig(func(c *samplerConfig) {
+					c.kind = kind
+				})
+			})
+		case envTransactionSampleTarget:
+			target, err := parseSampleTarget(k, v)
+			if err != nil {
+				errorf("central config failure: %s", err)
+				delete(attrs, k)
+				continue
+			}
+			if customSampler() {
+				warningf("central config %s set to %s, but not in effect while a custom sampler is in use", k, v)
+			}
+			updates = append(updates, func(cfg *instrumentationConfig) {
+				cfg.setSamplerConfig(func(c *samplerConfig) {
+					c.target = target
+				})
+			})
+		case envTransactionSampleInterval:
+			interval, err := parseSampleInterval(k, v)
+			if err != nil {
+				errorf("central config failure: %s", err)
+				delete(attrs, k)
+				continue
+			}
+			if customSampler() {
+				warningf("central config %s set to %s, but not in effect while a custom sampler is in use", k, v)
+			}
+			updates = append(updates, func(cfg *instrumentationConfig) {
+				cfg.setSamplerConfig(func(c *samplerConfig) {
+					c.interval = interval
+				})
+			})
+		case envTransactionSampleRules:
+			rules, err := parseSampleRules(k, v)
+			if err != nil {
+				errorf("central config failure: %s", err)
+				delete(attrs, k)
+				continue
+			}
+			updates = append(updates, func(cfg *instrumentationConfig) {
+				cfg.setSamplerConfig(func(c *samplerConfig) {
+					c.rules = rules
 				})
+			})
+		case envParentSampling, envUntrustedParentSampling:
+			policy, err := parseParentSamplingPolicy(k, v)
+			if err != nil {
+				errorf("central config failure: %s", err)
+				delete(attrs, k)
+				continue
 			}
+			trusted := envName(k) == envParentSampling
+			updates = append(updates, func(cfg *instrumentationConfig) {
+				if trusted {
+					cfg.parentSampling.trusted = policy
+				} else {
+					cfg.parentSampling.untrusted = policy
+				}
+			})
 		case apmlog.EnvLogLevel:
 			level, err := apmlog.ParseLogLevel(v)
 			if err != nil {
@@ -566,6 +1331,7 @@ func (t *Tracer) updateRemoteConfig(logger WarningLogger, old, attrs map[string]
 		if _, ok := attrs[k]; ok {
 			continue
 		}
+		k := k
 		updates = append(updates, func(cfg *instrumentationConfig) {
 			if f, ok := cfg.local[envName(k)]; ok {
 				f(&cfg.instrumentationConfigValues)
@@ -652,11 +1418,17 @@ type instrumentationConfigValues struct {
 	extendedSampler       ExtendedSampler
 	maxSpans              int
 	sampler               Sampler
+	samplerConfig         samplerConfig
+	parentSampling        parentSamplingPolicies
 	spanFramesMinDuration time.Duration
 	exitSpanMinDuration   time.Duration
 	stackTraceLimit       int
 	propagateLegacyHeader bool
+	propagators           []string
 	sanitizedFieldNames   wildcard.Matchers
+	baggageToLabels       wildcard.Matchers
 	ignoreTransactionURLs wildcard.Matchers
 	compressionOptions    compressionOptions
+	batchLimits           batchLimits
+	profiling             profilingConfig
 }
@@ -0,0 +1,61 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitialPropagators(t *testing.T) {
+	propagators, err := initialPropagators()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tracecontext"}, propagators)
+
+	os.Setenv(envPropagators, "tracecontext, B3,jaeger")
+	defer os.Unsetenv(envPropagators)
+	propagators, err = initialPropagators()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tracecontext", "b3", "jaeger"}, propagators)
+
+	os.Setenv(envPropagators, "b3,zipkin")
+	_, err = initialPropagators()
+	assert.EqualError(t, err, `invalid ATATUS_PROPAGATORS value "b3,zipkin": unknown propagator "zipkin"`)
+
+	os.Setenv(envPropagators, ",")
+	_, err = initialPropagators()
+	assert.EqualError(t, err, `invalid ATATUS_PROPAGATORS value ",": no propagators specified`)
+}
+
+func TestTracerSetPropagators(t *testing.T) {
+	tracer := newAggTestTracer(t, "http://server.invalid")
+	defer tracer.Close()
+
+	assert.Equal(t, []string{"tracecontext"}, tracer.Propagators())
+	require.NoError(t, tracer.SetPropagators("b3multi", "tracecontext"))
+	assert.Equal(t, []string{"b3multi", "tracecontext"}, tracer.Propagators())
+	assert.Error(t, tracer.SetPropagators())
+
+	tracer.updateRemoteConfig(nil, nil, map[string]string{"propagators": "jaeger"})
+	tx := tracer.StartTransaction("name", "type")
+	assert.Equal(t, []string{"jaeger"}, tx.Propagators())
+	tx.End()
+	assert.Nil(t, tx.Propagators())
+}
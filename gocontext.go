@@ -41,6 +41,13 @@ func ContextWithBodyCapturer(parent context.Context, bc *BodyCapturer) context.C
 	return apmcontext.ContextWithBodyCapturer(parent, bc)
 }
 
+// ContextWithBaggage returns a copy of parent in which the given
+// baggage is stored. Instrumentation propagating requests to other
+// services will include the baggage in outgoing requests.
+func ContextWithBaggage(parent context.Context, b Baggage) context.Context {
+	return context.WithValue(parent, baggageKey{}, b)
+}
+
 // SpanFromContext returns the current Span in context, if any. The span must
 // have been added to the context previously using ContextWithSpan, or the
 // top-level StartSpan function.
@@ -65,6 +72,16 @@ func BodyCapturerFromContext(ctx context.Context) *BodyCapturer {
 	return value
 }
 
+// BaggageFromContext returns the Baggage in context, if any. The baggage
+// must have been added to the context previously using ContextWithBaggage;
+// otherwise the returned Baggage will be empty.
+func BaggageFromContext(ctx context.Context) Baggage {
+	value, _ := ctx.Value(baggageKey{}).(Baggage)
+	return value
+}
+
+type baggageKey struct{}
+
 // DetachedContext returns a new context detached from the lifetime
 // of ctx, but which still returns the values of ctx.
 //
@@ -101,6 +118,7 @@ func StartSpan(ctx context.Context, name, spanType string) (*Span, context.Conte
 // when the span completes.
 func StartSpanOptions(ctx context.Context, name, spanType string, opts SpanOptions) (*Span, context.Context) {
 	var span *Span
+	opts.ctx = ctx
 	if opts.parent = SpanFromContext(ctx); opts.parent != nil {
 		if opts.parent.tx == nil && opts.parent.tracer != nil {
 			span = opts.parent.tracer.StartSpan(name, spanType, opts.parent.transactionID, opts)
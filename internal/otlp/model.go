@@ -0,0 +1,231 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+)
+
+// SpanKind describes the relationship between a span, its parents and
+// its children in a trace.
+type SpanKind int32
+
+// Span kinds.
+const (
+	SpanKindUnspecified SpanKind = 0
+	SpanKindInternal    SpanKind = 1
+	SpanKindServer      SpanKind = 2
+	SpanKindClient      SpanKind = 3
+	SpanKindProducer    SpanKind = 4
+	SpanKindConsumer    SpanKind = 5
+)
+
+// StatusCode is the status of a span.
+type StatusCode int32
+
+// Status codes.
+const (
+	StatusCodeUnset StatusCode = 0
+	StatusCodeOk    StatusCode = 1
+	StatusCodeError StatusCode = 2
+)
+
+// SeverityNumber is the severity of a log record.
+type SeverityNumber int32
+
+// SeverityNumberError is the severity number of error log records.
+const SeverityNumberError SeverityNumber = 17
+
+// TraceID is a trace ID, encoded in JSON as a hex string.
+type TraceID [16]byte
+
+// MarshalJSON encodes id as a hex string, or the empty string if id is zero.
+func (id TraceID) MarshalJSON() ([]byte, error) {
+	return marshalHexID(id[:])
+}
+
+// SpanID is a span ID, encoded in JSON as a hex string.
+type SpanID [8]byte
+
+// MarshalJSON encodes id as a hex string, or the empty string if id is zero.
+func (id SpanID) MarshalJSON() ([]byte, error) {
+	return marshalHexID(id[:])
+}
+
+func marshalHexID(id []byte) ([]byte, error) {
+	if isZero(id) {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(hex.EncodeToString(id))
+}
+
+func isZero(id []byte) bool {
+	for _, b := range id {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyValue is an attribute key/value pair.
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue holds an attribute value. Exactly one field should be set.
+type AnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *int64   `json:"intValue,omitempty,string"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// String returns a KeyValue holding a string value.
+func String(key, value string) KeyValue {
+	return KeyValue{Key: key, Value: AnyValue{StringValue: &value}}
+}
+
+// Bool returns a KeyValue holding a bool value.
+func Bool(key string, value bool) KeyValue {
+	return KeyValue{Key: key, Value: AnyValue{BoolValue: &value}}
+}
+
+// Int returns a KeyValue holding an integer value.
+func Int(key string, value int64) KeyValue {
+	return KeyValue{Key: key, Value: AnyValue{IntValue: &value}}
+}
+
+// Double returns a KeyValue holding a floating point value.
+func Double(key string, value float64) KeyValue {
+	return KeyValue{Key: key, Value: AnyValue{DoubleValue: &value}}
+}
+
+// Resource describes the entity producing telemetry.
+type Resource struct {
+	Attributes []KeyValue `json:"attributes,omitempty"`
+}
+
+// Scope describes the instrumentation scope producing telemetry.
+type Scope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// TracesRequest is an OTLP trace export request.
+type TracesRequest struct {
+	ResourceSpans []ResourceSpans `json:"resourceSpans"`
+}
+
+// ResourceSpans holds the spans produced by a resource.
+type ResourceSpans struct {
+	Resource   Resource     `json:"resource"`
+	ScopeSpans []ScopeSpans `json:"scopeSpans"`
+}
+
+// ScopeSpans holds the spans produced by an instrumentation scope.
+type ScopeSpans struct {
+	Scope Scope  `json:"scope"`
+	Spans []Span `json:"spans"`
+}
+
+// Span is a single operation within a trace.
+type Span struct {
+	TraceID           TraceID    `json:"traceId"`
+	SpanID            SpanID     `json:"spanId"`
+	TraceState        string     `json:"traceState,omitempty"`
+	ParentSpanID      SpanID     `json:"parentSpanId"`
+	Name              string     `json:"name"`
+	Kind              SpanKind   `json:"kind"`
+	StartTimeUnixNano uint64     `json:"startTimeUnixNano,string"`
+	EndTimeUnixNano   uint64     `json:"endTimeUnixNano,string"`
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	Status            Status     `json:"status"`
+}
+
+// Status is the status of a span.
+type Status struct {
+	Message string     `json:"message,omitempty"`
+	Code    StatusCode `json:"code,omitempty"`
+}
+
+// MetricsRequest is an OTLP metrics export request.
+type MetricsRequest struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+// ResourceMetrics holds the metrics produced by a resource.
+type ResourceMetrics struct {
+	Resource     Resource       `json:"resource"`
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+}
+
+// ScopeMetrics holds the metrics produced by an instrumentation scope.
+type ScopeMetrics struct {
+	Scope   Scope    `json:"scope"`
+	Metrics []Metric `json:"metrics"`
+}
+
+// Metric is a named metric, with its data points. Only gauges are supported.
+type Metric struct {
+	Name  string `json:"name"`
+	Unit  string `json:"unit,omitempty"`
+	Gauge Gauge  `json:"gauge"`
+}
+
+// Gauge holds the data points of a gauge metric.
+type Gauge struct {
+	DataPoints []NumberDataPoint `json:"dataPoints"`
+}
+
+// NumberDataPoint is a single floating point metric value.
+type NumberDataPoint struct {
+	Attributes   []KeyValue `json:"attributes,omitempty"`
+	TimeUnixNano uint64     `json:"timeUnixNano,string"`
+	AsDouble     float64    `json:"asDouble"`
+}
+
+// LogsRequest is an OTLP logs export request.
+type LogsRequest struct {
+	ResourceLogs []ResourceLogs `json:"resourceLogs"`
+}
+
+// ResourceLogs holds the log records produced by a resource.
+type ResourceLogs struct {
+	Resource  Resource    `json:"resource"`
+	ScopeLogs []ScopeLogs `json:"scopeLogs"`
+}
+
+// ScopeLogs holds the log records produced by an instrumentation scope.
+type ScopeLogs struct {
+	Scope      Scope       `json:"scope"`
+	LogRecords []LogRecord `json:"logRecords"`
+}
+
+// LogRecord is a single log record.
+type LogRecord struct {
+	TimeUnixNano         uint64         `json:"timeUnixNano,string"`
+	ObservedTimeUnixNano uint64         `json:"observedTimeUnixNano,string"`
+	SeverityNumber       SeverityNumber `json:"severityNumber,omitempty"`
+	SeverityText         string         `json:"severityText,omitempty"`
+	Body                 AnyValue       `json:"body"`
+	Attributes           []KeyValue     `json:"attributes,omitempty"`
+	TraceID              TraceID        `json:"traceId"`
+	SpanID               SpanID         `json:"spanId"`
+}
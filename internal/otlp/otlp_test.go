@@ -0,0 +1,84 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.atatus.com/agent/internal/otlp"
+)
+
+func testTracesRequest() *otlp.TracesRequest {
+	return &otlp.TracesRequest{ResourceSpans: []otlp.ResourceSpans{{
+		Resource: otlp.Resource{Attributes: []otlp.KeyValue{otlp.Int("k", 1)}},
+		ScopeSpans: []otlp.ScopeSpans{{
+			Scope: otlp.Scope{Name: "s"},
+			Spans: []otlp.Span{{
+				TraceID:           otlp.TraceID{1, 15: 2},
+				SpanID:            otlp.SpanID{3, 7: 4},
+				Name:              "a",
+				Kind:              otlp.SpanKindServer,
+				StartTimeUnixNano: 1,
+				EndTimeUnixNano:   2,
+			}},
+		}},
+	}}}
+}
+
+func TestTracesRequestMarshalProto(t *testing.T) {
+	assert.Equal(t,
+		"0a470a090a070a016b12021801123a0a030a017312330a100100000000000000"+
+			"0000000000000002120803000000000000042a01613002390100000000000000"+
+			"410200000000000000",
+		hex.EncodeToString(testTracesRequest().MarshalProto()),
+	)
+}
+
+func TestTracesRequestMarshalJSON(t *testing.T) {
+	data, err := json.Marshal(testTracesRequest())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"resourceSpans":[{
+		"resource":{"attributes":[{"key":"k","value":{"intValue":"1"}}]},
+		"scopeSpans":[{"scope":{"name":"s"},"spans":[{
+			"traceId":"01000000000000000000000000000002",
+			"spanId":"0300000000000004",
+			"parentSpanId":"",
+			"name":"a",
+			"kind":2,
+			"startTimeUnixNano":"1",
+			"endTimeUnixNano":"2",
+			"status":{}
+		}]}]
+	}]}`, string(data))
+}
+
+func TestLogsRequestMarshalProto(t *testing.T) {
+	body := "boom"
+	req := otlp.LogsRequest{ResourceLogs: []otlp.ResourceLogs{{
+		ScopeLogs: []otlp.ScopeLogs{{LogRecords: []otlp.LogRecord{{
+			SeverityNumber: otlp.SeverityNumberError,
+			Body:           otlp.AnyValue{StringValue: &body},
+		}}}},
+	}}}
+	// The zero trace and span IDs are omitted.
+	assert.Equal(t, "0a120a00120e0a00120a10112a060a04626f6f6d", hex.EncodeToString(req.MarshalProto()))
+}
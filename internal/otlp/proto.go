@@ -0,0 +1,271 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package otlp
+
+import "math"
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// MarshalProto encodes r in the OTLP protobuf format.
+func (r *TracesRequest) MarshalProto() []byte {
+	var b []byte
+	for i := range r.ResourceSpans {
+		b = appendMessage(b, 1, r.ResourceSpans[i].appendProto)
+	}
+	return b
+}
+
+func (rs *ResourceSpans) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, rs.Resource.appendProto)
+	for i := range rs.ScopeSpans {
+		b = appendMessage(b, 2, rs.ScopeSpans[i].appendProto)
+	}
+	return b
+}
+
+func (ss *ScopeSpans) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, ss.Scope.appendProto)
+	for i := range ss.Spans {
+		b = appendMessage(b, 2, ss.Spans[i].appendProto)
+	}
+	return b
+}
+
+func (s *Span) appendProto(b []byte) []byte {
+	b = appendID(b, 1, s.TraceID[:])
+	b = appendID(b, 2, s.SpanID[:])
+	b = appendString(b, 3, s.TraceState)
+	b = appendID(b, 4, s.ParentSpanID[:])
+	b = appendString(b, 5, s.Name)
+	b = appendVarintField(b, 6, uint64(s.Kind))
+	b = appendFixed64Field(b, 7, s.StartTimeUnixNano)
+	b = appendFixed64Field(b, 8, s.EndTimeUnixNano)
+	b = appendAttributes(b, 9, s.Attributes)
+	if s.Status != (Status{}) {
+		b = appendMessage(b, 15, s.Status.appendProto)
+	}
+	return b
+}
+
+func (s *Status) appendProto(b []byte) []byte {
+	b = appendString(b, 2, s.Message)
+	b = appendVarintField(b, 3, uint64(s.Code))
+	return b
+}
+
+// MarshalProto encodes r in the OTLP protobuf format.
+func (r *MetricsRequest) MarshalProto() []byte {
+	var b []byte
+	for i := range r.ResourceMetrics {
+		b = appendMessage(b, 1, r.ResourceMetrics[i].appendProto)
+	}
+	return b
+}
+
+func (rm *ResourceMetrics) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, rm.Resource.appendProto)
+	for i := range rm.ScopeMetrics {
+		b = appendMessage(b, 2, rm.ScopeMetrics[i].appendProto)
+	}
+	return b
+}
+
+func (sm *ScopeMetrics) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, sm.Scope.appendProto)
+	for i := range sm.Metrics {
+		b = appendMessage(b, 2, sm.Metrics[i].appendProto)
+	}
+	return b
+}
+
+func (m *Metric) appendProto(b []byte) []byte {
+	b = appendString(b, 1, m.Name)
+	b = appendString(b, 3, m.Unit)
+	b = appendMessage(b, 5, m.Gauge.appendProto)
+	return b
+}
+
+func (g *Gauge) appendProto(b []byte) []byte {
+	for i := range g.DataPoints {
+		b = appendMessage(b, 1, g.DataPoints[i].appendProto)
+	}
+	return b
+}
+
+func (p *NumberDataPoint) appendProto(b []byte) []byte {
+	b = appendFixed64Field(b, 3, p.TimeUnixNano)
+	// as_double is part of a oneof, so is encoded even if zero.
+	b = appendTag(b, 4, wireFixed64)
+	b = appendFixed64(b, math.Float64bits(p.AsDouble))
+	b = appendAttributes(b, 7, p.Attributes)
+	return b
+}
+
+// MarshalProto encodes r in the OTLP protobuf format.
+func (r *LogsRequest) MarshalProto() []byte {
+	var b []byte
+	for i := range r.ResourceLogs {
+		b = appendMessage(b, 1, r.ResourceLogs[i].appendProto)
+	}
+	return b
+}
+
+func (rl *ResourceLogs) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, rl.Resource.appendProto)
+	for i := range rl.ScopeLogs {
+		b = appendMessage(b, 2, rl.ScopeLogs[i].appendProto)
+	}
+	return b
+}
+
+func (sl *ScopeLogs) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, sl.Scope.appendProto)
+	for i := range sl.LogRecords {
+		b = appendMessage(b, 2, sl.LogRecords[i].appendProto)
+	}
+	return b
+}
+
+func (r *LogRecord) appendProto(b []byte) []byte {
+	b = appendFixed64Field(b, 1, r.TimeUnixNano)
+	b = appendVarintField(b, 2, uint64(r.SeverityNumber))
+	b = appendString(b, 3, r.SeverityText)
+	if r.Body != (AnyValue{}) {
+		b = appendMessage(b, 5, r.Body.appendProto)
+	}
+	b = appendAttributes(b, 6, r.Attributes)
+	b = appendID(b, 9, r.TraceID[:])
+	b = appendID(b, 10, r.SpanID[:])
+	b = appendFixed64Field(b, 11, r.ObservedTimeUnixNano)
+	return b
+}
+
+func (r *Resource) appendProto(b []byte) []byte {
+	return appendAttributes(b, 1, r.Attributes)
+}
+
+func (s *Scope) appendProto(b []byte) []byte {
+	b = appendString(b, 1, s.Name)
+	b = appendString(b, 2, s.Version)
+	return b
+}
+
+func (kv *KeyValue) appendProto(b []byte) []byte {
+	b = appendString(b, 1, kv.Key)
+	b = appendMessage(b, 2, kv.Value.appendProto)
+	return b
+}
+
+func (v *AnyValue) appendProto(b []byte) []byte {
+	// The value fields are part of a oneof, so are encoded even if zero.
+	switch {
+	case v.StringValue != nil:
+		b = appendTag(b, 1, wireBytes)
+		b = appendVarint(b, uint64(len(*v.StringValue)))
+		b = append(b, *v.StringValue...)
+	case v.BoolValue != nil:
+		b = appendTag(b, 2, wireVarint)
+		if *v.BoolValue {
+			b = appendVarint(b, 1)
+		} else {
+			b = appendVarint(b, 0)
+		}
+	case v.IntValue != nil:
+		b = appendTag(b, 3, wireVarint)
+		b = appendVarint(b, uint64(*v.IntValue))
+	case v.DoubleValue != nil:
+		b = appendTag(b, 4, wireFixed64)
+		b = appendFixed64(b, math.Float64bits(*v.DoubleValue))
+	}
+	return b
+}
+
+func appendAttributes(b []byte, field int, attrs []KeyValue) []byte {
+	for i := range attrs {
+		b = appendMessage(b, field, attrs[i].appendProto)
+	}
+	return b
+}
+
+// appendMessage appends the embedded message encoded by appendProto
+// as the given field.
+func appendMessage(b []byte, field int, appendProto func([]byte) []byte) []byte {
+	msg := appendProto(nil)
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(msg)))
+	return append(b, msg...)
+}
+
+// appendID appends the given trace or span ID as a bytes field,
+// omitting it if the ID is zero.
+func appendID(b []byte, field int, id []byte) []byte {
+	if isZero(id) {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(id)))
+	return append(b, id...)
+}
+
+func appendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendFixed64Field(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireFixed64)
+	return appendFixed64(b, v)
+}
+
+func appendTag(b []byte, field int, wireType uint64) []byte {
+	return appendVarint(b, uint64(field)<<3|wireType)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	return append(b,
+		byte(v), byte(v>>8), byte(v>>16), byte(v>>24),
+		byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56),
+	)
+}
@@ -0,0 +1,328 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package pprofdelta computes the difference between two snapshots of a
+// cumulative pprof profile, such as the mutex and block profiles, as
+// written by runtime/pprof.
+package pprofdelta // import "go.atatus.com/agent/internal/pprofdelta"
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Field numbers of the pprof profile.proto messages.
+const (
+	profileSample   = 2
+	profileLocation = 4
+
+	sampleLocationID = 1
+	sampleValue      = 2
+	sampleLabel      = 3
+
+	locationID      = 1
+	locationAddress = 3
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Delta returns the profile cur, with the sample values in prev subtracted.
+// Samples are matched by their stack addresses and labels; samples which
+// are unchanged since prev are omitted. Both profiles must be of the same
+// type, and taken in the same process. The result is gzip-compressed.
+func Delta(prev, cur []byte) ([]byte, error) {
+	prevProfile, err := parse(prev)
+	if err != nil {
+		return nil, err
+	}
+	curProfile, err := parse(cur)
+	if err != nil {
+		return nil, err
+	}
+	prevValues := make(map[string][]int64)
+	for _, s := range prevProfile.samples {
+		key := prevProfile.key(s)
+		prevValues[key] = addValues(prevValues[key], s.values)
+	}
+
+	var out []byte
+	var sampleIndex int
+	for _, f := range curProfile.fields {
+		if f.num != profileSample {
+			out = appendField(out, f)
+			continue
+		}
+		s := curProfile.samples[sampleIndex]
+		sampleIndex++
+		values, changed := subtractValues(s.values, prevValues[curProfile.key(s)])
+		if !changed {
+			continue
+		}
+		s.values = values
+		out = appendBytesField(out, profileSample, s.marshal())
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(out); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type profile struct {
+	fields    []field
+	samples   []sample
+	addresses map[uint64]uint64 // location ID -> address
+}
+
+type sample struct {
+	locationIDs []uint64
+	values      []int64
+	labels      [][]byte
+}
+
+// field is a top-level field of a profile message. For varint and
+// fixed-width fields, value holds the value; otherwise data holds
+// the field's bytes.
+type field struct {
+	num   int
+	wire  int
+	value uint64
+	data  []byte
+}
+
+func parse(data []byte) (*profile, error) {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, errors.Wrap(err, "decompressing profile")
+		}
+		if data, err = ioutil.ReadAll(zr); err != nil {
+			return nil, errors.Wrap(err, "decompressing profile")
+		}
+	}
+	p := &profile{addresses: make(map[uint64]uint64)}
+	err := decodeFields(data, func(f field) error {
+		p.fields = append(p.fields, f)
+		switch f.num {
+		case profileSample:
+			s, err := decodeSample(f.data)
+			if err != nil {
+				return err
+			}
+			p.samples = append(p.samples, s)
+		case profileLocation:
+			var id, address uint64
+			if err := decodeFields(f.data, func(f field) error {
+				switch f.num {
+				case locationID:
+					id = f.value
+				case locationAddress:
+					address = f.value
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			p.addresses[id] = address
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding profile")
+	}
+	return p, nil
+}
+
+// key returns a key identifying the sample's stack and labels,
+// which is comparable across profiles taken in the same process.
+func (p *profile) key(s sample) string {
+	var buf []byte
+	for _, id := range s.locationIDs {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], p.addresses[id])
+		buf = append(buf, b[:]...)
+	}
+	for _, label := range s.labels {
+		buf = appendBytesField(buf, sampleLabel, label)
+	}
+	return string(buf)
+}
+
+func decodeSample(data []byte) (sample, error) {
+	var s sample
+	err := decodeFields(data, func(f field) error {
+		switch f.num {
+		case sampleLocationID:
+			return decodeRepeated(f, func(v uint64) {
+				s.locationIDs = append(s.locationIDs, v)
+			})
+		case sampleValue:
+			return decodeRepeated(f, func(v uint64) {
+				s.values = append(s.values, int64(v))
+			})
+		case sampleLabel:
+			s.labels = append(s.labels, f.data)
+		}
+		return nil
+	})
+	return s, err
+}
+
+func (s sample) marshal() []byte {
+	var ids, values, out []byte
+	for _, id := range s.locationIDs {
+		ids = appendVarint(ids, id)
+	}
+	for _, v := range s.values {
+		values = appendVarint(values, uint64(v))
+	}
+	out = appendBytesField(out, sampleLocationID, ids)
+	out = appendBytesField(out, sampleValue, values)
+	for _, label := range s.labels {
+		out = appendBytesField(out, sampleLabel, label)
+	}
+	return out
+}
+
+func addValues(sum, values []int64) []int64 {
+	if sum == nil {
+		sum = make([]int64, len(values))
+	}
+	for i := range values {
+		if i < len(sum) {
+			sum[i] += values[i]
+		}
+	}
+	return sum
+}
+
+// subtractValues returns values minus prev, and whether
+// any of the resulting values is non-zero.
+func subtractValues(values, prev []int64) ([]int64, bool) {
+	var changed bool
+	out := make([]int64, len(values))
+	for i, v := range values {
+		if i < len(prev) {
+			v -= prev[i]
+		}
+		out[i] = v
+		changed = changed || v != 0
+	}
+	return out, changed
+}
+
+// decodeRepeated calls fn with each value of a repeated
+// varint field, which may or may not be packed.
+func decodeRepeated(f field, fn func(uint64)) error {
+	if f.wire != wireBytes {
+		fn(f.value)
+		return nil
+	}
+	for data := f.data; len(data) > 0; {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid varint")
+		}
+		fn(v)
+		data = data[n:]
+	}
+	return nil
+}
+
+func decodeFields(data []byte, fn func(field) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field tag")
+		}
+		data = data[n:]
+		f := field{num: int(tag >> 3), wire: int(tag & 7)}
+		switch f.wire {
+		case wireVarint:
+			if f.value, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("invalid varint")
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			f.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			f.value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errors.New("truncated field")
+			}
+			f.data = data[n : n+int(size)]
+			data = data[n+int(size):]
+		default:
+			return errors.Errorf("unsupported wire type %d", f.wire)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendField(b []byte, f field) []byte {
+	b = appendVarint(b, uint64(f.num)<<3|uint64(f.wire))
+	switch f.wire {
+	case wireVarint:
+		return appendVarint(b, f.value)
+	case wireFixed64:
+		var v [8]byte
+		binary.LittleEndian.PutUint64(v[:], f.value)
+		return append(b, v[:]...)
+	case wireFixed32:
+		var v [4]byte
+		binary.LittleEndian.PutUint32(v[:], uint32(f.value))
+		return append(b, v[:]...)
+	}
+	b = appendVarint(b, uint64(len(f.data)))
+	return append(b, f.data...)
+}
+
+func appendBytesField(b []byte, num int, data []byte) []byte {
+	return appendField(b, field{num: num, wire: wireBytes, data: data})
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
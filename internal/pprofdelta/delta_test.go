@@ -0,0 +1,95 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package pprofdelta
+
+import (
+	"bytes"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelta(t *testing.T) {
+	defer runtime.SetMutexProfileFraction(runtime.SetMutexProfileFraction(1))
+	contend()
+	prev := writeProfile(t, "mutex")
+
+	delta, err := Delta(prev, prev)
+	require.NoError(t, err)
+	p, err := parse(delta)
+	require.NoError(t, err)
+	assert.Empty(t, p.samples)
+
+	contend()
+	cur := writeProfile(t, "mutex")
+	delta, err = Delta(prev, cur)
+	require.NoError(t, err)
+	p, err = parse(delta)
+	require.NoError(t, err)
+	require.NotEmpty(t, p.samples)
+
+	// The delta holds the contention since prev, which is less than
+	// the total contention in cur.
+	prevProfile, err := parse(prev)
+	require.NoError(t, err)
+	curProfile, err := parse(cur)
+	require.NoError(t, err)
+	assert.Equal(t, sumCounts(curProfile)-sumCounts(prevProfile), sumCounts(p))
+	assert.True(t, sumCounts(p) < sumCounts(curProfile))
+
+	// Other fields, such as the sample types and string table, are kept.
+	assert.Equal(t, len(curProfile.fields)-len(curProfile.samples), len(p.fields)-len(p.samples))
+}
+
+func TestDeltaInvalid(t *testing.T) {
+	_, err := Delta([]byte{0x0a, 0x05}, nil)
+	assert.Error(t, err)
+}
+
+func contend() {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.Lock()
+			time.Sleep(time.Millisecond)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+func writeProfile(t *testing.T, name string) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, pprof.Lookup(name).WriteTo(&buf, 0))
+	return buf.Bytes()
+}
+
+func sumCounts(p *profile) int64 {
+	var sum int64
+	for _, s := range p.samples {
+		sum += s.values[0]
+	}
+	return sum
+}
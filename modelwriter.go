@@ -104,6 +104,29 @@ func (w *modelWriter) writeMetrics(m *Metrics) {
 	m.reset()
 }
 
+// exportOTLP converts the event to the model, and queues it in the
+// OTLP exporter. Non-sampled transactions are not exported.
+func (w *modelWriter) exportOTLP(exporter *otlpExporter, event tracerEvent) {
+	switch event.eventType {
+	case transactionEvent:
+		tx := event.tx.Transaction
+		if !tx.traceContext.Options.Recorded() {
+			return
+		}
+		var modelTx model.Transaction
+		w.buildModelTransaction(&modelTx, tx, event.tx.TransactionData)
+		exporter.addTransaction(&modelTx, tx.traceContext.State.String())
+	case spanEvent:
+		var modelSpan model.Span
+		w.buildModelSpan(&modelSpan, event.span.Span, event.span.SpanData)
+		exporter.addSpan(&modelSpan, event.span.traceContext.State.String())
+	case errorEvent:
+		var modelError model.Error
+		w.buildModelError(&modelError, event.err)
+		exporter.addError(&modelError)
+	}
+}
+
 func (w *modelWriter) buildModelTransaction(out *model.Transaction, tx *Transaction, td *TransactionData) {
 	out.ID = model.SpanID(tx.traceContext.Span)
 	out.TraceID = model.TraceID(tx.traceContext.Trace)
@@ -196,16 +196,16 @@ func startSpan(ctx context.Context, name string) (*atatus.Span, context.Context)
 		return nil, ctx
 	}
 	traceContext := tx.TraceContext()
-	propagateLegacyHeader := tx.ShouldPropagateLegacyHeader()
+	propagator := athttp.NewPropagator(tx.Propagators(), tx.ShouldPropagateLegacyHeader())
 	if !traceContext.Options.Recorded() {
-		return nil, outgoingContextWithTraceContext(ctx, traceContext, propagateLegacyHeader)
+		return nil, outgoingContextWithTraceContext(ctx, traceContext, propagator)
 	}
 	span := tx.StartSpan(name, "external.grpc", atatus.SpanFromContext(ctx))
 	if !span.Dropped() {
 		traceContext = span.TraceContext()
 		ctx = atatus.ContextWithSpan(ctx, span)
 	}
-	return span, outgoingContextWithTraceContext(ctx, traceContext, propagateLegacyHeader)
+	return span, outgoingContextWithTraceContext(ctx, traceContext, propagator)
 }
 
 func setSpanContext(span *atatus.Span, peer peer.Peer) {
@@ -224,21 +224,17 @@ func setSpanContext(span *atatus.Span, peer peer.Peer) {
 func outgoingContextWithTraceContext(
 	ctx context.Context,
 	traceContext atatus.TraceContext,
-	propagateLegacyHeader bool,
+	propagator athttp.Propagator,
 ) context.Context {
-	traceparentValue := athttp.FormatTraceparentHeader(traceContext)
 	md, ok := metadata.FromOutgoingContext(ctx)
 	if !ok {
-		md = metadata.Pairs(w3cTraceparentHeader, traceparentValue)
+		md = metadata.MD{}
 	} else {
 		md = md.Copy()
-		md.Set(w3cTraceparentHeader, traceparentValue)
 	}
-	if propagateLegacyHeader {
-		md.Set(atatusTraceparentHeader, traceparentValue)
-	}
-	if tracestate := traceContext.State.String(); tracestate != "" {
-		md.Set(tracestateHeader, tracestate)
+	propagator.Inject(traceContext, metadataCarrier(md))
+	if baggage := atatus.BaggageFromContext(ctx); baggage.Len() != 0 && len(md.Get(baggageHeader)) == 0 {
+		md.Set(baggageHeader, baggage.String())
 	}
 	return metadata.NewOutgoingContext(ctx, md)
 }
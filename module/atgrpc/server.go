@@ -39,9 +39,7 @@ import (
 )
 
 var (
-	atatusTraceparentHeader = strings.ToLower(athttp.AtatusTraceparentHeader)
-	w3cTraceparentHeader     = strings.ToLower(athttp.W3CTraceparentHeader)
-	tracestateHeader         = strings.ToLower(athttp.TracestateHeader)
+	baggageHeader = strings.ToLower(athttp.BaggageHeader)
 )
 
 // NewUnaryServerInterceptor returns a grpc.UnaryServerInterceptor that
@@ -164,11 +162,12 @@ func startTransaction(ctx context.Context, tracer *atatus.Tracer, name string) (
 	var opts atatus.TransactionOptions
 	md, ok := metadata.FromIncomingContext(ctx)
 	if ok {
-		traceContext, ok := getIncomingMetadataTraceContext(md, w3cTraceparentHeader)
-		if !ok {
-			traceContext, _ = getIncomingMetadataTraceContext(md, atatusTraceparentHeader)
+		propagator := athttp.NewPropagator(tracer.Propagators(), false)
+		opts.TraceContext, _ = propagator.Extract(metadataCarrier(md))
+		opts.Baggage, _ = athttp.ParseBaggageHeader(md.Get(baggageHeader)...)
+		if opts.Baggage.Len() != 0 {
+			ctx = atatus.ContextWithBaggage(ctx, opts.Baggage)
 		}
-		opts.TraceContext = traceContext
 	}
 	tx := tracer.StartTransactionOptions(name, "request", opts)
 	tx.Context.SetFramework("grpc", grpc.Version)
@@ -204,15 +203,16 @@ func startTransaction(ctx context.Context, tracer *atatus.Tracer, name string) (
 	return tx, atatus.ContextWithTransaction(ctx, tx)
 }
 
-func getIncomingMetadataTraceContext(md metadata.MD, header string) (atatus.TraceContext, bool) {
-	if values := md.Get(header); len(values) == 1 {
-		traceContext, err := athttp.ParseTraceparentHeader(values[0])
-		if err == nil {
-			traceContext.State, _ = athttp.ParseTracestateHeader(md.Get(tracestateHeader)...)
-			return traceContext, true
-		}
-	}
-	return atatus.TraceContext{}, false
+// metadataCarrier is an athttp.Carrier for gRPC metadata,
+// in which keys are lower-case.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) []string {
+	return metadata.MD(c).Get(key)
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
 }
 
 func setTransactionResult(tx *atatus.Transaction, err error) {
@@ -73,6 +73,7 @@ type roundTripper struct {
 	requestIgnorer RequestIgnorerFunc
 	traceRequests  bool
 	spanType       string
+	propagator     Propagator
 }
 
 // RoundTrip delegates to r.r, emitting a span if req's context
@@ -83,7 +84,8 @@ func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 	ctx := req.Context()
 	tx := atatus.TransactionFromContext(ctx)
-	if tx == nil {
+	baggage := atatus.BaggageFromContext(ctx)
+	if tx == nil && baggage.Len() == 0 {
 		return r.r.RoundTrip(req)
 	}
 
@@ -96,10 +98,18 @@ func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 	req = &reqCopy
 
-	propagateLegacyHeader := tx.ShouldPropagateLegacyHeader()
+	SetBaggageHeader(req, baggage)
+	if tx == nil {
+		return r.r.RoundTrip(req)
+	}
+
+	propagator := r.propagator
+	if propagator == nil {
+		propagator = NewPropagator(tx.Propagators(), tx.ShouldPropagateLegacyHeader())
+	}
 	traceContext := tx.TraceContext()
 	if !traceContext.Options.Recorded() {
-		SetHeaders(req, traceContext, propagateLegacyHeader)
+		propagator.Inject(traceContext, HeaderCarrier(req.Header))
 		return r.r.RoundTrip(req)
 	}
 
@@ -119,7 +129,7 @@ func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 		span = nil
 	}
 
-	SetHeaders(req, traceContext, propagateLegacyHeader)
+	propagator.Inject(traceContext, HeaderCarrier(req.Header))
 	resp, err := r.r.RoundTrip(req)
 	if span != nil {
 		if err != nil {
@@ -136,15 +146,20 @@ func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 // SetHeaders sets traceparent and tracestate headers on an http request.
+//
+// SetHeaders always uses the W3C Trace Context format; use a Propagator
+// to inject trace context in other formats.
 func SetHeaders(req *http.Request, traceContext atatus.TraceContext, propagateLegacyHeader bool) {
-	headerValue := FormatTraceparentHeader(traceContext)
-	if propagateLegacyHeader {
-		req.Header.Set(AtatusTraceparentHeader, headerValue)
-	}
-	req.Header.Set(W3CTraceparentHeader, headerValue)
-	if tracestate := traceContext.State.String(); tracestate != "" {
-		req.Header.Set(TracestateHeader, tracestate)
+	TraceContextPropagator{PropagateLegacyHeader: propagateLegacyHeader}.Inject(traceContext, HeaderCarrier(req.Header))
+}
+
+// SetBaggageHeader sets the baggage header on an http request, unless
+// the baggage is empty or the request already has a baggage header.
+func SetBaggageHeader(req *http.Request, baggage atatus.Baggage) {
+	if baggage.Len() == 0 || len(req.Header[BaggageHeader]) != 0 {
+		return
 	}
+	req.Header.Set(BaggageHeader, baggage.String())
 }
 
 // CloseIdleConnections calls r.r.CloseIdleConnections if the method exists.
@@ -214,6 +229,16 @@ func WithClientRequestName(r RequestNameFunc) ClientOption {
 	})
 }
 
+// WithClientPropagator returns a ClientOption which sets p as the Propagator
+// to use for injecting trace context into client requests, in place of the
+// propagators configured for the tracer. If p is nil, the tracer's
+// propagators will be used.
+func WithClientPropagator(p Propagator) ClientOption {
+	return ClientOption(func(rt *roundTripper) {
+		rt.propagator = p
+	})
+}
+
 // WithClientSpanType sets the span type for HTTP client requests.
 //
 // Defaults to "external.http".
@@ -65,6 +65,8 @@ type handler struct {
 	panicPropagation bool
 	requestName      RequestNameFunc
 	requestIgnorer   RequestIgnorerFunc
+	trustedOrigin    TrustedOriginFunc
+	propagator       Propagator
 }
 
 // ServeHTTP delegates to h.Handler, tracing the transaction with
@@ -74,7 +76,12 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		h.handler.ServeHTTP(w, req)
 		return
 	}
-	tx, body, req := StartTransactionWithBody(h.tracer, h.requestName(req), req)
+	untrusted := h.trustedOrigin != nil && !h.trustedOrigin(req)
+	tx, req := startTransaction(h.tracer, h.requestName(req), req, h.propagator, untrusted)
+	body := h.tracer.CaptureHTTPRequestBody(req)
+	if body != nil {
+		req = RequestWithContext(atatus.ContextWithBodyCapturer(req.Context(), body), req)
+	}
 	defer tx.End()
 
 	w, resp := WrapResponseWriter(w)
@@ -110,15 +117,33 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 //
 // DEPRECATED. Use StartTransactionWithBody instead.
 func StartTransaction(tracer *atatus.Tracer, name string, req *http.Request) (*atatus.Transaction, *http.Request) {
-	traceContext, ok := getRequestTraceparent(req, W3CTraceparentHeader)
-	if !ok {
-		traceContext, ok = getRequestTraceparent(req, AtatusTraceparentHeader)
-	}
-	if ok {
-		traceContext.State, _ = ParseTracestateHeader(req.Header[TracestateHeader]...)
+	return startTransaction(tracer, name, req, nil, false)
+}
+
+// startTransaction starts a transaction for req, extracting trace context
+// with propagator, or with the tracer's configured propagators if nil.
+func startTransaction(
+	tracer *atatus.Tracer,
+	name string,
+	req *http.Request,
+	propagator Propagator,
+	untrusted bool,
+) (*atatus.Transaction, *http.Request) {
+	if propagator == nil {
+		propagator = NewPropagator(tracer.Propagators(), false)
 	}
-	tx := tracer.StartTransactionOptions(name, "request", atatus.TransactionOptions{TraceContext: traceContext})
+	traceContext, _ := propagator.Extract(HeaderCarrier(req.Header))
+	baggage, _ := ParseBaggageHeader(req.Header[BaggageHeader]...)
+	tx := tracer.StartTransactionOptions(name, "request", atatus.TransactionOptions{
+		TraceContext:          traceContext,
+		UntrustedTraceContext: untrusted,
+		Baggage:               baggage,
+		Context:               req.Context(),
+	})
 	ctx := atatus.ContextWithTransaction(req.Context(), tx)
+	if baggage.Len() != 0 {
+		ctx = atatus.ContextWithBaggage(ctx, baggage)
+	}
 	req = RequestWithContext(ctx, req)
 	return tx, req
 }
@@ -137,15 +162,6 @@ func StartTransactionWithBody(tracer *atatus.Tracer, name string, req *http.Requ
 	return tx, bc, req
 }
 
-func getRequestTraceparent(req *http.Request, header string) (atatus.TraceContext, bool) {
-	if values := req.Header[header]; len(values) == 1 && values[0] != "" {
-		if c, err := ParseTraceparentHeader(values[0]); err == nil {
-			return c, true
-		}
-	}
-	return atatus.TraceContext{}, false
-}
-
 // SetTransactionContext sets tx.Result and, if the transaction is being
 // sampled, sets tx.Context with information from req, resp, and body.
 func SetTransactionContext(tx *atatus.Transaction, req *http.Request, resp *Response, body *atatus.BodyCapturer) {
@@ -377,6 +393,31 @@ func WithServerRequestIgnorer(r RequestIgnorerFunc) ServerOption {
 	}
 }
 
+// TrustedOriginFunc is the type of a function for use in
+// WithTrustedOrigin.
+type TrustedOriginFunc func(*http.Request) bool
+
+// WithTrustedOrigin returns a ServerOption which sets f as the function
+// to use to determine whether or not the trace context of a server request
+// is from a trusted origin. The trace context of requests for which f
+// returns false is subject to the tracer's untrusted parent sampling
+// policy. If f is nil, all requests are trusted.
+func WithTrustedOrigin(f TrustedOriginFunc) ServerOption {
+	return func(h *handler) {
+		h.trustedOrigin = f
+	}
+}
+
+// WithServerPropagator returns a ServerOption which sets p as the Propagator
+// to use for extracting trace context from server requests, in place of the
+// propagators configured for the tracer. If p is nil, the tracer's
+// propagators will be used.
+func WithServerPropagator(p Propagator) ServerOption {
+	return func(h *handler) {
+		h.propagator = p
+	}
+}
+
 // RequestWithContext is equivalent to req.WithContext, except that the URL
 // pointer is copied, rather than the contents.
 func RequestWithContext(ctx context.Context, req *http.Request) *http.Request {
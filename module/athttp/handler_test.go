@@ -533,6 +533,65 @@ func TestHandlerTracestateHeader(t *testing.T) {
 	assert.Equal(t, "", w.Body.String())
 }
 
+func TestHandlerTrustedOrigin(t *testing.T) {
+	tracer := apmtest.NewDiscardTracer()
+	defer tracer.Close()
+	tracer.SetParentSamplingPolicy(atatus.ParentSamplingRespect, atatus.ParentSamplingResample)
+	tracer.SetSampler(atatus.NewRatioSampler(0))
+
+	mux := http.NewServeMux()
+	mux.Handle("/foo", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tx := atatus.TransactionFromContext(req.Context())
+		fmt.Fprint(w, tx.Sampled())
+	}))
+	h := athttp.Wrap(mux, athttp.WithTracer(tracer), athttp.WithTrustedOrigin(func(req *http.Request) bool {
+		return req.Header.Get("X-Internal") != ""
+	}))
+
+	sampled := func(internal bool) string {
+		req, _ := http.NewRequest("GET", "http://server.testing/foo", nil)
+		req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		if internal {
+			req.Header.Set("X-Internal", "1")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	assert.Equal(t, "true", sampled(true))
+	assert.Equal(t, "false", sampled(false))
+}
+
+func TestHandlerBaggage(t *testing.T) {
+	tracer := apmtest.NewDiscardTracer()
+	defer tracer.Close()
+
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, req.Header.Get("Baggage"))
+	}))
+	defer downstream.Close()
+
+	client := athttp.WrapClient(http.DefaultClient)
+	h := athttp.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		baggage := atatus.BaggageFromContext(req.Context())
+		baggage, err := baggage.Set("region", "eu west")
+		require.NoError(t, err)
+		ctx := atatus.ContextWithBaggage(req.Context(), baggage)
+
+		outgoing, _ := http.NewRequest("GET", downstream.URL, nil)
+		resp, err := client.Do(outgoing.WithContext(ctx))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}), athttp.WithTracer(tracer))
+
+	req, _ := http.NewRequest("GET", "http://server.testing/foo", nil)
+	req.Header.Set("Baggage", "tenant_id=acme")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "tenant_id=acme,region=eu%20west", w.Body.String())
+}
+
 func TestHandlerReaderFrom(t *testing.T) {
 	recorder := apmtest.NewRecordingTracer()
 	defer recorder.Close()
@@ -0,0 +1,293 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package athttp // import "go.atatus.com/agent/module/athttp"
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	atatus "go.atatus.com/agent"
+)
+
+const (
+	// B3Header is the Zipkin B3 single HTTP header for trace propagation.
+	B3Header = "B3"
+
+	// B3TraceIDHeader, B3SpanIDHeader, B3SampledHeader and B3FlagsHeader
+	// are the Zipkin B3 multiple HTTP headers for trace propagation.
+	B3TraceIDHeader = "X-B3-TraceId"
+	B3SpanIDHeader  = "X-B3-SpanId"
+	B3SampledHeader = "X-B3-Sampled"
+	B3FlagsHeader   = "X-B3-Flags"
+
+	// JaegerHeader is the Jaeger HTTP header for trace propagation.
+	JaegerHeader = "Uber-Trace-Id"
+)
+
+// Carrier is the interface for reading and writing the headers,
+// or other key/value metadata, of requests for trace propagation.
+type Carrier interface {
+	// Get returns the values for key.
+	Get(key string) []string
+
+	// Set sets the value for key, replacing any existing values.
+	Set(key, value string)
+}
+
+// HeaderCarrier is a Carrier for http.Header.
+type HeaderCarrier http.Header
+
+// Get returns the values for the canonical form of key.
+func (h HeaderCarrier) Get(key string) []string {
+	return h[textproto.CanonicalMIMEHeaderKey(key)]
+}
+
+// Set sets the value for key, replacing any existing values.
+func (h HeaderCarrier) Set(key, value string) {
+	http.Header(h).Set(key, value)
+}
+
+// Propagator is the interface for injecting trace context into the
+// headers of outgoing requests, and extracting it from the headers
+// of incoming requests, in a particular propagation format.
+type Propagator interface {
+	// Inject sets headers in carrier for propagating traceContext.
+	Inject(traceContext atatus.TraceContext, carrier Carrier)
+
+	// Extract returns the trace context held in carrier, and a boolean
+	// indicating whether or not valid trace context was found.
+	Extract(carrier Carrier) (atatus.TraceContext, bool)
+}
+
+// NewPropagator returns a Propagator for the named propagation formats,
+// as returned by atatus.Tracer.Propagators and atatus.Transaction.Propagators.
+// Unknown names are ignored; if no known formats are named, the returned
+// Propagator uses W3C Trace Context.
+//
+// If propagateLegacyHeader is true, the legacy "Atatus-Apm-Traceparent"
+// header is injected along with the W3C Trace Context headers.
+func NewPropagator(names []string, propagateLegacyHeader bool) Propagator {
+	var propagators CompositePropagator
+	for _, name := range names {
+		switch name {
+		case "tracecontext":
+			propagators = append(propagators, TraceContextPropagator{PropagateLegacyHeader: propagateLegacyHeader})
+		case "b3":
+			propagators = append(propagators, B3Propagator{})
+		case "b3multi":
+			propagators = append(propagators, B3Propagator{MultipleHeaders: true})
+		case "jaeger":
+			propagators = append(propagators, JaegerPropagator{})
+		}
+	}
+	switch len(propagators) {
+	case 0:
+		return TraceContextPropagator{PropagateLegacyHeader: propagateLegacyHeader}
+	case 1:
+		return propagators[0]
+	}
+	return propagators
+}
+
+// CompositePropagator is a Propagator which injects trace context using
+// each of its Propagators, and extracts trace context using the first of
+// its Propagators to find valid trace context.
+type CompositePropagator []Propagator
+
+// Inject injects traceContext into carrier using each of p's Propagators.
+func (p CompositePropagator) Inject(traceContext atatus.TraceContext, carrier Carrier) {
+	for _, p := range p {
+		p.Inject(traceContext, carrier)
+	}
+}
+
+// Extract returns the trace context extracted from carrier by the first
+// of p's Propagators to find valid trace context.
+func (p CompositePropagator) Extract(carrier Carrier) (atatus.TraceContext, bool) {
+	for _, p := range p {
+		if traceContext, ok := p.Extract(carrier); ok {
+			return traceContext, true
+		}
+	}
+	return atatus.TraceContext{}, false
+}
+
+// TraceContextPropagator is a Propagator for the W3C Trace Context
+// "traceparent" and "tracestate" headers.
+//
+// The legacy "Atatus-Apm-Traceparent" header is extracted if there is
+// no valid "traceparent" header, and injected if PropagateLegacyHeader
+// is true.
+type TraceContextPropagator struct {
+	PropagateLegacyHeader bool
+}
+
+// Inject sets the traceparent and tracestate headers in carrier.
+func (p TraceContextPropagator) Inject(traceContext atatus.TraceContext, carrier Carrier) {
+	headerValue := FormatTraceparentHeader(traceContext)
+	if p.PropagateLegacyHeader {
+		carrier.Set(AtatusTraceparentHeader, headerValue)
+	}
+	carrier.Set(W3CTraceparentHeader, headerValue)
+	if tracestate := traceContext.State.String(); tracestate != "" {
+		carrier.Set(TracestateHeader, tracestate)
+	}
+}
+
+// Extract returns the trace context held in the traceparent and
+// tracestate headers of carrier.
+func (TraceContextPropagator) Extract(carrier Carrier) (atatus.TraceContext, bool) {
+	traceContext, ok := extractTraceparent(carrier, W3CTraceparentHeader)
+	if !ok {
+		traceContext, ok = extractTraceparent(carrier, AtatusTraceparentHeader)
+	}
+	if ok {
+		traceContext.State, _ = ParseTracestateHeader(carrier.Get(TracestateHeader)...)
+	}
+	return traceContext, ok
+}
+
+func extractTraceparent(carrier Carrier, header string) (atatus.TraceContext, bool) {
+	if values := carrier.Get(header); len(values) == 1 && values[0] != "" {
+		if c, err := ParseTraceparentHeader(values[0]); err == nil {
+			return c, true
+		}
+	}
+	return atatus.TraceContext{}, false
+}
+
+// B3Propagator is a Propagator for the Zipkin B3 headers. Trace context is
+// extracted from either the single "b3" header or the multiple "X-B3-*"
+// headers, preferring the single header. Trace context is injected into the
+// single header, or into the multiple headers if MultipleHeaders is true.
+//
+// B3 allows the sampling decision to be deferred to the receiver, which is
+// not representable in the W3C Trace Context model; a deferred decision is
+// extracted as a decision not to sample.
+type B3Propagator struct {
+	MultipleHeaders bool
+}
+
+// Inject sets the B3 headers in carrier.
+func (p B3Propagator) Inject(traceContext atatus.TraceContext, carrier Carrier) {
+	sampled := "0"
+	if traceContext.Options.Recorded() {
+		sampled = "1"
+	}
+	if !p.MultipleHeaders {
+		carrier.Set(B3Header, fmt.Sprintf("%032x-%016x-%s", traceContext.Trace[:], traceContext.Span[:], sampled))
+		return
+	}
+	carrier.Set(B3TraceIDHeader, fmt.Sprintf("%032x", traceContext.Trace[:]))
+	carrier.Set(B3SpanIDHeader, fmt.Sprintf("%016x", traceContext.Span[:]))
+	carrier.Set(B3SampledHeader, sampled)
+}
+
+// Extract returns the trace context held in the B3 headers of carrier.
+func (B3Propagator) Extract(carrier Carrier) (atatus.TraceContext, bool) {
+	if values := carrier.Get(B3Header); len(values) == 1 {
+		// b3: {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}
+		fields := strings.Split(values[0], "-")
+		if len(fields) < 2 || len(fields) > 4 {
+			return atatus.TraceContext{}, false
+		}
+		var sampled string
+		if len(fields) > 2 {
+			sampled = fields[2]
+		}
+		return makeTraceContext(fields[0], fields[1], sampled == "1" || sampled == "d")
+	}
+	traceID := firstValue(carrier, B3TraceIDHeader)
+	spanID := firstValue(carrier, B3SpanIDHeader)
+	if traceID == "" || spanID == "" {
+		return atatus.TraceContext{}, false
+	}
+	sampled := firstValue(carrier, B3SampledHeader)
+	recorded := sampled == "1" || sampled == "true" || firstValue(carrier, B3FlagsHeader) == "1"
+	return makeTraceContext(traceID, spanID, recorded)
+}
+
+// JaegerPropagator is a Propagator for the Jaeger "uber-trace-id" header.
+type JaegerPropagator struct{}
+
+// Inject sets the uber-trace-id header in carrier.
+func (JaegerPropagator) Inject(traceContext atatus.TraceContext, carrier Carrier) {
+	var flags int
+	if traceContext.Options.Recorded() {
+		flags = 1
+	}
+	carrier.Set(JaegerHeader, fmt.Sprintf("%032x:%016x:0:%d", traceContext.Trace[:], traceContext.Span[:], flags))
+}
+
+// Extract returns the trace context held in the uber-trace-id header of carrier.
+func (JaegerPropagator) Extract(carrier Carrier) (atatus.TraceContext, bool) {
+	value := firstValue(carrier, JaegerHeader)
+	if strings.ContainsRune(value, '%') {
+		unescaped, err := url.QueryUnescape(value)
+		if err != nil {
+			return atatus.TraceContext{}, false
+		}
+		value = unescaped
+	}
+	// uber-trace-id: {trace-id}:{span-id}:{parent-span-id}:{flags}
+	fields := strings.Split(value, ":")
+	if len(fields) != 4 {
+		return atatus.TraceContext{}, false
+	}
+	flags, err := strconv.ParseUint(fields[3], 16, 8)
+	if err != nil {
+		return atatus.TraceContext{}, false
+	}
+	return makeTraceContext(fields[0], fields[1], flags&1 != 0)
+}
+
+// makeTraceContext returns a trace context with the given hex-encoded
+// trace and span IDs, which may be shorter than their full lengths,
+// in which case they are padded with leading zeroes.
+func makeTraceContext(traceID, spanID string, recorded bool) (atatus.TraceContext, bool) {
+	var out atatus.TraceContext
+	if !decodeHexID(out.Trace[:], traceID) || out.Trace.Validate() != nil {
+		return atatus.TraceContext{}, false
+	}
+	if !decodeHexID(out.Span[:], spanID) || out.Span.Validate() != nil {
+		return atatus.TraceContext{}, false
+	}
+	out.Options = out.Options.WithRecorded(recorded)
+	return out, true
+}
+
+func decodeHexID(out []byte, s string) bool {
+	n := hex.EncodedLen(len(out))
+	if s == "" || len(s) > n {
+		return false
+	}
+	s = strings.Repeat("0", n-len(s)) + s
+	_, err := hex.Decode(out, []byte(s))
+	return err == nil
+}
+
+func firstValue(carrier Carrier, key string) string {
+	if values := carrier.Get(key); len(values) != 0 {
+		return values[0]
+	}
+	return ""
+}
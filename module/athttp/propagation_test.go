@@ -0,0 +1,167 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package athttp_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	atatus "go.atatus.com/agent"
+	"go.atatus.com/agent/apmtest"
+	"go.atatus.com/agent/module/athttp"
+)
+
+var testTraceContext = atatus.TraceContext{
+	Trace:   atatus.TraceID{0x0a, 0xf7, 0x65, 0x19, 0x16, 0xcd, 0x43, 0xdd, 0x84, 0x48, 0xeb, 0x21, 0x1c, 0x80, 0x31, 0x9c},
+	Span:    atatus.SpanID{0xb7, 0xad, 0x6b, 0x71, 0x69, 0x20, 0x33, 0x31},
+	Options: atatus.TraceOptions(0).WithRecorded(true),
+}
+
+func TestPropagatorsInject(t *testing.T) {
+	h := make(http.Header)
+	athttp.NewPropagator([]string{"tracecontext", "b3", "b3multi", "jaeger"}, false).Inject(
+		testTraceContext, athttp.HeaderCarrier(h),
+	)
+	assert.Equal(t, http.Header{
+		"Traceparent":   {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		"B3":            {"0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1"},
+		"X-B3-Traceid":  {"0af7651916cd43dd8448eb211c80319c"},
+		"X-B3-Spanid":   {"b7ad6b7169203331"},
+		"X-B3-Sampled":  {"1"},
+		"Uber-Trace-Id": {"0af7651916cd43dd8448eb211c80319c:b7ad6b7169203331:0:1"},
+	}, h)
+}
+
+func TestPropagatorsExtract(t *testing.T) {
+	extract := func(p athttp.Propagator, h http.Header) (atatus.TraceContext, bool) {
+		return p.Extract(athttp.HeaderCarrier(h))
+	}
+	unsampled := testTraceContext
+	unsampled.Options = unsampled.Options.WithRecorded(false)
+
+	for name, test := range map[string]struct {
+		propagator athttp.Propagator
+		header     http.Header
+		expect     atatus.TraceContext
+	}{
+		"b3-single": {
+			propagator: athttp.B3Propagator{},
+			header:     http.Header{"B3": {"0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-d-00f067aa0ba902b7"}},
+			expect:     testTraceContext,
+		},
+		"b3-single-deferred": {
+			propagator: athttp.B3Propagator{},
+			header:     http.Header{"B3": {"0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331"}},
+			expect:     unsampled,
+		},
+		"b3-multi": {
+			propagator: athttp.B3Propagator{},
+			header: http.Header{
+				"X-B3-Traceid": {"0af7651916cd43dd8448eb211c80319c"},
+				"X-B3-Spanid":  {"b7ad6b7169203331"},
+				"X-B3-Flags":   {"1"},
+			},
+			expect: testTraceContext,
+		},
+		"jaeger": {
+			propagator: athttp.JaegerPropagator{},
+			header:     http.Header{"Uber-Trace-Id": {"af7651916cd43dd8448eb211c80319c%3Ab7ad6b7169203331%3A0%3A3"}},
+			expect:     testTraceContext,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			traceContext, ok := extract(test.propagator, test.header)
+			require.True(t, ok)
+			assert.Equal(t, test.expect, traceContext)
+		})
+	}
+
+	// 64-bit B3 trace IDs are left-padded with zeroes.
+	traceContext, ok := extract(athttp.B3Propagator{}, http.Header{"B3": {"8448eb211c80319c-b7ad6b7169203331-0"}})
+	require.True(t, ok)
+	assert.Equal(t, atatus.TraceID{8: 0x84, 9: 0x48, 10: 0xeb, 11: 0x21, 12: 0x1c, 13: 0x80, 14: 0x31, 15: 0x9c}, traceContext.Trace)
+
+	for _, h := range []http.Header{
+		{"B3": {"1"}},
+		{"B3": {"zz-b7ad6b7169203331-1"}},
+		{"X-B3-Traceid": {"0af7651916cd43dd8448eb211c80319c"}},
+		{"Uber-Trace-Id": {"0af7651916cd43dd8448eb211c80319c:b7ad6b7169203331:0"}},
+		{"Uber-Trace-Id": {"0:b7ad6b7169203331:0:1"}},
+	} {
+		_, ok := extract(athttp.NewPropagator([]string{"b3", "jaeger"}, false), h)
+		assert.False(t, ok, "%v", h)
+	}
+
+	// Trace context is extracted by the first propagator to find it.
+	traceContext, ok = extract(athttp.NewPropagator([]string{"jaeger", "tracecontext"}, false), http.Header{
+		"Traceparent":   {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		"Uber-Trace-Id": {"0af7651916cd43dd8448eb211c80319c:b7ad6b7169203331:0:0"},
+	})
+	require.True(t, ok)
+	assert.Equal(t, unsampled, traceContext)
+}
+
+func TestHandlerClientPropagators(t *testing.T) {
+	tracer := apmtest.NewDiscardTracer()
+	defer tracer.Close()
+	require.NoError(t, tracer.SetPropagators("b3", "jaeger"))
+
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Empty(t, req.Header.Get("Traceparent"))
+		assert.NotEmpty(t, req.Header.Get("B3"))
+		w.Write([]byte(req.Header.Get("Uber-Trace-Id")))
+	}))
+	defer downstream.Close()
+
+	var traceContext atatus.TraceContext
+	client := athttp.WrapClient(http.DefaultClient)
+	h := athttp.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tx := atatus.TransactionFromContext(req.Context())
+		traceContext = tx.TraceContext()
+		outgoing, _ := http.NewRequest("GET", downstream.URL, nil)
+		resp, err := client.Do(outgoing.WithContext(req.Context()))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}), athttp.WithTracer(tracer))
+
+	req, _ := http.NewRequest("GET", "http://server.testing/foo", nil)
+	req.Header.Set("Uber-Trace-Id", "0af7651916cd43dd8448eb211c80319c:b7ad6b7169203331:0:1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, testTraceContext.Trace, traceContext.Trace)
+	assert.True(t, traceContext.Options.Recorded())
+	assert.Regexp(t, "^0af7651916cd43dd8448eb211c80319c:[0-9a-f]{16}:0:1$", w.Body.String())
+
+	// A client propagator option takes precedence over the tracer's propagators.
+	client = athttp.WrapClient(http.DefaultClient, athttp.WithClientPropagator(athttp.B3Propagator{}))
+	tx := tracer.StartTransaction("name", "type")
+	defer tx.End()
+	outgoing, _ := http.NewRequest("GET", downstream.URL, nil)
+	resp, err := client.Do(outgoing.WithContext(atatus.ContextWithTransaction(context.Background(), tx)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Empty(t, body)
+}
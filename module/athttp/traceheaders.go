@@ -47,6 +47,10 @@ const (
 	// TracestateHeader is the standard W3C Trace-Context HTTP header
 	// for vendor-specific trace propagation.
 	TracestateHeader = "Tracestate"
+
+	// BaggageHeader is the standard W3C Baggage HTTP header for
+	// propagating application-defined key/value pairs.
+	BaggageHeader = "Baggage"
 )
 
 // FormatTraceparentHeader formats the given trace context as a
@@ -166,3 +170,34 @@ func ParseTracestateHeader(h ...string) (atatus.TraceState, error) {
 	}
 	return atatus.NewTraceState(entries...), nil
 }
+
+// ParseBaggageHeader parses the given header, which is expected to be in the
+// W3C Baggage format according to W3C Working Draft 2022:
+//    https://www.w3.org/TR/baggage/#baggage-http-header-format
+//
+// Multiple header values may be presented, in which case they will be treated as
+// if they are concatenated together with commas.
+//
+// An error is returned if the header is malformed, or if the resulting baggage
+// is invalid; the W3C Baggage specification does not allow partial baggage to
+// be propagated.
+func ParseBaggageHeader(h ...string) (atatus.Baggage, error) {
+	var members []atatus.BaggageMember
+	for _, h := range h {
+		for _, s := range strings.Split(h, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			m, err := atatus.ParseBaggageMember(s)
+			if err != nil {
+				return atatus.Baggage{}, err
+			}
+			members = append(members, m)
+		}
+	}
+	baggage := atatus.NewBaggage(members...)
+	if err := baggage.Validate(); err != nil {
+		return atatus.Baggage{}, err
+	}
+	return baggage, nil
+}
@@ -89,3 +89,32 @@ func TestParseTracestateHeader(t *testing.T) {
 	tracestate, _ = assertParse("vendorname1=opaqueValue1", "vendorname2=opaqueValue2")
 	assert.Equal(t, "vendorname1=opaqueValue1,vendorname2=opaqueValue2", tracestate.String())
 }
+
+func TestParseBaggageHeader(t *testing.T) {
+	assertParseError := func(h, expect string) {
+		_, err := athttp.ParseBaggageHeader(h)
+		if assert.Error(t, err) {
+			assert.Regexp(t, expect, err.Error())
+		}
+	}
+	assertParseError("a", `missing '=' in baggage member`)
+	assertParseError("a=b, c ", `missing '=' in baggage member`)
+	assertParseError("a=b c", `invalid value for key "a": value contains invalid character ' '`)
+	assertParseError("a b=c", `invalid baggage member at position 0: invalid key "a b"`)
+	assertParseError("a=%zz", `invalid value for key "a": invalid URL escape "%zz"`)
+
+	assertParse := func(h ...string) (atatus.Baggage, bool) {
+		out, err := athttp.ParseBaggageHeader(h...)
+		return out, assert.NoError(t, err)
+	}
+
+	baggage, _ := assertParse("tenant_id=acme, user = bob%20smith ;ttl=60")
+	assert.Equal(t, 2, baggage.Len())
+	assert.Equal(t, "acme", baggage.Get("tenant_id"))
+	member, _ := baggage.Member("user")
+	assert.Equal(t, atatus.BaggageMember{Key: "user", Value: "bob smith", Properties: "ttl=60"}, member)
+	assert.Equal(t, "tenant_id=acme,user=bob%20smith;ttl=60", baggage.String())
+
+	baggage, _ = assertParse("a=1", "b=2,a=3")
+	assert.Equal(t, "b=2,a=3", baggage.String())
+}
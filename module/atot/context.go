@@ -18,6 +18,7 @@
 package atot // import "go.atatus.com/agent/module/atot"
 
 import (
+	"sync"
 	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
@@ -31,6 +32,9 @@ type spanContext struct {
 	tx           *atatus.Transaction
 	traceContext atatus.TraceContext
 	startTime    time.Time
+
+	mu      sync.RWMutex
+	baggage atatus.Baggage
 }
 
 // TraceContext returns the trace context for the transaction or span
@@ -44,8 +48,31 @@ func (s *spanContext) Transaction() *atatus.Transaction {
 	return s.tx
 }
 
-// ForeachBaggageItem is a no-op; we do not support baggage propagation.
-func (*spanContext) ForeachBaggageItem(handler func(k, v string) bool) {}
+// ForeachBaggageItem calls handler for each baggage item in the
+// span context, stopping if handler returns false.
+func (s *spanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for _, m := range s.getBaggage().Members() {
+		if !handler(m.Key, m.Value) {
+			return
+		}
+	}
+}
+
+func (s *spanContext) getBaggage() atatus.Baggage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.baggage
+}
+
+// setBaggageItem sets a baggage item in the span context. Invalid
+// items are discarded, as the OpenTracing API cannot report errors.
+func (s *spanContext) setBaggageItem(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if baggage, err := s.baggage.Set(key, value); err == nil {
+		s.baggage = baggage
+	}
+}
 
 func (t *otTracer) parentSpanContext(refs []opentracing.SpanReference) (*spanContext, bool) {
 	for _, ref := range refs {
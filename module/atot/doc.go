@@ -19,6 +19,5 @@
 //
 // Things not implemented by this tracer:
 //  - binary propagation format
-//  - baggage
 //  - logging (generally; errors are reported)
 package atot // import "go.atatus.com/agent/module/atot"
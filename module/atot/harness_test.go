@@ -66,6 +66,7 @@ func TestHarness(t *testing.T) {
 	harness.RunAPIChecks(t, newTracer,
 		harness.CheckExtract(true),
 		harness.CheckInject(true),
+		harness.CheckBaggageValues(true),
 		harness.UseProbe(harnessAPIProbe{}),
 		func(s *harness.APICheckSuite) {
 			suite.Run(t, &harnessSuiteWrapper{s})
@@ -124,14 +124,18 @@ func (s *otSpan) Context() opentracing.SpanContext {
 	return &s.ctx
 }
 
-// BaggageItem returns the empty string; we do not support baggage.
-func (*otSpan) BaggageItem(key string) string {
-	return ""
+// BaggageItem returns the value of the baggage item with the given key,
+// or the empty string if there is no such item.
+func (s *otSpan) BaggageItem(key string) string {
+	return s.ctx.getBaggage().Get(key)
 }
 
-// SetBaggageItem is a no-op; we do not support baggage.
+// SetBaggageItem sets a baggage item, which will be propagated to this
+// span's descendants, including those in other services. Baggage items
+// are propagated using the W3C Baggage format; items with keys that are
+// not valid in that format are discarded.
 func (s *otSpan) SetBaggageItem(key, val string) opentracing.Span {
-	// We do not support baggage.
+	s.ctx.setBaggageItem(key, val)
 	return s
 }
 
@@ -81,6 +81,7 @@ func (t *otTracer) StartSpanWithOptions(name string, opts opentracing.StartSpanO
 
 	var parentTraceContext atatus.TraceContext
 	if parentCtx, ok := t.parentSpanContext(opts.References); ok {
+		otSpan.ctx.baggage = parentCtx.getBaggage()
 		if parentCtx.tx != nil && (parentCtx.tracer == t || parentCtx.tracer == nil) {
 			opts := atatus.SpanOptions{
 				Parent: parentCtx.traceContext, // parent span
@@ -98,6 +99,7 @@ func (t *otTracer) StartSpanWithOptions(name string, opts opentracing.StartSpanO
 	otSpan.ctx.tx = t.tracer.StartTransactionOptions(name, "", atatus.TransactionOptions{
 		TraceContext: parentTraceContext,
 		Start:        otSpan.ctx.startTime,
+		Baggage:      otSpan.ctx.baggage,
 	})
 	otSpan.ctx.traceContext = otSpan.ctx.tx.TraceContext()
 	return otSpan
@@ -122,6 +124,9 @@ func (t *otTracer) Inject(sc opentracing.SpanContext, format interface{}, carrie
 		if tracestate := spanContext.traceContext.State.String(); tracestate != "" {
 			writer.Set(athttp.TracestateHeader, tracestate)
 		}
+		if baggage := spanContext.getBaggage(); baggage.Len() != 0 {
+			writer.Set(athttp.BaggageHeader, baggage.String())
+		}
 		return nil
 	case opentracing.Binary:
 		writer, ok := carrier.(io.Writer)
@@ -139,6 +144,7 @@ func (t *otTracer) Extract(format interface{}, carrier interface{}) (opentracing
 	case opentracing.TextMap, opentracing.HTTPHeaders:
 		var traceparentHeaderValue string
 		var tracestateHeaderValues []string
+		var baggageHeaderValues []string
 		switch carrier := carrier.(type) {
 		case opentracing.HTTPHeadersCarrier:
 			traceparentHeaderValue = http.Header(carrier).Get(athttp.W3CTraceparentHeader)
@@ -146,6 +152,7 @@ func (t *otTracer) Extract(format interface{}, carrier interface{}) (opentracing
 				traceparentHeaderValue = http.Header(carrier).Get(athttp.AtatusTraceparentHeader)
 			}
 			tracestateHeaderValues = http.Header(carrier)[athttp.TracestateHeader]
+			baggageHeaderValues = http.Header(carrier)[athttp.BaggageHeader]
 		case opentracing.TextMapReader:
 			carrier.ForeachKey(func(key, val string) error {
 				switch textproto.CanonicalMIMEHeaderKey(key) {
@@ -159,6 +166,8 @@ func (t *otTracer) Extract(format interface{}, carrier interface{}) (opentracing
 					}
 				case athttp.TracestateHeader:
 					tracestateHeaderValues = append(tracestateHeaderValues, val)
+				case athttp.BaggageHeader:
+					baggageHeaderValues = append(baggageHeaderValues, val)
 				}
 				return nil
 			})
@@ -173,7 +182,8 @@ func (t *otTracer) Extract(format interface{}, carrier interface{}) (opentracing
 			return nil, err
 		}
 		traceContext.State, _ = athttp.ParseTracestateHeader(tracestateHeaderValues...)
-		return &spanContext{tracer: t, traceContext: traceContext}, nil
+		baggage, _ := athttp.ParseBaggageHeader(baggageHeaderValues...)
+		return &spanContext{tracer: t, traceContext: traceContext, baggage: baggage}, nil
 	case opentracing.Binary:
 		reader, ok := carrier.(io.Reader)
 		if !ok {
@@ -0,0 +1,30 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package atotel provides an Atatus implementation of the OpenTelemetry
+// tracing API, enabling libraries instrumented with OpenTelemetry to
+// report transactions and spans through an atatus.Tracer.
+//
+// OpenTelemetry spans without a local parent are mapped to transactions,
+// and spans with a local parent are mapped to spans. Spans started by
+// the native Atatus API and stored in the context with
+// atatus.ContextWithTransaction or atatus.ContextWithSpan are treated
+// as local parents, and vice versa.
+//
+// Things not implemented by this tracer:
+//   - span links
+//   - span events, other than errors recorded with RecordError
+package atotel // import "go.atatus.com/agent/module/atotel"
@@ -0,0 +1,349 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atotel // import "go.atatus.com/agent/module/atotel"
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	atatus "go.atatus.com/agent"
+	"go.atatus.com/agent/module/athttp"
+)
+
+// otelSpan is a trace.Span recorded as an Atatus span if started with a
+// local parent, or otherwise as an Atatus transaction; tx holds the
+// transaction in both cases.
+type otelSpan struct {
+	provider    *tracerProvider
+	kind        trace.SpanKind
+	startTime   time.Time
+	spanContext trace.SpanContext
+
+	mu         sync.Mutex
+	ended      bool
+	tx         *atatus.Transaction
+	span       *atatus.Span
+	attributes []attribute.KeyValue
+	status     codes.Code
+}
+
+// End completes the span. Attributes set on the span are recorded as
+// span context and labels, and the underlying transaction or span ended.
+func (s *otelSpan) End(options ...trace.SpanEndOption) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+
+	cfg := trace.NewSpanEndConfig(options...)
+	if s.span != nil {
+		if ts := cfg.Timestamp(); !ts.IsZero() {
+			s.span.Duration = ts.Sub(s.startTime)
+		}
+		s.setSpanContext()
+		s.span.End()
+	} else {
+		if ts := cfg.Timestamp(); !ts.IsZero() {
+			s.tx.Duration = ts.Sub(s.startTime)
+		}
+		s.setTransactionContext()
+		s.tx.End()
+	}
+}
+
+// AddEvent is a no-op; span events are not supported.
+func (s *otelSpan) AddEvent(name string, options ...trace.EventOption) {}
+
+// IsRecording reports whether the span is sampled and has not ended.
+func (s *otelSpan) IsRecording() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.ended && s.spanContext.IsSampled()
+}
+
+// RecordError reports err to Atatus as an error belonging to the span.
+func (s *otelSpan) RecordError(err error, options ...trace.EventOption) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	cfg := trace.NewEventConfig(options...)
+	e := s.provider.tracer.NewError(err)
+	e.Handled = true
+	if ts := cfg.Timestamp(); !ts.IsZero() {
+		e.Timestamp = ts
+	}
+	if s.span != nil {
+		e.SetSpan(s.span)
+	} else {
+		e.SetTransaction(s.tx)
+	}
+	e.Send()
+}
+
+// SpanContext returns the span's trace context.
+//
+// It is valid to call SpanContext after calling End.
+func (s *otelSpan) SpanContext() trace.SpanContext {
+	return s.spanContext
+}
+
+// SetStatus sets the status of the span, which is used to
+// set the outcome of the underlying transaction or span.
+func (s *otelSpan) SetStatus(code codes.Code, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// An Ok status is final, and an Unset status is ignored.
+	if code == codes.Unset || s.status == codes.Ok {
+		return
+	}
+	s.status = code
+}
+
+// SetName sets or changes the span name.
+func (s *otelSpan) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	if s.span != nil {
+		s.span.Name = name
+	} else {
+		s.tx.Name = name
+	}
+}
+
+// SetAttributes adds or changes attributes. Attributes are recorded
+// when the span ends.
+func (s *otelSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.attributes = append(s.attributes, kv...)
+}
+
+// TracerProvider returns the TracerProvider that created this span.
+func (s *otelSpan) TracerProvider() trace.TracerProvider {
+	return s.provider
+}
+
+// outcome returns the outcome corresponding to the span status,
+// or the empty string if the status is unset.
+func (s *otelSpan) outcome() string {
+	switch s.status {
+	case codes.Ok:
+		return "success"
+	case codes.Error:
+		return "failure"
+	}
+	return ""
+}
+
+func (s *otelSpan) setSpanContext() {
+	var (
+		dbContext       atatus.DatabaseSpanContext
+		dbSystem        string
+		messagingSystem string
+		rpcSystem       string
+		httpAttrs       httpAttributes
+		haveDBContext   bool
+	)
+	for _, kv := range s.attributes {
+		switch kv.Key {
+		case semconv.DBSystemKey:
+			dbSystem = kv.Value.Emit()
+			haveDBContext = true
+		case semconv.DBNameKey:
+			dbContext.Instance = kv.Value.Emit()
+			haveDBContext = true
+		case semconv.DBStatementKey:
+			dbContext.Statement = kv.Value.Emit()
+			haveDBContext = true
+		case semconv.DBUserKey:
+			dbContext.User = kv.Value.Emit()
+			haveDBContext = true
+		case semconv.MessagingSystemKey:
+			messagingSystem = kv.Value.Emit()
+		case semconv.RPCSystemKey:
+			rpcSystem = kv.Value.Emit()
+		default:
+			if !httpAttrs.set(kv) {
+				s.span.Context.SetLabel(string(kv.Key), labelValue(kv.Value))
+			}
+		}
+	}
+	switch {
+	case haveDBContext:
+		dbContext.Type = dbSystem
+		s.span.Type = "db"
+		s.span.Subtype = dbSystem
+		s.span.Context.SetDatabase(dbContext)
+	case messagingSystem != "":
+		s.span.Type = "messaging"
+		s.span.Subtype = messagingSystem
+	case httpAttrs.present():
+		s.span.Type = "external"
+		s.span.Subtype = "http"
+		if req := httpAttrs.request(); req != nil {
+			s.span.Context.SetHTTPRequest(req)
+		}
+		if httpAttrs.statusCode > 0 {
+			s.span.Context.SetHTTPStatusCode(httpAttrs.statusCode)
+		}
+	case rpcSystem != "":
+		s.span.Type = "external"
+		s.span.Subtype = rpcSystem
+	default:
+		switch s.kind {
+		case trace.SpanKindClient:
+			s.span.Type = "external"
+		case trace.SpanKindProducer:
+			s.span.Type = "messaging"
+		default:
+			s.span.Type = "custom"
+		}
+	}
+	if outcome := s.outcome(); outcome != "" {
+		s.span.Outcome = outcome
+	}
+}
+
+func (s *otelSpan) setTransactionContext() {
+	var httpAttrs httpAttributes
+	for _, kv := range s.attributes {
+		if !httpAttrs.set(kv) {
+			s.tx.Context.SetLabel(string(kv.Key), labelValue(kv.Value))
+		}
+	}
+	switch {
+	case s.kind == trace.SpanKindServer || httpAttrs.present():
+		s.tx.Type = "request"
+	case s.kind == trace.SpanKindConsumer:
+		s.tx.Type = "messaging"
+	default:
+		s.tx.Type = "custom"
+	}
+	if req := httpAttrs.request(); req != nil {
+		s.tx.Context.SetHTTPRequest(req)
+	}
+	if httpAttrs.statusCode > 0 {
+		s.tx.Result = athttp.StatusCodeResult(httpAttrs.statusCode)
+		s.tx.Context.SetHTTPStatusCode(httpAttrs.statusCode)
+	} else if s.status == codes.Error {
+		s.tx.Result = "error"
+	}
+	if outcome := s.outcome(); outcome != "" {
+		s.tx.Outcome = outcome
+	}
+}
+
+// httpAttributes holds the HTTP semantic convention attributes
+// recorded as HTTP context for transactions and spans.
+type httpAttributes struct {
+	method     string
+	url        string
+	scheme     string
+	host       string
+	target     string
+	statusCode int
+}
+
+// set records kv if it is an HTTP semantic convention attribute,
+// reporting whether or not it was recorded.
+func (a *httpAttributes) set(kv attribute.KeyValue) bool {
+	switch kv.Key {
+	case semconv.HTTPMethodKey:
+		a.method = kv.Value.Emit()
+	case semconv.HTTPURLKey:
+		a.url = kv.Value.Emit()
+	case semconv.HTTPSchemeKey:
+		a.scheme = kv.Value.Emit()
+	case semconv.HTTPHostKey:
+		a.host = kv.Value.Emit()
+	case semconv.HTTPTargetKey:
+		a.target = kv.Value.Emit()
+	case semconv.HTTPStatusCodeKey:
+		a.statusCode = int(kv.Value.AsInt64())
+	default:
+		return false
+	}
+	return true
+}
+
+// present reports whether any HTTP request attributes were recorded.
+func (a *httpAttributes) present() bool {
+	return a.method != "" || a.url != "" || a.target != ""
+}
+
+// request returns an *http.Request describing the recorded HTTP request
+// attributes, or nil if there is insufficient information to build one.
+func (a *httpAttributes) request() *http.Request {
+	rawURL := a.url
+	if rawURL == "" {
+		if a.target == "" {
+			return nil
+		}
+		scheme := a.scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		rawURL = scheme + "://" + a.host + a.target
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	if u.Host == "" {
+		u.Host = a.host
+	}
+	return &http.Request{
+		ProtoMajor: 1, // Assume HTTP/1.1
+		ProtoMinor: 1,
+		Method:     a.method,
+		URL:        u,
+		Host:       u.Host,
+	}
+}
+
+// labelValue returns v in a form suitable for passing to SetLabel.
+func labelValue(v attribute.Value) interface{} {
+	switch v.Type() {
+	case attribute.BOOL:
+		return v.AsBool()
+	case attribute.INT64:
+		return v.AsInt64()
+	case attribute.FLOAT64:
+		return v.AsFloat64()
+	}
+	return v.Emit()
+}
@@ -0,0 +1,175 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atotel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	atatus "go.atatus.com/agent"
+	"go.atatus.com/agent/apmtest"
+)
+
+func TestSpanType(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	otelTracer := NewTracerProvider(WithTracer(tracer.Tracer)).Tracer("test")
+	ctx, tx := otelTracer.Start(context.Background(), "tx")
+	defer tx.End()
+
+	type test struct {
+		kind    trace.SpanKind
+		attrs   []attribute.KeyValue
+		typ     string
+		subtype string
+	}
+	tests := []test{
+		{kind: trace.SpanKindInternal, typ: "custom"},
+		{kind: trace.SpanKindClient, typ: "external"},
+		{kind: trace.SpanKindProducer, typ: "messaging"},
+		{
+			kind:    trace.SpanKindClient,
+			attrs:   []attribute.KeyValue{semconv.DBSystemPostgreSQL},
+			typ:     "db",
+			subtype: "postgresql",
+		},
+		{
+			kind:    trace.SpanKindClient,
+			attrs:   []attribute.KeyValue{semconv.HTTPMethodKey.String("GET")},
+			typ:     "external",
+			subtype: "http",
+		},
+		{
+			kind:    trace.SpanKindProducer,
+			attrs:   []attribute.KeyValue{semconv.MessagingSystemKey.String("kafka")},
+			typ:     "messaging",
+			subtype: "kafka",
+		},
+		{
+			kind:    trace.SpanKindClient,
+			attrs:   []attribute.KeyValue{semconv.RPCSystemGRPC},
+			typ:     "external",
+			subtype: "grpc",
+		},
+	}
+	for _, test := range tests {
+		_, span := otelTracer.Start(ctx, "name", trace.WithSpanKind(test.kind), trace.WithAttributes(test.attrs...))
+		s := span.(*otelSpan)
+		s.setSpanContext()
+		assert.Equal(t, test.typ, s.span.Type)
+		assert.Equal(t, test.subtype, s.span.Subtype)
+		span.End()
+	}
+}
+
+func TestSpanContext(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	otelTracer := NewTracerProvider(WithTracer(tracer.Tracer)).Tracer("test")
+	ctx, tx := otelTracer.Start(context.Background(), "tx")
+	defer tx.End()
+
+	_, span := otelTracer.Start(ctx, "SELECT", trace.WithAttributes(
+		semconv.DBSystemMySQL,
+		semconv.DBNameKey.String("test"),
+		semconv.DBStatementKey.String("SELECT 1"),
+		semconv.DBUserKey.String("root"),
+	))
+	span.SetAttributes(attribute.Int("rows", 1))
+	span.SetStatus(codes.Error, "")
+	span.SetStatus(codes.Unset, "") // ignored
+	s := span.(*otelSpan)
+	s.setSpanContext()
+	assert.Equal(t, "failure", s.span.Outcome)
+	span.End()
+
+	_, span = otelTracer.Start(ctx, "GET", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.HTTPMethodKey.String("GET"),
+		semconv.HTTPURLKey.String("http://testing.invalid/foo?bar"),
+		semconv.HTTPStatusCodeKey.Int(404),
+	))
+	span.SetStatus(codes.Ok, "")
+	span.SetStatus(codes.Error, "") // Ok is final
+	s = span.(*otelSpan)
+	s.setSpanContext()
+	assert.Equal(t, "success", s.span.Outcome)
+	span.End()
+}
+
+func TestTransactionContext(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	otelTracer := NewTracerProvider(WithTracer(tracer.Tracer)).Tracer("test")
+
+	type test struct {
+		kind   trace.SpanKind
+		attrs  []attribute.KeyValue
+		status codes.Code
+		typ    string
+		result string
+	}
+	tests := []test{
+		{kind: trace.SpanKindInternal, typ: "custom"},
+		{kind: trace.SpanKindConsumer, typ: "messaging"},
+		{kind: trace.SpanKindInternal, status: codes.Error, typ: "custom", result: "error"},
+		{
+			kind: trace.SpanKindServer,
+			attrs: []attribute.KeyValue{
+				semconv.HTTPMethodKey.String("POST"),
+				semconv.HTTPTargetKey.String("/foo"),
+				semconv.HTTPStatusCodeKey.Int(503),
+			},
+			typ:    "request",
+			result: "HTTP 5xx",
+		},
+	}
+	for _, test := range tests {
+		ctx, span := otelTracer.Start(context.Background(), "name", trace.WithSpanKind(test.kind), trace.WithAttributes(test.attrs...))
+		span.SetStatus(test.status, "")
+		tx := atatus.TransactionFromContext(ctx)
+		require.NotNil(t, tx)
+		span.(*otelSpan).setTransactionContext()
+		assert.Equal(t, test.typ, tx.Type)
+		assert.Equal(t, test.result, tx.Result)
+		span.End()
+	}
+}
+
+func TestHTTPAttributesRequest(t *testing.T) {
+	var attrs httpAttributes
+	assert.False(t, attrs.present())
+	assert.Nil(t, attrs.request())
+
+	attrs.set(semconv.HTTPMethodKey.String("GET"))
+	attrs.set(semconv.HTTPHostKey.String("testing.invalid:8080"))
+	attrs.set(semconv.HTTPTargetKey.String("/foo?bar=baz"))
+	assert.True(t, attrs.present())
+	req := attrs.request()
+	require.NotNil(t, req)
+	assert.Equal(t, "GET", req.Method)
+	assert.Equal(t, "http://testing.invalid:8080/foo?bar=baz", req.URL.String())
+
+	attrs.set(semconv.HTTPURLKey.String("https://other.invalid/"))
+	assert.Equal(t, "https://other.invalid/", attrs.request().URL.String())
+}
@@ -0,0 +1,151 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atotel // import "go.atatus.com/agent/module/atotel"
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	atatus "go.atatus.com/agent"
+	"go.atatus.com/agent/module/athttp"
+)
+
+// NewTracerProvider returns a new trace.TracerProvider backed by the
+// supplied Atatus tracer.
+//
+// By default, the returned provider will use atatus.DefaultTracer.
+// This can be overridden by using a WithTracer option.
+func NewTracerProvider(opts ...Option) trace.TracerProvider {
+	p := &tracerProvider{tracer: atatus.DefaultTracer}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// tracerProvider is a trace.TracerProvider backed by an atatus.Tracer.
+type tracerProvider struct {
+	tracer *atatus.Tracer
+}
+
+// Tracer returns a trace.Tracer for the named instrumentation library.
+// All tracers returned by the provider share its atatus.Tracer.
+func (p *tracerProvider) Tracer(name string, opts ...trace.TracerOption) trace.Tracer {
+	return &otelTracer{provider: p}
+}
+
+// otelTracer is a trace.Tracer backed by an atatus.Tracer.
+type otelTracer struct {
+	provider *tracerProvider
+}
+
+// Start starts a new OpenTelemetry span with the given name and options,
+// returning the span and a context containing it.
+//
+// If ctx contains a local parent, created either by this package or by
+// the native Atatus API, the span is recorded as an Atatus span;
+// otherwise the span is recorded as a transaction, continuing the
+// remote trace in ctx if any.
+func (t *otelTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	s := &otelSpan{
+		provider:  t.provider,
+		kind:      cfg.SpanKind(),
+		startTime: cfg.Timestamp(),
+	}
+	if s.startTime.IsZero() {
+		s.startTime = time.Now()
+	}
+	s.attributes = append(s.attributes, cfg.Attributes()...)
+
+	var parent trace.SpanContext
+	if !cfg.NewRoot() {
+		parent = trace.SpanContextFromContext(ctx)
+		if tx := atatus.TransactionFromContext(ctx); tx != nil && !parent.IsRemote() {
+			s.tx = tx
+			s.span, ctx = atatus.StartSpanOptions(ctx, name, "", atatus.SpanOptions{
+				Start: s.startTime,
+			})
+			s.spanContext = spanContextFromTraceContext(s.span.TraceContext())
+			return trace.ContextWithSpan(ctx, s), s
+		}
+	}
+
+	// There's no local parent, so start a transaction.
+	txOpts := atatus.TransactionOptions{
+		Start:   s.startTime,
+		Baggage: atatus.BaggageFromContext(ctx),
+	}
+	if parent.IsValid() {
+		txOpts.TraceContext = traceContextFromSpanContext(parent)
+	}
+	s.tx = t.provider.tracer.StartTransactionOptions(name, "", txOpts)
+	s.spanContext = spanContextFromTraceContext(s.tx.TraceContext())
+	ctx = atatus.ContextWithTransaction(ctx, s.tx)
+	if atatus.SpanFromContext(ctx) != nil {
+		// Spans started with ctx must not be parented by
+		// a span belonging to some other transaction.
+		ctx = atatus.ContextWithSpan(ctx, nil)
+	}
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+// spanContextFromTraceContext returns a trace.SpanContext
+// equivalent to the given atatus.TraceContext.
+func spanContextFromTraceContext(tc atatus.TraceContext) trace.SpanContext {
+	var flags trace.TraceFlags
+	if tc.Options.Recorded() {
+		flags = flags.WithSampled(true)
+	}
+	state, _ := trace.ParseTraceState(tc.State.String())
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID(tc.Trace),
+		SpanID:     trace.SpanID(tc.Span),
+		TraceFlags: flags,
+		TraceState: state,
+	})
+}
+
+// traceContextFromSpanContext returns an atatus.TraceContext
+// equivalent to the given trace.SpanContext.
+func traceContextFromSpanContext(sc trace.SpanContext) atatus.TraceContext {
+	tc := atatus.TraceContext{
+		Trace:   atatus.TraceID(sc.TraceID()),
+		Span:    atatus.SpanID(sc.SpanID()),
+		Options: atatus.TraceOptions(0).WithRecorded(sc.IsSampled()),
+	}
+	if state := sc.TraceState().String(); state != "" {
+		tc.State, _ = athttp.ParseTracestateHeader(state)
+	}
+	return tc
+}
+
+// Option sets options for the OpenTelemetry TracerProvider implementation.
+type Option func(*tracerProvider)
+
+// WithTracer returns an Option which sets t as the underlying
+// atatus.Tracer for constructing an OpenTelemetry TracerProvider.
+func WithTracer(t *atatus.Tracer) Option {
+	if t == nil {
+		panic("t == nil")
+	}
+	return func(p *tracerProvider) {
+		p.tracer = t
+	}
+}
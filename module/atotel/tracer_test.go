@@ -0,0 +1,179 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atotel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	atatus "go.atatus.com/agent"
+	"go.atatus.com/agent/apmtest"
+	"go.atatus.com/agent/module/atotel"
+)
+
+func TestStartTransactionAndSpans(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	otelTracer := atotel.NewTracerProvider(atotel.WithTracer(tracer.Tracer)).Tracer("test")
+
+	ctx, root := otelTracer.Start(context.Background(), "root", trace.WithSpanKind(trace.SpanKindServer))
+	defer root.End()
+	tx := atatus.TransactionFromContext(ctx)
+	require.NotNil(t, tx)
+	assert.Equal(t, "root", tx.Name)
+	assert.Nil(t, atatus.SpanFromContext(ctx))
+	assert.True(t, root.IsRecording())
+	assertSpanContext(t, tx.TraceContext(), root.SpanContext())
+
+	childCtx, child := otelTracer.Start(ctx, "child")
+	span := atatus.SpanFromContext(childCtx)
+	require.NotNil(t, span)
+	assert.Equal(t, "child", span.Name)
+	assert.Equal(t, tx, atatus.TransactionFromContext(childCtx))
+	assert.Equal(t, tx.TraceContext().Span, span.ParentID())
+	assertSpanContext(t, span.TraceContext(), child.SpanContext())
+
+	grandchildCtx, grandchild := otelTracer.Start(childCtx, "grandchild")
+	assert.Equal(t, span.TraceContext().Span, atatus.SpanFromContext(grandchildCtx).ParentID())
+	grandchild.End()
+	child.End()
+	assert.False(t, child.IsRecording())
+
+	// Spans started with the native API are children of OpenTelemetry spans.
+	nativeSpan, _ := atatus.StartSpan(ctx, "native", "custom")
+	assert.Equal(t, tx.TraceContext().Span, nativeSpan.ParentID())
+	nativeSpan.End()
+}
+
+func TestStartSpanNativeParent(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	otelTracer := atotel.NewTracerProvider(atotel.WithTracer(tracer.Tracer)).Tracer("test")
+
+	tx := tracer.StartTransaction("native", "request")
+	defer tx.End()
+	nativeSpan, ctx := atatus.StartSpan(atatus.ContextWithTransaction(context.Background(), tx), "native", "custom")
+	defer nativeSpan.End()
+
+	ctx, span := otelTracer.Start(ctx, "otel")
+	defer span.End()
+	assert.Equal(t, tx, atatus.TransactionFromContext(ctx))
+	assert.Equal(t, nativeSpan.TraceContext().Span, atatus.SpanFromContext(ctx).ParentID())
+	assert.Equal(t, trace.TraceID(tx.TraceContext().Trace), span.SpanContext().TraceID())
+
+	// WithNewRoot starts a new transaction, which must
+	// not be confused with the native span in ctx.
+	rootCtx, root := otelTracer.Start(ctx, "root", trace.WithNewRoot())
+	defer root.End()
+	assert.NotEqual(t, tx, atatus.TransactionFromContext(rootCtx))
+	assert.Nil(t, atatus.SpanFromContext(rootCtx))
+	assert.NotEqual(t, span.SpanContext().TraceID(), root.SpanContext().TraceID())
+}
+
+func TestStartTransactionRemoteParent(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	otelTracer := atotel.NewTracerProvider(atotel.WithTracer(tracer.Tracer)).Tracer("test")
+
+	state, err := trace.ParseTraceState("vendor=value")
+	require.NoError(t, err)
+	remote := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0: 1, 15: 2},
+		SpanID:     trace.SpanID{0: 3, 7: 4},
+		TraceFlags: trace.FlagsSampled,
+		TraceState: state,
+		Remote:     true,
+	})
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), remote)
+
+	ctx, span := otelTracer.Start(ctx, "name")
+	defer span.End()
+	tx := atatus.TransactionFromContext(ctx)
+	require.NotNil(t, tx)
+	assert.Equal(t, atatus.TraceID(remote.TraceID()), tx.TraceContext().Trace)
+	assert.Equal(t, atatus.SpanID(remote.SpanID()), tx.ParentID())
+	assert.True(t, span.SpanContext().IsSampled())
+	assert.False(t, span.SpanContext().IsRemote())
+	assert.Equal(t, "value", span.SpanContext().TraceState().Get("vendor"))
+}
+
+func TestSpanEndTimestamp(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	otelTracer := atotel.NewTracerProvider(atotel.WithTracer(tracer.Tracer)).Tracer("test")
+
+	start := time.Now().Add(-time.Minute)
+	_, span := otelTracer.Start(context.Background(), "name", trace.WithTimestamp(start))
+	span.SetName("renamed")
+	span.End(trace.WithTimestamp(start.Add(time.Second)))
+	span.End() // no-op
+	span.SetName("ignored")
+
+	tracer.Flush(nil)
+	var txns []struct {
+		Transactions []struct {
+			Name string `json:"name"`
+		} `json:"transactions"`
+	}
+	require.NoError(t, tracer.AggregatedPayloads.DecodePayloads(atatus.PayloadTransaction, &txns))
+	require.Len(t, txns, 1)
+	require.Len(t, txns[0].Transactions, 1)
+	assert.Equal(t, "renamed", txns[0].Transactions[0].Name)
+}
+
+func TestSpanRecordError(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	otelTracer := atotel.NewTracerProvider(atotel.WithTracer(tracer.Tracer)).Tracer("test")
+
+	ctx, tx := otelTracer.Start(context.Background(), "GET /foo")
+	_, span := otelTracer.Start(ctx, "child")
+	span.RecordError(nil) // ignored
+	span.RecordError(errors.New("boom"))
+	span.SetStatus(codes.Error, "boom")
+	span.End()
+	tx.End()
+	tracer.Flush(nil)
+
+	var payloads []struct {
+		Errors []struct {
+			Transaction string `json:"transaction"`
+			Exceptions  []struct {
+				Message string `json:"message"`
+			} `json:"exceptions"`
+		} `json:"errors"`
+	}
+	require.NoError(t, tracer.AggregatedPayloads.DecodePayloads(atatus.PayloadError, &payloads))
+	require.Len(t, payloads, 1)
+	require.Len(t, payloads[0].Errors, 1)
+	assert.Equal(t, "GET /foo", payloads[0].Errors[0].Transaction)
+	require.Len(t, payloads[0].Errors[0].Exceptions, 1)
+	assert.Equal(t, "boom", payloads[0].Errors[0].Exceptions[0].Message)
+}
+
+func assertSpanContext(t *testing.T, tc atatus.TraceContext, sc trace.SpanContext) {
+	assert.Equal(t, trace.TraceID(tc.Trace), sc.TraceID())
+	assert.Equal(t, trace.SpanID(tc.Span), sc.SpanID())
+	assert.Equal(t, tc.Options.Recorded(), sc.IsSampled())
+}
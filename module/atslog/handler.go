@@ -0,0 +1,263 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atslog // import "go.atatus.com/agent/module/atslog"
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	atatus "go.atatus.com/agent"
+	"go.atatus.com/agent/stacktrace"
+)
+
+const (
+	// DefaultFatalFlushTimeout is the default value for WithFatalFlushTimeout.
+	DefaultFatalFlushTimeout = 5 * time.Second
+
+	// LevelFatal is the level of fatal log records. slog has no fatal
+	// level; records logged at or above LevelFatal are expected to be
+	// followed by the process exiting, so the tracer is flushed.
+	LevelFatal = slog.Level(12)
+
+	// FieldKeyTraceID is the attribute key for the trace ID.
+	FieldKeyTraceID = "trace.id"
+
+	// FieldKeyTransactionID is the attribute key for the transaction ID.
+	FieldKeyTransactionID = "transaction.id"
+
+	// FieldKeySpanID is the attribute key for the span ID.
+	FieldKeySpanID = "span.id"
+
+	// FieldKeyError is the key of the attribute holding the error
+	// reported as the cause of an error log record. Only top-level
+	// attributes are used; error attributes in groups are ignored.
+	FieldKeyError = "error"
+)
+
+func init() {
+	stacktrace.RegisterLibraryPackage("log/slog")
+}
+
+// Handler is an implementation of slog.Handler, wrapping another handler.
+// Log records are passed to the wrapped handler with the trace context of
+// the transaction or span in the record's context, if any, and records at
+// or above the report level are reported as errors to Atatus, associated
+// with the transaction or span.
+type Handler struct {
+	handler           slog.Handler
+	tracer            *atatus.Tracer
+	reportLevel       slog.Level
+	fatalFlushTimeout time.Duration
+
+	// err holds the error attribute added with WithAttrs, if any.
+	err error
+
+	// grouped records whether WithGroup has been called, after which
+	// attributes are no longer top-level.
+	grouped bool
+}
+
+// NewHandler returns a new Handler wrapping h.
+func NewHandler(h slog.Handler, o ...Option) *Handler {
+	handler := &Handler{
+		handler:           h,
+		reportLevel:       slog.LevelError,
+		fatalFlushTimeout: DefaultFatalFlushTimeout,
+	}
+	for _, o := range o {
+		o(handler)
+	}
+	return handler
+}
+
+func (h *Handler) getTracer() *atatus.Tracer {
+	if h.tracer == nil {
+		return atatus.DefaultTracer
+	}
+	return h.tracer
+}
+
+// Enabled reports whether either the wrapped handler handles records at
+// the given level, or records at the level are reported to Atatus.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level) || h.reportEnabled(level)
+}
+
+func (h *Handler) reportEnabled(level slog.Level) bool {
+	return level >= h.reportLevel && h.getTracer().Recording()
+}
+
+// Handle passes r to the wrapped handler with the trace context attributes
+// added, and reports r as an error if its level is at or above the report
+// level. Handle flushes the tracer after handling fatal records.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	tx := atatus.TransactionFromContext(ctx)
+	span := atatus.SpanFromContext(ctx)
+
+	var err error
+	if h.handler.Enabled(ctx, r.Level) {
+		out := r
+		if tx != nil {
+			out = r.Clone()
+			out.AddAttrs(TraceContext(ctx)...)
+		}
+		err = h.handler.Handle(ctx, out)
+	}
+	if !h.reportEnabled(r.Level) {
+		return err
+	}
+
+	tracer := h.getTracer()
+	errlog := tracer.NewErrorLog(atatus.ErrorLogRecord{
+		Message: r.Message,
+		Level:   levelString(r.Level),
+		Error:   h.recordError(r),
+	})
+	errlog.Handled = true
+	if !r.Time.IsZero() {
+		errlog.Timestamp = r.Time
+	}
+	errlog.SetStacktrace(1)
+	if span != nil {
+		errlog.SetSpan(span)
+	} else if tx != nil {
+		errlog.SetTransaction(tx)
+	}
+	errlog.Send()
+
+	if r.Level >= LevelFatal && h.fatalFlushTimeout >= 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), h.fatalFlushTimeout)
+		defer cancel()
+		tracer.Flush(ctx.Done())
+	}
+	return err
+}
+
+// recordError returns the error held in r's error attribute,
+// or in the error attribute added with WithAttrs.
+func (h *Handler) recordError(r slog.Record) error {
+	err := h.err
+	if h.grouped {
+		return err
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		if e, ok := attrError(attr); ok {
+			err = e
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// WithAttrs returns a new Handler wrapping the result of
+// calling WithAttrs on the wrapped handler.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.handler = h.handler.WithAttrs(attrs)
+	if h.grouped {
+		return &out
+	}
+	for _, attr := range attrs {
+		if err, ok := attrError(attr); ok {
+			out.err = err
+		}
+	}
+	return &out
+}
+
+// WithGroup returns a new Handler wrapping the result of
+// calling WithGroup on the wrapped handler.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	out := *h
+	out.handler = h.handler.WithGroup(name)
+	out.grouped = true
+	return &out
+}
+
+// TraceContext returns slog.Attrs containing the trace context
+// of the transaction and span contained in ctx, if any.
+func TraceContext(ctx context.Context) []slog.Attr {
+	tx := atatus.TransactionFromContext(ctx)
+	if tx == nil {
+		return nil
+	}
+	traceContext := tx.TraceContext()
+	attrs := []slog.Attr{
+		slog.String(FieldKeyTraceID, traceContext.Trace.String()),
+		slog.String(FieldKeyTransactionID, traceContext.Span.String()),
+	}
+	if span := atatus.SpanFromContext(ctx); span != nil {
+		attrs = append(attrs, slog.String(FieldKeySpanID, span.TraceContext().Span.String()))
+	}
+	return attrs
+}
+
+func attrError(attr slog.Attr) (error, bool) {
+	if attr.Key != FieldKeyError || attr.Value.Kind() != slog.KindAny {
+		return nil, false
+	}
+	err, ok := attr.Value.Any().(error)
+	return err, ok
+}
+
+func levelString(level slog.Level) string {
+	if level >= LevelFatal {
+		return "fatal"
+	}
+	return strings.ToLower(level.String())
+}
+
+// Option sets options for a Handler.
+type Option func(*Handler)
+
+// WithTracer returns an Option which sets t as the tracer
+// to use for reporting errors; by default, the handler will
+// use atatus.DefaultTracer.
+func WithTracer(t *atatus.Tracer) Option {
+	if t == nil {
+		panic("t == nil")
+	}
+	return func(h *Handler) {
+		h.tracer = t
+	}
+}
+
+// WithReportLevel returns an Option which sets the minimum level of
+// log records reported to Atatus as errors; by default, records at
+// slog.LevelError and above are reported.
+func WithReportLevel(level slog.Level) Option {
+	return func(h *Handler) {
+		h.reportLevel = level
+	}
+}
+
+// WithFatalFlushTimeout returns an Option which sets the amount of time
+// to wait while flushing the tracer after a record at LevelFatal or above
+// is reported, before the process is expected to exit. If the timeout is
+// negative, then no flushing will be performed. By default, the timeout
+// is DefaultFatalFlushTimeout.
+func WithFatalFlushTimeout(d time.Duration) Option {
+	return func(h *Handler) {
+		h.fatalFlushTimeout = d
+	}
+}
@@ -0,0 +1,162 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atslog_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	atatus "go.atatus.com/agent"
+	"go.atatus.com/agent/apmtest"
+	"go.atatus.com/agent/module/atslog"
+)
+
+type errorPayload struct {
+	Errors []struct {
+		Transaction string `json:"transaction"`
+		Exceptions  []struct {
+			Message string `json:"message"`
+		} `json:"exceptions"`
+	} `json:"errors"`
+}
+
+func TestHandlerTraceContext(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	logger := slog.New(atslog.NewHandler(slog.NewJSONHandler(&buf, nil), atslog.WithTracer(tracer.Tracer)))
+
+	tx := tracer.StartTransaction("name", "type")
+	ctx := atatus.ContextWithTransaction(context.Background(), tx)
+	span, ctx := atatus.StartSpan(ctx, "name", "type")
+	logger.InfoContext(ctx, "¡hola, mundo!")
+	span.End()
+	tx.End()
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, "¡hola, mundo!", record["msg"])
+	assert.Equal(t, tx.TraceContext().Trace.String(), record["trace.id"])
+	assert.Equal(t, tx.TraceContext().Span.String(), record["transaction.id"])
+	assert.Equal(t, span.TraceContext().Span.String(), record["span.id"])
+
+	buf.Reset()
+	logger.Info("no context")
+	record = nil
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.NotContains(t, record, "trace.id")
+
+	tracer.Flush(nil)
+	assert.Empty(t, tracer.AggregatedPayloads.Payloads(atatus.PayloadError))
+}
+
+func TestHandlerReportError(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	handler := atslog.NewHandler(slog.NewTextHandler(&buf, nil), atslog.WithTracer(tracer.Tracer))
+	logger := slog.New(handler)
+
+	tx := tracer.StartTransaction("GET /foo", "request")
+	ctx := atatus.ContextWithTransaction(context.Background(), tx)
+	logger.WarnContext(ctx, "not reported")
+	logger.With("error", errors.New("boom")).ErrorContext(ctx, "request failed")
+	tx.End()
+	tracer.Flush(nil)
+
+	assert.Contains(t, buf.String(), "not reported")
+	assert.Contains(t, buf.String(), "request failed")
+
+	var payloads []errorPayload
+	require.NoError(t, tracer.AggregatedPayloads.DecodePayloads(atatus.PayloadError, &payloads))
+	require.Len(t, payloads, 1)
+	require.Len(t, payloads[0].Errors, 1)
+	assert.Equal(t, "GET /foo", payloads[0].Errors[0].Transaction)
+	require.NotEmpty(t, payloads[0].Errors[0].Exceptions)
+	assert.Equal(t, "boom", payloads[0].Errors[0].Exceptions[0].Message)
+}
+
+func TestHandlerGroupedError(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	logger := slog.New(atslog.NewHandler(slog.NewTextHandler(&buf, nil), atslog.WithTracer(tracer.Tracer)))
+
+	// Only top-level error attributes are reported as the cause.
+	logger.With("error", errors.New("top")).WithGroup("request").Error("first", "error", errors.New("nested"))
+	logger.WithGroup("request").With("error", errors.New("nested")).Error("second")
+	tracer.Flush(nil)
+
+	var payloads []errorPayload
+	require.NoError(t, tracer.AggregatedPayloads.DecodePayloads(atatus.PayloadError, &payloads))
+	var messages []string
+	for _, p := range payloads {
+		for _, e := range p.Errors {
+			require.NotEmpty(t, e.Exceptions)
+			messages = append(messages, e.Exceptions[0].Message)
+		}
+	}
+	assert.Equal(t, []string{"top", ""}, messages) // the second record has no cause
+}
+
+func TestHandlerReportLevel(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	inner := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})
+	logger := slog.New(atslog.NewHandler(inner,
+		atslog.WithTracer(tracer.Tracer),
+		atslog.WithReportLevel(slog.LevelWarn),
+	))
+	assert.True(t, logger.Enabled(context.Background(), slog.LevelWarn))
+	assert.False(t, logger.Enabled(context.Background(), slog.LevelInfo))
+
+	logger.Warn("reported", "error", errors.New("warning"))
+	tracer.Flush(nil)
+
+	// The warning is reported, but not handled by the wrapped handler.
+	assert.Empty(t, buf.String())
+	var payloads []errorPayload
+	require.NoError(t, tracer.AggregatedPayloads.DecodePayloads(atatus.PayloadError, &payloads))
+	require.Len(t, payloads, 1)
+	require.Len(t, payloads[0].Errors, 1)
+	assert.Equal(t, "warning", payloads[0].Errors[0].Exceptions[0].Message)
+}
+
+func TestHandlerFatalFlush(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	logger := slog.New(atslog.NewHandler(slog.NewTextHandler(&buf, nil), atslog.WithTracer(tracer.Tracer)))
+	logger.Log(context.Background(), atslog.LevelFatal, "fatal", "error", errors.New("boom"))
+
+	// Fatal records are flushed before returning, as the process is
+	// expected to exit immediately afterwards.
+	assert.Len(t, tracer.AggregatedPayloads.Payloads(atatus.PayloadError), 1)
+}
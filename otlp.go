@@ -0,0 +1,604 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus // import "go.atatus.com/agent"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"go.atatus.com/agent/internal/apmlog"
+	"go.atatus.com/agent/internal/otlp"
+	"go.atatus.com/agent/model"
+)
+
+const (
+	// exportModeOTLP exports transactions, spans, errors and metrics
+	// to an OTLP/HTTP endpoint in place of Atatus.
+	exportModeOTLP = "otlp"
+
+	otlpProtocolProtobuf = "http/protobuf"
+	otlpProtocolJSON     = "http/json"
+
+	otlpTracesPath  = "/v1/traces"
+	otlpMetricsPath = "/v1/metrics"
+	otlpLogsPath    = "/v1/logs"
+
+	// otlpExportInterval is the interval at which queued telemetry
+	// is exported, in addition to exports on flush and close.
+	otlpExportInterval = 10 * time.Second
+	otlpTimeout        = 10 * time.Second
+
+	// otlpMaxQueueSize is the maximum number of spans, and of log
+	// records, queued between exports. Further events are dropped.
+	otlpMaxQueueSize = 2048
+
+	otlpScopeName = "go.atatus.com/agent"
+)
+
+// discardPayloadSink is a PayloadSink which discards all payloads. It is
+// used in the OTLP export mode, where telemetry is exported by otlpExporter
+// instead of being sent to Atatus.
+type discardPayloadSink struct{}
+
+func (discardPayloadSink) SendPayload(ctx context.Context, p Payload) (*PayloadResponse, error) {
+	return nil, nil
+}
+
+// otlpExporter converts transactions, spans, errors and metrics to OTLP,
+// and periodically POSTs them to an OTLP/HTTP endpoint. Transactions and
+// spans are exported as traces, and errors as logs.
+type otlpExporter struct {
+	endpoint string
+	protocol string
+	headers  http.Header
+	client   *http.Client
+	logger   WarningLogger
+
+	resourceOnce sync.Once
+	resource     otlp.Resource
+
+	mu    sync.Mutex
+	batch otlpBatch
+
+	flushC  chan chan<- struct{}
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// otlpBatch holds the telemetry queued between exports.
+type otlpBatch struct {
+	spans   []otlp.Span
+	logs    []otlp.LogRecord
+	metrics []otlp.Metric
+	dropped int
+
+	// metricIndex maps metric names to their index in metrics,
+	// so data points for the same metric are grouped together.
+	metricIndex map[string]int
+}
+
+// newOTLPExporter returns a new otlpExporter, exporting to the OTLP/HTTP
+// endpoint with the given base URL, using protocol to encode requests.
+// Requests are sent with the proxy and TLS configuration of the notify
+// HTTP client, as returned by newNotifyHTTPClient.
+func newOTLPExporter(endpoint, protocol string, headers http.Header, proxy string) (*otlpExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid OTLP endpoint %q", endpoint)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("invalid OTLP endpoint %q: expected http or https scheme", endpoint)
+	}
+	switch protocol {
+	case otlpProtocolProtobuf, otlpProtocolJSON:
+	default:
+		return nil, errors.Errorf("invalid OTLP protocol %q", protocol)
+	}
+	client, err := newNotifyHTTPClient(proxy)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = otlpTimeout
+	e := &otlpExporter{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		protocol: protocol,
+		headers:  headers,
+		client:   client,
+		flushC:   make(chan chan<- struct{}),
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	if apmlog.DefaultLogger != nil {
+		e.logger = apmlog.DefaultLogger
+	}
+	return e, nil
+}
+
+// run exports the queued telemetry periodically, and when requested by
+// requestFlush, until close is called. Exports are performed in separate
+// goroutines, so run remains responsive while requests are in flight.
+func (e *otlpExporter) run(service model.Service, system *model.System) {
+	defer close(e.closed)
+	ticker := time.NewTicker(otlpExportInterval)
+	defer ticker.Stop()
+
+	var exports sync.WaitGroup
+	export := func(flushed chan<- struct{}) {
+		b := e.takeBatch()
+		exports.Add(1)
+		go func() {
+			defer exports.Done()
+			e.export(&service, system, b)
+			if flushed != nil {
+				flushed <- struct{}{}
+			}
+		}()
+	}
+	for {
+		select {
+		case <-ticker.C:
+			export(nil)
+		case flushed := <-e.flushC:
+			export(flushed)
+		case <-e.closing:
+			export(nil)
+			exports.Wait()
+			return
+		}
+	}
+}
+
+// requestFlush requests that the queued telemetry be exported, signalling
+// flushed once the export requests have completed.
+func (e *otlpExporter) requestFlush(flushed chan<- struct{}) {
+	select {
+	case e.flushC <- flushed:
+	case <-e.closed:
+		flushed <- struct{}{}
+	}
+}
+
+// close exports the remaining telemetry, and waits for run to return.
+func (e *otlpExporter) close() {
+	close(e.closing)
+	<-e.closed
+}
+
+func (e *otlpExporter) takeBatch() otlpBatch {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b := e.batch
+	e.batch = otlpBatch{}
+	return b
+}
+
+// addTransaction queues tx, which must be sampled, as an OTLP span.
+func (e *otlpExporter) addTransaction(tx *model.Transaction, traceState string) {
+	span := otlp.Span{
+		TraceID:      otlp.TraceID(tx.TraceID),
+		SpanID:       otlp.SpanID(tx.ID),
+		TraceState:   traceState,
+		ParentSpanID: otlp.SpanID(tx.ParentID),
+		Name:         tx.Name,
+		Kind:         otlpTransactionKind(tx.Type),
+		Status:       otlpStatus(tx.Outcome),
+	}
+	span.StartTimeUnixNano, span.EndTimeUnixNano = otlpTimes(tx.Timestamp, tx.Duration)
+	span.Attributes = appendOTLPString(span.Attributes, "atatus.transaction.type", tx.Type)
+	span.Attributes = appendOTLPString(span.Attributes, "atatus.transaction.result", tx.Result)
+	if tx.Context != nil {
+		if req := tx.Context.Request; req != nil {
+			span.Attributes = appendOTLPString(span.Attributes, "http.method", req.Method)
+			span.Attributes = appendOTLPString(span.Attributes, "http.url", otlpRequestURL(&req.URL))
+		}
+		if resp := tx.Context.Response; resp != nil && resp.StatusCode != 0 {
+			span.Attributes = append(span.Attributes, otlp.Int("http.status_code", int64(resp.StatusCode)))
+		}
+		if user := tx.Context.User; user != nil {
+			span.Attributes = appendOTLPString(span.Attributes, "enduser.id", user.ID)
+		}
+		span.Attributes = appendOTLPLabels(span.Attributes, tx.Context.Tags)
+	}
+	e.addSpanRecord(span)
+}
+
+// addSpan queues s as an OTLP span.
+func (e *otlpExporter) addSpan(s *model.Span, traceState string) {
+	span := otlp.Span{
+		TraceID:      otlp.TraceID(s.TraceID),
+		SpanID:       otlp.SpanID(s.ID),
+		TraceState:   traceState,
+		ParentSpanID: otlp.SpanID(s.ParentID),
+		Name:         s.Name,
+		Kind:         otlpSpanKind(s),
+		Status:       otlpStatus(s.Outcome),
+	}
+	span.StartTimeUnixNano, span.EndTimeUnixNano = otlpTimes(s.Timestamp, s.Duration)
+	span.Attributes = appendOTLPString(span.Attributes, "atatus.span.type", s.Type)
+	span.Attributes = appendOTLPString(span.Attributes, "atatus.span.subtype", s.Subtype)
+	span.Attributes = appendOTLPString(span.Attributes, "atatus.span.action", s.Action)
+	if ctx := s.Context; ctx != nil {
+		if db := ctx.Database; db != nil {
+			system := s.Subtype
+			if system == "" {
+				system = db.Type
+			}
+			span.Attributes = appendOTLPString(span.Attributes, "db.system", system)
+			span.Attributes = appendOTLPString(span.Attributes, "db.name", db.Instance)
+			span.Attributes = appendOTLPString(span.Attributes, "db.statement", db.Statement)
+			span.Attributes = appendOTLPString(span.Attributes, "db.user", db.User)
+		}
+		if httpCtx := ctx.HTTP; httpCtx != nil {
+			if httpCtx.URL != nil {
+				span.Attributes = appendOTLPString(span.Attributes, "http.url", httpCtx.URL.String())
+			}
+			if httpCtx.StatusCode != 0 {
+				span.Attributes = append(span.Attributes, otlp.Int("http.status_code", int64(httpCtx.StatusCode)))
+			}
+		}
+		if msg := ctx.Message; msg != nil && msg.Queue != nil {
+			span.Attributes = appendOTLPString(span.Attributes, "messaging.destination", msg.Queue.Name)
+		}
+		if dest := ctx.Destination; dest != nil {
+			span.Attributes = appendOTLPString(span.Attributes, "net.peer.name", dest.Address)
+			if dest.Port != 0 {
+				span.Attributes = append(span.Attributes, otlp.Int("net.peer.port", int64(dest.Port)))
+			}
+		}
+		span.Attributes = appendOTLPLabels(span.Attributes, ctx.Tags)
+	}
+	e.addSpanRecord(span)
+}
+
+func (e *otlpExporter) addSpanRecord(span otlp.Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.batch.spans) >= otlpMaxQueueSize {
+		e.batch.dropped++
+		return
+	}
+	e.batch.spans = append(e.batch.spans, span)
+}
+
+// addError queues err as an OTLP log record, correlated with the
+// trace and span, or transaction, in which the error occurred.
+func (e *otlpExporter) addError(err *model.Error) {
+	record := otlp.LogRecord{
+		TimeUnixNano:         uint64(time.Time(err.Timestamp).UnixNano()),
+		ObservedTimeUnixNano: uint64(time.Now().UnixNano()),
+		SeverityNumber:       otlp.SeverityNumberError,
+		SeverityText:         "ERROR",
+		TraceID:              otlp.TraceID(err.TraceID),
+		SpanID:               otlp.SpanID(err.ParentID),
+	}
+	message := err.Log.Message
+	if message == "" {
+		message = err.Exception.Message
+	}
+	record.Body.StringValue = &message
+
+	record.Attributes = appendOTLPString(record.Attributes, "atatus.error.culprit", err.Culprit)
+	if ex := err.Exception; ex.Message != "" || ex.Type != "" {
+		exceptionType := ex.Type
+		if ex.Module != "" && exceptionType != "" {
+			exceptionType = ex.Module + "." + exceptionType
+		}
+		record.Attributes = appendOTLPString(record.Attributes, "exception.type", exceptionType)
+		record.Attributes = appendOTLPString(record.Attributes, "exception.message", ex.Message)
+		record.Attributes = appendOTLPString(record.Attributes, "exception.stacktrace", otlpStacktrace(ex.Stacktrace))
+	} else {
+		record.Attributes = appendOTLPString(record.Attributes, "log.logger", err.Log.LoggerName)
+	}
+	if err.Context != nil {
+		record.Attributes = appendOTLPLabels(record.Attributes, err.Context.Tags)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.batch.logs) >= otlpMaxQueueSize {
+		e.batch.dropped++
+		return
+	}
+	e.batch.logs = append(e.batch.logs, record)
+}
+
+// addMetrics queues the gathered metrics as OTLP gauges. Histogram
+// samples, which have no single value, are not exported.
+func (e *otlpExporter) addMetrics(m *Metrics) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, metrics := range [][]*model.Metrics{m.transactionGroupMetrics, m.metrics} {
+		for _, ms := range metrics {
+			e.batch.addMetrics(ms)
+		}
+	}
+}
+
+func (b *otlpBatch) addMetrics(ms *model.Metrics) {
+	var attrs []otlp.KeyValue
+	attrs = appendOTLPString(attrs, "transaction.name", ms.Transaction.Name)
+	attrs = appendOTLPString(attrs, "transaction.type", ms.Transaction.Type)
+	attrs = appendOTLPString(attrs, "span.type", ms.Span.Type)
+	attrs = appendOTLPString(attrs, "span.subtype", ms.Span.Subtype)
+	for _, l := range ms.Labels {
+		attrs = append(attrs, otlp.String(l.Key, l.Value))
+	}
+
+	names := make([]string, 0, len(ms.Samples))
+	for name, sample := range ms.Samples {
+		if sample.Values == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		i, ok := b.metricIndex[name]
+		if !ok {
+			if b.metricIndex == nil {
+				b.metricIndex = make(map[string]int)
+			}
+			i = len(b.metrics)
+			b.metricIndex[name] = i
+			b.metrics = append(b.metrics, otlp.Metric{Name: name})
+		}
+		b.metrics[i].Gauge.DataPoints = append(b.metrics[i].Gauge.DataPoints, otlp.NumberDataPoint{
+			Attributes:   attrs,
+			TimeUnixNano: uint64(time.Time(ms.Timestamp).UnixNano()),
+			AsDouble:     ms.Samples[name].Value,
+		})
+	}
+}
+
+// export POSTs the telemetry in b to the traces, metrics and logs endpoints.
+func (e *otlpExporter) export(service *model.Service, system *model.System, b otlpBatch) {
+	e.resourceOnce.Do(func() {
+		e.resource = makeOTLPResource(service, system, &currentProcess, getCloudMetadata())
+	})
+	scope := otlp.Scope{Name: otlpScopeName, Version: AgentVersion}
+	if b.dropped > 0 && e.logger != nil {
+		e.logger.Warningf("OTLP export queue full: dropped %d events", b.dropped)
+	}
+	if len(b.spans) > 0 {
+		e.send(otlpTracesPath, &otlp.TracesRequest{ResourceSpans: []otlp.ResourceSpans{{
+			Resource:   e.resource,
+			ScopeSpans: []otlp.ScopeSpans{{Scope: scope, Spans: b.spans}},
+		}}})
+	}
+	if len(b.metrics) > 0 {
+		e.send(otlpMetricsPath, &otlp.MetricsRequest{ResourceMetrics: []otlp.ResourceMetrics{{
+			Resource:     e.resource,
+			ScopeMetrics: []otlp.ScopeMetrics{{Scope: scope, Metrics: b.metrics}},
+		}}})
+	}
+	if len(b.logs) > 0 {
+		e.send(otlpLogsPath, &otlp.LogsRequest{ResourceLogs: []otlp.ResourceLogs{{
+			Resource:  e.resource,
+			ScopeLogs: []otlp.ScopeLogs{{Scope: scope, LogRecords: b.logs}},
+		}}})
+	}
+}
+
+// otlpRequest is implemented by the OTLP export requests.
+type otlpRequest interface {
+	MarshalProto() []byte
+}
+
+func (e *otlpExporter) send(path string, req otlpRequest) {
+	if err := e.post(path, req); err != nil && e.logger != nil {
+		e.logger.Errorf("OTLP export failed: %s", err)
+	}
+}
+
+func (e *otlpExporter) post(path string, req otlpRequest) error {
+	var body []byte
+	var contentType string
+	if e.protocol == otlpProtocolJSON {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	} else {
+		body = req.MarshalProto()
+		contentType = "application/x-protobuf"
+	}
+
+	httpReq, err := http.NewRequest("POST", e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.headers {
+		httpReq.Header[k] = v
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	httpReq.Header.Set("User-Agent", fmt.Sprintf("atatus-go/%s", AgentVersion))
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("%s%s responded with %s", e.endpoint, path, resp.Status)
+	}
+	return nil
+}
+
+// makeOTLPResource returns the OTLP resource describing the service,
+// using the OpenTelemetry semantic conventions for resource attributes.
+func makeOTLPResource(service *model.Service, system *model.System, process *model.Process, cloud *model.Cloud) otlp.Resource {
+	var attrs []otlp.KeyValue
+	attrs = appendOTLPString(attrs, "service.name", service.Name)
+	attrs = appendOTLPString(attrs, "service.version", service.Version)
+	attrs = appendOTLPString(attrs, "deployment.environment", service.Environment)
+	if service.Node != nil {
+		attrs = appendOTLPString(attrs, "service.instance.id", service.Node.ConfiguredName)
+	}
+	attrs = append(attrs,
+		otlp.String("telemetry.sdk.name", "atatus"),
+		otlp.String("telemetry.sdk.language", "go"),
+		otlp.String("telemetry.sdk.version", AgentVersion),
+	)
+	if service.Runtime != nil {
+		attrs = appendOTLPString(attrs, "process.runtime.name", service.Runtime.Name)
+		attrs = appendOTLPString(attrs, "process.runtime.version", service.Runtime.Version)
+	}
+	if process != nil {
+		attrs = append(attrs, otlp.Int("process.pid", int64(process.Pid)))
+		attrs = appendOTLPString(attrs, "process.executable.name", process.Title)
+	}
+	if system != nil {
+		attrs = appendOTLPString(attrs, "host.name", system.Hostname)
+		attrs = appendOTLPString(attrs, "host.arch", system.Architecture)
+		attrs = appendOTLPString(attrs, "os.type", system.Platform)
+		if system.Container != nil {
+			attrs = appendOTLPString(attrs, "container.id", system.Container.ID)
+		}
+		if k8s := system.Kubernetes; k8s != nil {
+			attrs = appendOTLPString(attrs, "k8s.namespace.name", k8s.Namespace)
+			if k8s.Node != nil {
+				attrs = appendOTLPString(attrs, "k8s.node.name", k8s.Node.Name)
+			}
+			if k8s.Pod != nil {
+				attrs = appendOTLPString(attrs, "k8s.pod.name", k8s.Pod.Name)
+				attrs = appendOTLPString(attrs, "k8s.pod.uid", k8s.Pod.UID)
+			}
+		}
+	}
+	if cloud != nil {
+		attrs = appendOTLPString(attrs, "cloud.provider", cloud.Provider)
+		attrs = appendOTLPString(attrs, "cloud.region", cloud.Region)
+		attrs = appendOTLPString(attrs, "cloud.availability_zone", cloud.AvailabilityZone)
+		if cloud.Instance != nil {
+			attrs = appendOTLPString(attrs, "host.id", cloud.Instance.ID)
+		}
+		if cloud.Machine != nil {
+			attrs = appendOTLPString(attrs, "host.type", cloud.Machine.Type)
+		}
+		if cloud.Account != nil {
+			attrs = appendOTLPString(attrs, "cloud.account.id", cloud.Account.ID)
+		} else if cloud.Project != nil {
+			attrs = appendOTLPString(attrs, "cloud.account.id", cloud.Project.ID)
+		}
+	}
+	for _, l := range globalLabels {
+		attrs = append(attrs, otlp.String(l.Key, l.Value))
+	}
+	return otlp.Resource{Attributes: attrs}
+}
+
+func otlpTransactionKind(transactionType string) otlp.SpanKind {
+	switch transactionType {
+	case "request":
+		return otlp.SpanKindServer
+	case "messaging":
+		return otlp.SpanKindConsumer
+	}
+	return otlp.SpanKindInternal
+}
+
+func otlpSpanKind(s *model.Span) otlp.SpanKind {
+	switch s.Type {
+	case "messaging":
+		return otlp.SpanKindProducer
+	case "db", "external", "cache", "storage":
+		return otlp.SpanKindClient
+	}
+	if s.Context != nil && s.Context.Destination != nil {
+		return otlp.SpanKindClient
+	}
+	return otlp.SpanKindInternal
+}
+
+func otlpStatus(outcome string) otlp.Status {
+	if outcome == "failure" {
+		return otlp.Status{Code: otlp.StatusCodeError}
+	}
+	return otlp.Status{}
+}
+
+// otlpTimes returns the start and end times of an event with the given
+// timestamp and duration in milliseconds, in nanoseconds since the epoch.
+func otlpTimes(timestamp model.Time, duration float64) (start, end uint64) {
+	start = uint64(time.Time(timestamp).UnixNano())
+	return start, start + uint64(duration*float64(time.Millisecond))
+}
+
+func otlpRequestURL(u *model.URL) string {
+	if u.Full != "" {
+		return u.Full
+	}
+	if u.Hostname == "" {
+		return ""
+	}
+	out := url.URL{Scheme: u.Protocol, Host: u.Hostname, Path: u.Path, RawQuery: u.Search}
+	if u.Port != "" {
+		out.Host += ":" + u.Port
+	}
+	return out.String()
+}
+
+func otlpStacktrace(frames []model.StacktraceFrame) string {
+	var buf strings.Builder
+	for _, frame := range frames {
+		file := frame.AbsolutePath
+		if file == "" {
+			file = frame.File
+		}
+		fmt.Fprintf(&buf, "%s\n\t%s:%d\n", frame.Function, file, frame.Line)
+	}
+	return buf.String()
+}
+
+func appendOTLPString(attrs []otlp.KeyValue, key, value string) []otlp.KeyValue {
+	if value == "" {
+		return attrs
+	}
+	return append(attrs, otlp.String(key, value))
+}
+
+func appendOTLPLabels(attrs []otlp.KeyValue, labels model.IfaceMap) []otlp.KeyValue {
+	for _, l := range labels {
+		switch v := l.Value.(type) {
+		case string:
+			attrs = append(attrs, otlp.String(l.Key, v))
+		case bool:
+			attrs = append(attrs, otlp.Bool(l.Key, v))
+		case float64:
+			attrs = append(attrs, otlp.Double(l.Key, v))
+		case int64:
+			attrs = append(attrs, otlp.Int(l.Key, v))
+		case int:
+			attrs = append(attrs, otlp.Int(l.Key, int64(v)))
+		default:
+			attrs = append(attrs, otlp.String(l.Key, fmt.Sprint(v)))
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,232 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.atatus.com/agent/internal/otlp"
+)
+
+// otlpCollector records the requests sent to an OTLP/HTTP endpoint.
+type otlpCollector struct {
+	mu       sync.Mutex
+	requests map[string][][]byte
+	headers  map[string]http.Header
+}
+
+func newOTLPCollector(t *testing.T) (*otlpCollector, *httptest.Server) {
+	c := &otlpCollector{requests: make(map[string][][]byte), headers: make(map[string]http.Header)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "POST", r.Method)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.requests[r.URL.Path] = append(c.requests[r.URL.Path], body)
+		c.headers[r.URL.Path] = r.Header
+	}))
+	return c, server
+}
+
+func newOTLPTestTracer(t *testing.T, endpoint string) *Tracer {
+	tracer, err := NewTracerOptions(TracerOptions{
+		ServiceName:  "otlp_test",
+		ExportMode:   "otlp",
+		OTLPEndpoint: endpoint,
+	})
+	require.NoError(t, err)
+	return tracer
+}
+
+func TestTracerExportModeOTLPJSON(t *testing.T) {
+	os.Setenv(envOTLPProtocol, "http/json")
+	defer os.Unsetenv(envOTLPProtocol)
+	os.Setenv(envOTLPHeaders, "Authorization=Bearer secret")
+	defer os.Unsetenv(envOTLPHeaders)
+
+	collector, server := newOTLPCollector(t)
+	defer server.Close()
+	tracer := newOTLPTestTracer(t, server.URL)
+
+	tx := tracer.StartTransaction("GET /", "request")
+	span := tx.StartSpan("SELECT FROM foo", "db.mysql.query", nil)
+	span.Context.SetDatabase(DatabaseSpanContext{Statement: "SELECT * FROM foo", Instance: "test"})
+	span.End()
+	e := tracer.NewError(errors.New("boom"))
+	e.SetTransaction(tx)
+	e.Send()
+	tx.End()
+	tracer.SendMetrics(nil)
+	tracer.Flush(nil)
+	tracer.Close()
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	for _, path := range []string{otlpTracesPath, otlpMetricsPath, otlpLogsPath} {
+		require.NotEmpty(t, collector.requests[path], path)
+		assert.Equal(t, "application/json", collector.headers[path].Get("Content-Type"))
+		assert.Equal(t, "Bearer secret", collector.headers[path].Get("Authorization"))
+	}
+
+	var traces struct {
+		ResourceSpans []struct {
+			Resource   resourceJSON
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string
+					SpanID       string
+					ParentSpanID string
+					Name         string
+					Kind         int
+					Attributes   []otlp.KeyValue
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(collector.requests[otlpTracesPath][0], &traces))
+	require.Len(t, traces.ResourceSpans, 1)
+	assert.Equal(t, "otlp_test", traces.ResourceSpans[0].Resource.attr("service.name"))
+	assert.Equal(t, "go", traces.ResourceSpans[0].Resource.attr("telemetry.sdk.language"))
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+
+	dbSpan, txSpan := spans[0], spans[1]
+	assert.Equal(t, "GET /", txSpan.Name)
+	assert.Equal(t, int(otlp.SpanKindServer), txSpan.Kind)
+	assert.Equal(t, "SELECT FROM foo", dbSpan.Name)
+	assert.Equal(t, int(otlp.SpanKindClient), dbSpan.Kind)
+	assert.Equal(t, txSpan.TraceID, dbSpan.TraceID)
+	assert.Equal(t, txSpan.SpanID, dbSpan.ParentSpanID)
+	assert.Contains(t, dbSpan.Attributes, otlp.String("db.system", "mysql"))
+	assert.Contains(t, dbSpan.Attributes, otlp.String("db.statement", "SELECT * FROM foo"))
+
+	var logs struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []struct {
+					SeverityNumber int
+					TraceID        string
+					SpanID         string
+					Body           otlp.AnyValue
+					Attributes     []otlp.KeyValue
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(collector.requests[otlpLogsPath][0], &logs))
+	records := logs.ResourceLogs[0].ScopeLogs[0].LogRecords
+	require.Len(t, records, 1)
+	assert.Equal(t, int(otlp.SeverityNumberError), records[0].SeverityNumber)
+	assert.Equal(t, "boom", *records[0].Body.StringValue)
+	assert.Equal(t, txSpan.TraceID, records[0].TraceID)
+	assert.Equal(t, txSpan.SpanID, records[0].SpanID)
+	assert.Contains(t, records[0].Attributes, otlp.String("exception.message", "boom"))
+
+	var metrics struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name string
+				}
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(collector.requests[otlpMetricsPath][0], &metrics))
+	var names []string
+	for _, m := range metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		names = append(names, m.Name)
+	}
+	assert.Contains(t, names, "golang.goroutines")
+}
+
+func TestTracerExportModeOTLPProtobuf(t *testing.T) {
+	collector, server := newOTLPCollector(t)
+	defer server.Close()
+	tracer := newOTLPTestTracer(t, server.URL)
+
+	tracer.StartTransaction("name", "type").End()
+	tracer.Flush(nil)
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	require.Len(t, collector.requests[otlpTracesPath], 1)
+	assert.Equal(t, "application/x-protobuf", collector.headers[otlpTracesPath].Get("Content-Type"))
+	assert.Contains(t, string(collector.requests[otlpTracesPath][0]), "otlp_test")
+	tracer.Close()
+}
+
+func TestInitialOTLPHeaders(t *testing.T) {
+	os.Setenv(envOTLPHeaders, "a=b, c = d=e")
+	defer os.Unsetenv(envOTLPHeaders)
+	headers, err := initialOTLPHeaders()
+	require.NoError(t, err)
+	assert.Equal(t, http.Header{"A": {"b"}, "C": {"d=e"}}, headers)
+
+	os.Setenv(envOTLPHeaders, "a")
+	_, err = initialOTLPHeaders()
+	assert.EqualError(t, err, `invalid ATATUS_OTLP_HEADERS value "a": expected key=value pairs`)
+}
+
+func TestNewOTLPExporterInvalid(t *testing.T) {
+	_, err := newOTLPExporter("localhost:4318", otlpProtocolProtobuf, nil, "")
+	assert.Error(t, err)
+	_, err = newOTLPExporter("http://localhost:4318", "grpc", nil, "")
+	assert.EqualError(t, err, `invalid OTLP protocol "grpc"`)
+	_, err = newOTLPExporter("http://localhost:4318", otlpProtocolProtobuf, nil, "ftp://proxy")
+	assert.EqualError(t, err, `invalid ATATUS_NOTIFY_PROXY scheme "ftp"`)
+}
+
+func TestOTLPExporterProxy(t *testing.T) {
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests sent through a proxy have an absolute URL.
+		assert.Equal(t, "http://collector.invalid/v1/traces", r.URL.String())
+		atomic.AddInt32(&proxied, 1)
+	}))
+	defer proxy.Close()
+
+	e, err := newOTLPExporter("http://collector.invalid", otlpProtocolProtobuf, nil, proxy.URL)
+	require.NoError(t, err)
+	assert.Equal(t, otlpTimeout, e.client.Timeout)
+	require.NoError(t, e.post(otlpTracesPath, &otlp.TracesRequest{}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&proxied))
+}
+
+type resourceJSON struct {
+	Attributes []otlp.KeyValue
+}
+
+func (r resourceJSON) attr(key string) string {
+	for _, kv := range r.Attributes {
+		if kv.Key == key && kv.Value.StringValue != nil {
+			return *kv.Value.StringValue
+		}
+	}
+	return ""
+}
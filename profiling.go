@@ -21,12 +21,45 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"runtime"
 	"runtime/pprof"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+
+	"go.atatus.com/agent/internal/pprofdelta"
+)
+
+const (
+	// defaultContentionProfileDuration is the default duration of
+	// the sampling window for mutex and block profiles.
+	defaultContentionProfileDuration = 10 * time.Second
+
+	// mutexProfileFraction is the mutex profile fraction set
+	// during mutex profile sampling windows: on average, 1/n
+	// mutex contention events are reported.
+	mutexProfileFraction = 10
+
+	// blockProfileRate is the block profile rate set during block
+	// profile sampling windows: on average, one blocking event is
+	// sampled per blockProfileRate nanoseconds spent blocked.
+	blockProfileRate = int(10 * time.Microsecond)
 )
 
+// profilingConfig holds the continuous profiling configuration.
+// Profiles with a zero interval are not captured.
+type profilingConfig struct {
+	cpuInterval       time.Duration
+	cpuDuration       time.Duration
+	heapInterval      time.Duration
+	goroutineInterval time.Duration
+	mutexInterval     time.Duration
+	mutexDuration     time.Duration
+	blockInterval     time.Duration
+	blockDuration     time.Duration
+}
+
 type profilingState struct {
 	profileType  string
 	profileStart func(io.Writer) error
@@ -38,6 +71,7 @@ type profilingState struct {
 
 	timer      *time.Timer
 	timerStart time.Time
+	running    bool
 	buf        bytes.Buffer
 	finished   chan struct{}
 }
@@ -45,8 +79,23 @@ type profilingState struct {
 // newCPUProfilingState calls newProfilingState with the
 // profiler type set to "cpu", and using pprof.StartCPUProfile
 // and pprof.StopCPUProfile.
-func newCPUProfilingState(sender profileSender) *profilingState {
-	return newProfilingState("cpu", pprof.StartCPUProfile, pprof.StopCPUProfile, sender)
+//
+// While the CPU profiler is running, active is set to 1; this is
+// used to decide whether transactions and spans should set pprof
+// labels on the current goroutine.
+func newCPUProfilingState(sender profileSender, active *int32) *profilingState {
+	profileStart := func(w io.Writer) error {
+		if err := pprof.StartCPUProfile(w); err != nil {
+			return err
+		}
+		atomic.StoreInt32(active, 1)
+		return nil
+	}
+	profileStop := func() {
+		atomic.StoreInt32(active, 0)
+		pprof.StopCPUProfile()
+	}
+	return newProfilingState("cpu", profileStart, profileStop, sender)
 }
 
 // newHeapProfilingState calls newProfilingState with the
@@ -55,15 +104,91 @@ func newHeapProfilingState(sender profileSender) *profilingState {
 	return newLookupProfilingState("heap", sender)
 }
 
+// newGoroutineProfilingState calls newProfilingState with the
+// profiler type set to "goroutine", and using pprof.Lookup("goroutine").WriteTo(writer, 0).
+func newGoroutineProfilingState(sender profileSender) *profilingState {
+	return newLookupProfilingState("goroutine", sender)
+}
+
+// newMutexProfilingState calls newContentionProfilingState with the
+// profiler type set to "mutex", enabling mutex profiling with
+// runtime.SetMutexProfileFraction for the sampling window.
+func newMutexProfilingState(sender profileSender) *profilingState {
+	return newContentionProfilingState("mutex", runtime.SetMutexProfileFraction, mutexProfileFraction, sender)
+}
+
+// newBlockProfilingState calls newContentionProfilingState with the
+// profiler type set to "block", enabling block profiling with
+// runtime.SetBlockProfileRate for the sampling window.
+//
+// The block profile rate cannot be queried, so it is disabled at the
+// end of each sampling window. Applications which enable block profiling
+// themselves, with runtime.SetBlockProfileRate, should therefore not also
+// enable block profiling in the agent, as it will disable theirs.
+func newBlockProfilingState(sender profileSender) *profilingState {
+	setRate := func(rate int) int {
+		runtime.SetBlockProfileRate(rate)
+		return 0
+	}
+	return newContentionProfilingState("block", setRate, blockProfileRate, sender)
+}
+
 func newLookupProfilingState(name string, sender profileSender) *profilingState {
 	profileStart := func(w io.Writer) error {
-		profile := pprof.Lookup(name)
-		if profile == nil {
-			return errors.Errorf("no profile called %q", name)
+		return writeLookupProfile(name, w)
+	}
+	return newProfilingState(name, profileStart, func() {}, sender)
+}
+
+// newContentionProfilingState returns a new profilingState for the
+// named contention profile. At the start of each sampling window the
+// profile's rate is set with setRate, which returns the previous rate;
+// at the end of the window the profile is written, and the previous
+// rate restored.
+//
+// Contention profiles are cumulative from process start, so the profile
+// is also captured at the start of the window, and subtracted from the
+// profile written at the end; each profile holds only the events sampled
+// during its window.
+func newContentionProfilingState(
+	name string,
+	setRate func(int) int,
+	rate int,
+	sender profileSender,
+) *profilingState {
+	var w io.Writer
+	var prevRate int
+	var start bytes.Buffer
+	profileStart := func(writer io.Writer) error {
+		start.Reset()
+		if err := writeLookupProfile(name, &start); err != nil {
+			return err
 		}
-		return profile.WriteTo(w, 0)
+		w = writer
+		prevRate = setRate(rate)
+		return nil
 	}
-	return newProfilingState("heap", profileStart, func() {}, sender)
+	profileStop := func() {
+		setRate(prevRate)
+		var end bytes.Buffer
+		if err := writeLookupProfile(name, &end); err != nil {
+			return
+		}
+		if delta, err := pprofdelta.Delta(start.Bytes(), end.Bytes()); err == nil {
+			w.Write(delta)
+		} else {
+			w.Write(end.Bytes())
+		}
+	}
+	return newProfilingState(name, profileStart, profileStop, sender)
+}
+
+func writeLookupProfile(name string, w io.Writer) error {
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		return errors.Errorf("no profile called %q", name)
+	}
+	return profile.WriteTo(w, 0)
 }
 
 // newProfilingState returns a new profilingState,
@@ -98,12 +223,23 @@ func (state *profilingState) updateConfig(interval, duration time.Duration) {
 	if state.interval == interval {
 		return
 	}
-	if state.timerStart.IsZero() {
-		state.interval = interval
-		state.resetTimer()
+	state.interval = interval
+	if state.running {
+		// The timer will be reset with the new interval
+		// once the running profile has finished.
+		return
+	}
+	if !state.timerStart.IsZero() && !state.timer.Stop() {
+		<-state.timer.C
 	}
-	// TODO(axw) handle extending/cutting short running timers once
-	// it is possible to dynamically control profiling configuration.
+	state.resetTimer()
+}
+
+// finish records that the running profile has finished,
+// and resets the timer for the next profile.
+func (state *profilingState) finish() {
+	state.running = false
+	state.resetTimer()
 }
 
 func (state *profilingState) resetTimer() {
@@ -123,6 +259,8 @@ func (state *profilingState) start(ctx context.Context, logger Logger, metadata
 	// The state.duration field may be updated after the goroutine starts,
 	// by the caller, so it must be read outside the goroutine.
 	duration := state.duration
+	state.running = true
+	state.timerStart = time.Time{}
 	go func() {
 		defer func() { state.finished <- struct{}{} }()
 		if err := state.profile(ctx, duration); err != nil {
@@ -163,6 +301,93 @@ func (state *profilingState) profile(ctx context.Context, duration time.Duration
 	return nil
 }
 
+// pprof label keys set on goroutines while the CPU profiler is active,
+// enabling CPU samples to be attributed to transactions and spans.
+const (
+	profileLabelTransactionName = "transaction.name"
+	profileLabelTransactionID   = "transaction.id"
+	profileLabelSpanID          = "span.id"
+)
+
+// goroutineProfileLabels records the pprof labels set on a goroutine when
+// a transaction or span starts, along with the labels the goroutine had
+// before, which are restored when the transaction or span ends.
+//
+// runtime/pprof provides no way of reading a goroutine's labels, so the
+// labels it had before are taken to be those of the context in which the
+// transaction or span started, along with those of its parent.
+type goroutineProfileLabels struct {
+	// ctx holds the labels set, from which child labels are derived.
+	ctx context.Context
+
+	// prev holds the labels the goroutine had before ctx was set.
+	prev context.Context
+
+	parent *goroutineProfileLabels
+	ended  int32
+
+	// children holds the number of labels set with l as
+	// their parent, which have not yet been restored.
+	children int32
+}
+
+// setGoroutineProfileLabels sets the current goroutine's pprof labels to
+// those of ctx and parent, if non-nil, with the given key/value pairs added.
+func setGoroutineProfileLabels(ctx context.Context, parent *goroutineProfileLabels, labels ...string) *goroutineProfileLabels {
+	prev := ctx
+	switch {
+	case parent == nil:
+		if prev == nil {
+			prev = context.Background()
+		}
+	case prev == nil:
+		prev = parent.ctx
+	default:
+		var parentLabels []string
+		pprof.ForLabels(parent.ctx, func(key, value string) bool {
+			parentLabels = append(parentLabels, key, value)
+			return true
+		})
+		prev = pprof.WithLabels(prev, pprof.Labels(parentLabels...))
+	}
+	if parent != nil {
+		atomic.AddInt32(&parent.children, 1)
+	}
+	l := &goroutineProfileLabels{
+		ctx:    pprof.WithLabels(prev, pprof.Labels(labels...)),
+		prev:   prev,
+		parent: parent,
+	}
+	pprof.SetGoroutineLabels(l.ctx)
+	return l
+}
+
+// restore marks l as ended, and restores the current goroutine's pprof
+// labels to those it had before l was set. If l's parent has already
+// ended, its labels are skipped over, and so on up to the transaction.
+//
+// The labels are left unchanged while any of l's children has not yet
+// ended, as when the transaction ends before its spans; they are then
+// restored when the last child ends. Labels are set on the current
+// goroutine, so transactions and spans should end on the goroutine
+// that started them.
+func (l *goroutineProfileLabels) restore() {
+	if !atomic.CompareAndSwapInt32(&l.ended, 0, 1) {
+		return
+	}
+	if atomic.LoadInt32(&l.children) != 0 {
+		return
+	}
+	for l.parent != nil {
+		parent := l.parent
+		if atomic.AddInt32(&parent.children, -1) != 0 || atomic.LoadInt32(&parent.ended) == 0 {
+			break
+		}
+		l = parent
+	}
+	pprof.SetGoroutineLabels(l.prev)
+}
+
 type profileSender interface {
 	SendProfile(ctx context.Context, metadata io.Reader, profile ...io.Reader) error
 }
@@ -0,0 +1,243 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chanProfileSender chan []byte
+
+func (s chanProfileSender) SendProfile(ctx context.Context, metadata io.Reader, profile ...io.Reader) error {
+	data, err := ioutil.ReadAll(io.MultiReader(profile...))
+	if err != nil {
+		return err
+	}
+	s <- data
+	return nil
+}
+
+func TestContentionProfilingState(t *testing.T) {
+	sender := make(chanProfileSender, 1)
+	state := newMutexProfilingState(sender)
+	defer runtime.SetMutexProfileFraction(runtime.SetMutexProfileFraction(0))
+
+	state.updateConfig(time.Millisecond, 200*time.Millisecond)
+	<-state.timer.C
+	state.start(context.Background(), nil, bytes.NewReader(nil))
+	assert.Eventually(t, func() bool {
+		return runtime.SetMutexProfileFraction(-1) == mutexProfileFraction
+	}, 10*time.Second, time.Millisecond)
+
+	select {
+	case data := <-sender:
+		assert.NotEmpty(t, data)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for profile")
+	}
+	<-state.finished
+	assert.Equal(t, 0, runtime.SetMutexProfileFraction(-1))
+
+	// Changing the interval while a profile is running
+	// takes effect once the profile has finished.
+	state.updateConfig(time.Hour, 200*time.Millisecond)
+	assert.True(t, state.timerStart.IsZero())
+	state.finish()
+	assert.False(t, state.timerStart.IsZero())
+
+	// Disabling the profile stops the timer.
+	state.updateConfig(0, 0)
+	assert.True(t, state.timerStart.IsZero())
+}
+
+func TestTracerProfilingRemoteConfig(t *testing.T) {
+	tracer := newAggTestTracer(t, "http://server.invalid")
+	defer tracer.Close()
+
+	tracer.updateRemoteConfig(nil, nil, map[string]string{
+		"goroutine_profile_interval": "1m",
+		"block_profile_interval":     "5m",
+		"block_profile_duration":     "30s",
+		"mutex_profile_interval":     "often",
+	})
+	assert.Equal(t, profilingConfig{
+		goroutineInterval: time.Minute,
+		blockInterval:     5 * time.Minute,
+		blockDuration:     30 * time.Second,
+	}, tracer.instrumentationConfig().profiling)
+
+	tracer.updateRemoteConfig(nil, map[string]string{"goroutine_profile_interval": "1m"}, map[string]string{
+		"block_profile_interval": "5m",
+		"block_profile_duration": "30s",
+	})
+	assert.Zero(t, tracer.instrumentationConfig().profiling.goroutineInterval)
+}
+
+func TestProfileLabels(t *testing.T) {
+	tracer := newAggTestTracer(t, "http://server.invalid")
+	defer tracer.Close()
+
+	tx := tracer.StartTransaction("name", "type")
+	assert.Nil(t, tx.profileLabels)
+	tx.Discard()
+
+	atomic.StoreInt32(&tracer.cpuProfiling, 1)
+	defer atomic.StoreInt32(&tracer.cpuProfiling, 0)
+
+	tx = tracer.StartTransaction("GET /foo", "request")
+	txLabel := `"transaction.id":"` + tx.TraceContext().Span.String() + `"`
+	assert.Contains(t, goroutineLabels(t), `"transaction.name":"GET /foo"`)
+	assert.Contains(t, goroutineLabels(t), txLabel)
+
+	span, ctx := StartSpan(ContextWithTransaction(context.Background(), tx), "parent", "type")
+	spanLabel := `"span.id":"` + span.TraceContext().Span.String() + `"`
+	assert.Contains(t, goroutineLabels(t), spanLabel)
+
+	child, _ := StartSpan(ctx, "child", "type")
+	childLabel := `"span.id":"` + child.TraceContext().Span.String() + `"`
+	labels := goroutineLabels(t)
+	assert.Contains(t, labels, childLabel)
+	assert.Contains(t, labels, txLabel)
+
+	child.End()
+	labels = goroutineLabels(t)
+	assert.NotContains(t, labels, childLabel)
+	assert.Contains(t, labels, spanLabel)
+
+	span.End()
+	labels = goroutineLabels(t)
+	assert.NotContains(t, labels, spanLabel)
+	assert.Contains(t, labels, txLabel)
+
+	tx.End()
+	assert.NotContains(t, goroutineLabels(t), txLabel)
+}
+
+func TestProfileLabelsTransactionEndedFirst(t *testing.T) {
+	tracer := newAggTestTracer(t, "http://server.invalid")
+	defer tracer.Close()
+	atomic.StoreInt32(&tracer.cpuProfiling, 1)
+	defer atomic.StoreInt32(&tracer.cpuProfiling, 0)
+
+	pprof.Do(context.Background(), pprof.Labels("app", "label"), func(ctx context.Context) {
+		tx := tracer.StartTransactionOptions("GET /leak", "request", TransactionOptions{Context: ctx})
+		txLabel := `"transaction.id":"` + tx.TraceContext().Span.String() + `"`
+		span := tx.StartSpan("name", "type", nil)
+		spanLabel := `"span.id":"` + span.TraceContext().Span.String() + `"`
+		assert.Contains(t, goroutineLabels(t), spanLabel)
+
+		// Ending the transaction first leaves the span's labels in
+		// place, and ending the span then restores the labels the
+		// goroutine had before the transaction started.
+		tx.End()
+		assert.Contains(t, goroutineLabels(t), spanLabel)
+		span.End()
+		labels := goroutineLabels(t)
+		assert.NotContains(t, labels, txLabel)
+		assert.NotContains(t, labels, `"transaction.name"`)
+		assert.Contains(t, labels, `"app":"label"`)
+	})
+}
+
+func TestProfileLabelsExisting(t *testing.T) {
+	tracer := newAggTestTracer(t, "http://server.invalid")
+	defer tracer.Close()
+	atomic.StoreInt32(&tracer.cpuProfiling, 1)
+	defer atomic.StoreInt32(&tracer.cpuProfiling, 0)
+
+	pprof.Do(context.Background(), pprof.Labels("app", "label"), func(ctx context.Context) {
+		// The labels of the transaction's context are kept.
+		tx := tracer.StartTransactionOptions("name", "type", TransactionOptions{Context: ctx})
+		txLabel := `"transaction.id":"` + tx.TraceContext().Span.String() + `"`
+		labels := goroutineLabels(t)
+		assert.Contains(t, labels, `"app":"label"`)
+		assert.Contains(t, labels, txLabel)
+
+		// Labels added to the context within the transaction are
+		// kept along with the transaction's labels for its spans.
+		ctx = ContextWithTransaction(ctx, tx)
+		pprof.Do(ctx, pprof.Labels("stage", "query"), func(ctx context.Context) {
+			span, _ := StartSpan(ctx, "name", "type")
+			labels := goroutineLabels(t)
+			assert.Contains(t, labels, `"app":"label"`)
+			assert.Contains(t, labels, `"stage":"query"`)
+			assert.Contains(t, labels, txLabel)
+
+			span.End()
+			labels = goroutineLabels(t)
+			assert.Contains(t, labels, `"stage":"query"`)
+			assert.Contains(t, labels, txLabel)
+			assert.NotContains(t, labels, `"span.id"`)
+		})
+
+		tx.End()
+		labels = goroutineLabels(t)
+		assert.Contains(t, labels, `"app":"label"`)
+		assert.NotContains(t, labels, txLabel)
+	})
+}
+
+// goroutineLabels returns the pprof labels of the current goroutine,
+// as formatted in the debug goroutine profile.
+func goroutineLabels(t *testing.T) string {
+	var buf bytes.Buffer
+	require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+	for _, record := range strings.Split(buf.String(), "\n\n") {
+		if strings.Contains(record, "goroutineLabels") {
+			for _, line := range strings.Split(record, "\n") {
+				if strings.HasPrefix(line, "# labels: ") {
+					return line
+				}
+			}
+			return ""
+		}
+	}
+	t.Fatal("current goroutine not found in profile")
+	return ""
+}
+
+func TestInitialContentionProfileIntervalDuration(t *testing.T) {
+	interval, duration, err := initialMutexProfileIntervalDuration()
+	require.NoError(t, err)
+	assert.Zero(t, interval)
+	assert.Zero(t, duration)
+
+	os.Setenv(envMutexProfileInterval, "1m")
+	defer os.Unsetenv(envMutexProfileInterval)
+	interval, duration, err = initialMutexProfileIntervalDuration()
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, interval)
+	assert.Equal(t, defaultContentionProfileDuration, duration)
+
+	os.Setenv(envMutexProfileDuration, "0s")
+	defer os.Unsetenv(envMutexProfileDuration)
+	_, _, err = initialMutexProfileIntervalDuration()
+	assert.EqualError(t, err, "ATATUS_MUTEX_PROFILE_DURATION must be greater than zero, got 0s")
+}
@@ -21,10 +21,13 @@ import (
 	"encoding/binary"
 	"math"
 	"math/big"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"go.atatus.com/agent/internal/apmmath"
+	"go.atatus.com/agent/internal/wildcard"
 )
 
 // Sampler provides a means of sampling transactions.
@@ -56,6 +59,14 @@ type SampleParams struct {
 	// TraceContext holds the newly-generated TraceContext
 	// for the root transaction which is being sampled.
 	TraceContext TraceContext
+
+	// TransactionName holds the name of the
+	// root transaction which is being sampled.
+	TransactionName string
+
+	// TransactionType holds the type of the
+	// root transaction which is being sampled.
+	TransactionType string
 }
 
 // SampleResult holds information about a sampling decision.
@@ -92,6 +103,10 @@ func NewRatioSampler(r float64) Sampler {
 	if r < 0 || r > 1.0 {
 		panic(errors.Errorf("ratio %v out of range [0,1.0]", r))
 	}
+	return newRatioSampler(r)
+}
+
+func newRatioSampler(r float64) ratioSampler {
 	r = roundSampleRate(r)
 	var x big.Float
 	x.SetUint64(math.MaxUint64)
@@ -122,6 +137,270 @@ func (s ratioSampler) SampleExtended(args SampleParams) SampleResult {
 	return result
 }
 
+// NewRateLimitingSampler returns a new Sampler that samples at most
+// perSecond transactions per second, using a token bucket that allows
+// bursts of up to perSecond transactions.
+//
+// So that the reported sample rate is exact, transactions are first
+// sampled by ratio, as with NewRatioSampler, with the ratio adjusted
+// each second to the throughput observed in the previous second; all
+// transactions pass this stage in the first second. Transactions that
+// pass but exceed the rate limit are not sampled, and are reported
+// with a sample rate of 0. If perSecond is negative,
+// NewRateLimitingSampler will panic.
+func NewRateLimitingSampler(perSecond float64) Sampler {
+	if perSecond < 0 {
+		panic(errors.Errorf("rate %v must not be negative", perSecond))
+	}
+	ratio := 1.0
+	if perSecond == 0 {
+		ratio = 0
+	}
+	return &rateLimitingSampler{
+		perSecond: perSecond,
+		burst:     math.Max(perSecond, 1),
+		tokens:    math.Max(perSecond, 1),
+		ratio:     newRatioSampler(ratio),
+		now:       time.Now,
+	}
+}
+
+type rateLimitingSampler struct {
+	mu        sync.Mutex
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+	start     time.Time
+	seen      uint64
+	ratio     ratioSampler
+	now       func() time.Time
+}
+
+// Sample samples the transaction if the rate limit has not been reached.
+func (s *rateLimitingSampler) Sample(c TraceContext) bool {
+	return s.SampleExtended(SampleParams{TraceContext: c}).Sampled
+}
+
+// SampleExtended samples the transaction according to the current
+// sample rate, if the rate limit has not been reached.
+func (s *rateLimitingSampler) SampleExtended(args SampleParams) SampleResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.last.IsZero() {
+		s.start = now
+	} else {
+		elapsed := now.Sub(s.last).Seconds()
+		s.tokens = math.Min(s.burst, s.tokens+elapsed*s.perSecond)
+		if elapsed := now.Sub(s.start); elapsed >= time.Second {
+			s.ratio = newRatioSampler(throughputSampleRate(s.perSecond*elapsed.Seconds(), s.seen))
+			s.start = now
+			s.seen = 0
+		}
+	}
+	s.last = now
+	s.seen++
+
+	result := s.ratio.SampleExtended(args)
+	if result.Sampled {
+		if s.tokens < 1 {
+			return SampleResult{}
+		}
+		s.tokens--
+	}
+	return result
+}
+
+// NewAdaptiveSampler returns a new Sampler that targets sampling
+// perSecond transactions per second, adjusting its sample rate at
+// the end of each interval according to the throughput observed
+// during that interval. All transactions are sampled until the
+// first adjustment.
+//
+// Within an interval the returned Sampler behaves like the Sampler
+// returned by NewRatioSampler, so the reported sample rate is exact.
+// If perSecond is negative, or interval is not positive,
+// NewAdaptiveSampler will panic.
+func NewAdaptiveSampler(perSecond float64, interval time.Duration) Sampler {
+	if perSecond < 0 {
+		panic(errors.Errorf("rate %v must not be negative", perSecond))
+	}
+	if interval <= 0 {
+		panic(errors.Errorf("interval %s must be positive", interval))
+	}
+	return &adaptiveSampler{
+		perSecond: perSecond,
+		interval:  interval,
+		ratio:     newRatioSampler(1),
+		now:       time.Now,
+	}
+}
+
+type adaptiveSampler struct {
+	mu        sync.Mutex
+	perSecond float64
+	interval  time.Duration
+	start     time.Time
+	seen      uint64
+	ratio     ratioSampler
+	now       func() time.Time
+}
+
+// Sample samples the transaction according to the current sample rate.
+func (s *adaptiveSampler) Sample(c TraceContext) bool {
+	return s.SampleExtended(SampleParams{TraceContext: c}).Sampled
+}
+
+// SampleExtended samples the transaction according
+// to the current sample rate.
+func (s *adaptiveSampler) SampleExtended(args SampleParams) SampleResult {
+	s.mu.Lock()
+	now := s.now()
+	if s.start.IsZero() {
+		s.start = now
+	} else if elapsed := now.Sub(s.start); elapsed >= s.interval {
+		s.ratio = newRatioSampler(throughputSampleRate(s.perSecond*elapsed.Seconds(), s.seen))
+		s.start = now
+		s.seen = 0
+	}
+	s.seen++
+	ratio := s.ratio
+	s.mu.Unlock()
+	return ratio.SampleExtended(args)
+}
+
+// SamplerRule holds a rule for NewRuleSampler, selecting
+// the Sampler used for matching transactions.
+type SamplerRule struct {
+	// TransactionName, if non-empty, holds a wildcard pattern
+	// matched case-insensitively against the transaction name.
+	TransactionName string
+
+	// TransactionType, if non-empty, holds the
+	// transaction type to match.
+	TransactionType string
+
+	// Sampler holds the Sampler used for matching transactions.
+	// If Sampler is nil, matching transactions are all sampled.
+	Sampler Sampler
+}
+
+// NewRuleSampler returns a new Sampler that samples each transaction
+// with the Sampler of the first rule matching its name and type, or
+// with fallback if no rule matches. If fallback is nil, transactions
+// matching no rule are all sampled.
+//
+// Samplers should implement ExtendedSampler, so that their sample
+// rate is reported; a sample rate of 1 is reported for the decisions
+// of other Samplers.
+func NewRuleSampler(rules []SamplerRule, fallback Sampler) Sampler {
+	s := &ruleSampler{fallback: fallback}
+	for _, rule := range rules {
+		var name *wildcard.Matcher
+		if rule.TransactionName != "" {
+			name = wildcard.NewMatcher(rule.TransactionName, wildcard.CaseInsensitive)
+		}
+		s.rules = append(s.rules, compiledSamplerRule{
+			name:    name,
+			typ:     rule.TransactionType,
+			sampler: rule.Sampler,
+		})
+	}
+	return s
+}
+
+type ruleSampler struct {
+	rules    []compiledSamplerRule
+	fallback Sampler
+}
+
+type compiledSamplerRule struct {
+	name    *wildcard.Matcher
+	typ     string
+	sampler Sampler
+}
+
+func (r *compiledSamplerRule) match(args SampleParams) bool {
+	if r.name != nil && !r.name.Match(args.TransactionName) {
+		return false
+	}
+	return r.typ == "" || r.typ == args.TransactionType
+}
+
+// Sample samples the transaction with the fallback Sampler,
+// or the Sampler of a rule that matches any transaction.
+func (s *ruleSampler) Sample(c TraceContext) bool {
+	return s.SampleExtended(SampleParams{TraceContext: c}).Sampled
+}
+
+// SampleExtended samples the transaction with the Sampler
+// of the first matching rule, or the fallback Sampler.
+func (s *ruleSampler) SampleExtended(args SampleParams) SampleResult {
+	sampler := s.fallback
+	for i := range s.rules {
+		if s.rules[i].match(args) {
+			sampler = s.rules[i].sampler
+			break
+		}
+	}
+	switch sampler := sampler.(type) {
+	case nil:
+		return SampleResult{Sampled: true, SampleRate: 1}
+	case ExtendedSampler:
+		return sampler.SampleExtended(args)
+	default:
+		return SampleResult{Sampled: sampler.Sample(args.TraceContext), SampleRate: 1}
+	}
+}
+
+// throughputSampleRate returns the sample rate that would have
+// sampled target of the seen transactions, or 1 if fewer were seen.
+func throughputSampleRate(target float64, seen uint64) float64 {
+	if float64(seen) <= target {
+		return 1
+	}
+	return target / float64(seen)
+}
+
+// ParentSamplingPolicy determines the sampling decision for
+// transactions that continue a trace started by another service.
+type ParentSamplingPolicy int
+
+const (
+	// ParentSamplingRespect follows the sampling decision
+	// of the parent, recorded in its TraceContext.
+	ParentSamplingRespect ParentSamplingPolicy = iota
+
+	// ParentSamplingAlways samples all transactions,
+	// regardless of the parent's sampling decision.
+	ParentSamplingAlways
+
+	// ParentSamplingResample ignores the parent's sampling decision,
+	// and samples transactions with the tracer's Sampler, as for the
+	// root of a trace.
+	ParentSamplingResample
+)
+
+// String returns the name of the policy, as used in configuration.
+func (p ParentSamplingPolicy) String() string {
+	switch p {
+	case ParentSamplingAlways:
+		return "always"
+	case ParentSamplingResample:
+		return "resample"
+	}
+	return "parent"
+}
+
+// parentSamplingPolicies holds the sampling policies for
+// transactions continuing a trace from a trusted or
+// untrusted origin.
+type parentSamplingPolicies struct {
+	trusted   ParentSamplingPolicy
+	untrusted ParentSamplingPolicy
+}
+
 // roundSampleRate rounds r to 4 decimal places half away from zero,
 // with the exception of values > 0 and < 0.0001, which are set to 0.0001.
 func roundSampleRate(r float64) float64 {
@@ -0,0 +1,292 @@
+// Licensed to Atatus. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Atatus licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package atatus
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func sampleN(s Sampler, n int, params SampleParams) (sampled int, rates []float64) {
+	for i := 0; i < n; i++ {
+		params.TraceContext.Span = SpanID{0, 0, 0, 0, 0, 0, 0, byte(i + 1)}
+		result := s.(ExtendedSampler).SampleExtended(params)
+		if result.Sampled {
+			sampled++
+			rates = append(rates, result.SampleRate)
+		}
+	}
+	return sampled, rates
+}
+
+func TestRateLimitingSampler(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := NewRateLimitingSampler(2)
+	s.(*rateLimitingSampler).now = clock.Now
+
+	// All transactions pass the ratio in the first second, so those
+	// sampled report a rate of 1, and those over the limit a rate of 0.
+	sampled, rates := sampleN(s, 5, SampleParams{})
+	assert.Equal(t, 2, sampled)
+	assert.Equal(t, []float64{1, 1}, rates)
+	result := s.(ExtendedSampler).SampleExtended(SampleParams{
+		TraceContext: TraceContext{Span: SpanID{0, 0, 0, 0, 0, 0, 0, 1}},
+	})
+	assert.Equal(t, SampleResult{}, result)
+
+	// Tokens are replenished at the configured rate, and the ratio is
+	// adjusted to the throughput of the previous second: 2 of 6.
+	clock.now = clock.now.Add(time.Second)
+	sampled, rates = sampleN(s, 5, SampleParams{})
+	assert.Equal(t, 2, sampled)
+	assert.Equal(t, []float64{0.3333, 0.3333}, rates)
+
+	// Transactions not sampled by the ratio report the ratio.
+	result = s.(ExtendedSampler).SampleExtended(SampleParams{
+		TraceContext: TraceContext{Span: SpanID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	})
+	assert.Equal(t, SampleResult{Sampled: false, SampleRate: 0.3333}, result)
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	sampled, _ = sampleN(s, 5, SampleParams{})
+	assert.Equal(t, 1, sampled)
+
+	sampled, _ = sampleN(NewRateLimitingSampler(0), 5, SampleParams{})
+	assert.Equal(t, 0, sampled)
+}
+
+func TestAdaptiveSampler(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := NewAdaptiveSampler(1, 10*time.Second)
+	s.(*adaptiveSampler).now = clock.Now
+
+	sampled, _ := sampleN(s, 100, SampleParams{})
+	assert.Equal(t, 100, sampled)
+
+	// 100 transactions were seen in the first interval, so the
+	// rate is adjusted to sample 10 transactions per interval.
+	clock.now = clock.now.Add(10 * time.Second)
+	result := s.(ExtendedSampler).SampleExtended(SampleParams{})
+	assert.Equal(t, 0.1, result.SampleRate)
+
+	// The rate is restored when throughput drops below the target.
+	clock.now = clock.now.Add(10 * time.Second)
+	result = s.(ExtendedSampler).SampleExtended(SampleParams{})
+	assert.Equal(t, 1.0, result.SampleRate)
+
+	assert.Panics(t, func() { NewAdaptiveSampler(1, 0) })
+}
+
+func TestRuleSampler(t *testing.T) {
+	s := NewRuleSampler([]SamplerRule{
+		{TransactionName: "GET /health*", Sampler: NewRatioSampler(0)},
+		{TransactionType: "background", Sampler: NewRatioSampler(0.5)},
+		{TransactionType: "messaging"},
+	}, NewRatioSampler(1))
+
+	sampled, _ := sampleN(s, 10, SampleParams{TransactionName: "get /healthz", TransactionType: "request"})
+	assert.Equal(t, 0, sampled)
+
+	result := s.(ExtendedSampler).SampleExtended(SampleParams{TransactionType: "background"})
+	assert.Equal(t, 0.5, result.SampleRate)
+
+	result = s.(ExtendedSampler).SampleExtended(SampleParams{TransactionType: "messaging"})
+	assert.Equal(t, SampleResult{Sampled: true, SampleRate: 1}, result)
+
+	sampled, rates := sampleN(s, 10, SampleParams{TransactionName: "GET /users", TransactionType: "request"})
+	assert.Equal(t, 10, sampled)
+	assert.Equal(t, 1.0, rates[0])
+}
+
+func TestTracerSamplerConfig(t *testing.T) {
+	os.Setenv(envTransactionSampler, "rate_limiting")
+	os.Setenv(envTransactionSampleTarget, "1")
+	defer os.Unsetenv(envTransactionSampler)
+	defer os.Unsetenv(envTransactionSampleTarget)
+
+	tracer := newAggTestTracer(t, "http://notify.invalid")
+	defer tracer.Close()
+
+	sampled := func(name string) bool {
+		tx := tracer.StartTransaction(name, "request")
+		defer tx.Discard()
+		return tx.Sampled()
+	}
+	assert.True(t, sampled("first"))
+	assert.False(t, sampled("second"))
+
+	attrs := map[string]string{
+		"transaction_sampler":      "ratio",
+		"transaction_sample_rules": "name:skip*=0",
+	}
+	tracer.updateRemoteConfig(nil, nil, attrs)
+	assert.False(t, sampled("skip me"))
+	assert.True(t, sampled("third"))
+	assert.True(t, sampled("fourth"))
+
+	tracer.updateRemoteConfig(nil, attrs, map[string]string{})
+	assert.True(t, sampled("fifth"))
+	assert.False(t, sampled("sixth"))
+}
+
+func TestParseSampleRules(t *testing.T) {
+	rules, err := parseSampleRules(envTransactionSampleRules, "name:GET /healthz=0, type:background=0.25")
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "GET /healthz", rules[0].TransactionName)
+	assert.Equal(t, "background", rules[1].TransactionType)
+	assert.Equal(t, 0.25, rules[1].Sampler.(ExtendedSampler).SampleExtended(SampleParams{}).SampleRate)
+
+	_, err = parseSampleRules(envTransactionSampleRules, "GET /healthz=0")
+	assert.EqualError(t, err, `invalid value for ATATUS_TRANSACTION_SAMPLE_RULES: "GET /healthz=0" (expected name:<pattern>=<rate> or type:<type>=<rate>)`)
+
+	_, err = parseSampleRules(envTransactionSampleRules, "type:background=2")
+	assert.EqualError(t, err, "invalid value for ATATUS_TRANSACTION_SAMPLE_RULES: 2 (out of range [0,1.0])")
+}
+
+func TestParentSamplingPolicy(t *testing.T) {
+	tracer := newAggTestTracer(t, "http://notify.invalid")
+	defer tracer.Close()
+
+	start := func(recorded, untrusted bool) TraceContext {
+		parent := TraceContext{
+			Trace: TraceID{1},
+			Span:  SpanID{1},
+			State: NewTraceState(
+				TraceStateEntry{Key: atatusTracestateVendorKey, Value: "s:0.5"},
+				TraceStateEntry{Key: "vendor", Value: "x"},
+			),
+		}
+		parent.Options = parent.Options.WithRecorded(recorded)
+		tx := tracer.StartTransactionOptions("name", "request", TransactionOptions{
+			TraceContext:          parent,
+			UntrustedTraceContext: untrusted,
+		})
+		defer tx.Discard()
+		return tx.TraceContext()
+	}
+
+	c := start(false, true)
+	assert.False(t, c.Options.Recorded())
+	assert.Equal(t, "at=s:0.5,vendor=x", c.State.String())
+
+	tracer.SetParentSamplingPolicy(ParentSamplingRespect, ParentSamplingAlways)
+	c = start(false, true)
+	assert.True(t, c.Options.Recorded())
+	assert.Equal(t, "at=s:1,vendor=x", c.State.String())
+	c = start(false, false)
+	assert.False(t, c.Options.Recorded())
+
+	tracer.SetSampler(NewRatioSampler(0))
+	tracer.SetParentSamplingPolicy(ParentSamplingRespect, ParentSamplingResample)
+	c = start(true, true)
+	assert.False(t, c.Options.Recorded())
+	assert.Equal(t, "at=s:0,vendor=x", c.State.String())
+	c = start(true, false)
+	assert.True(t, c.Options.Recorded())
+
+	tracer.updateRemoteConfig(nil, nil, map[string]string{"parent_sampling_policy": "resample"})
+	c = start(true, false)
+	assert.False(t, c.Options.Recorded())
+}
+
+func TestInitialParentSampling(t *testing.T) {
+	os.Setenv(envUntrustedParentSampling, "Resample")
+	defer os.Unsetenv(envUntrustedParentSampling)
+	policies, err := initialParentSampling()
+	require.NoError(t, err)
+	assert.Equal(t, parentSamplingPolicies{
+		trusted:   ParentSamplingRespect,
+		untrusted: ParentSamplingResample,
+	}, policies)
+
+	os.Setenv(envUntrustedParentSampling, "never")
+	_, err = initialParentSampling()
+	assert.EqualError(t, err, `invalid value for ATATUS_UNTRUSTED_PARENT_SAMPLING_POLICY: never (expected "parent", "always" or "resample")`)
+}
+
+func TestTracerSamplerKeptOnUpdate(t *testing.T) {
+	tracer := newAggTestTracer(t, "http://server.invalid")
+	defer tracer.Close()
+
+	attrs := map[string]string{"transaction_sampler": "rate_limiting", "transaction_sample_target": "10"}
+	tracer.updateRemoteConfig(nil, nil, attrs)
+	sampler := tracer.instrumentationConfig().sampler
+	require.NotNil(t, sampler)
+
+	// The sample rate is not used by the rate limiting sampler,
+	// so updating it keeps the sampler and its token bucket.
+	old := attrs
+	attrs = map[string]string{"transaction_sampler": "rate_limiting", "transaction_sample_target": "10", "transaction_sample_rate": "0.5"}
+	tracer.updateRemoteConfig(nil, old, attrs)
+	assert.True(t, sampler == tracer.instrumentationConfig().sampler)
+
+	old = attrs
+	attrs = map[string]string{"transaction_sampler": "rate_limiting", "transaction_sample_target": "20", "transaction_sample_rate": "0.5"}
+	tracer.updateRemoteConfig(nil, old, attrs)
+	assert.False(t, sampler == tracer.instrumentationConfig().sampler)
+}
+
+func TestTracerSamplerKeptOnEqualRules(t *testing.T) {
+	tracer := newAggTestTracer(t, "http://server.invalid")
+	defer tracer.Close()
+
+	attrs := map[string]string{"transaction_sampler": "rate_limiting", "transaction_sample_rules": "name:GET /*=0.5"}
+	tracer.updateRemoteConfig(nil, nil, attrs)
+	sampler := tracer.instrumentationConfig().sampler
+	require.NotNil(t, sampler)
+
+	// The rules are parsed again on each update; equal rules
+	// keep the sampler, and changed rules replace it.
+	old := attrs
+	attrs = map[string]string{"transaction_sampler": "rate_limiting", "transaction_sample_rules": "name:GET /*=0.5", "transaction_sample_rate": "0.5"}
+	tracer.updateRemoteConfig(nil, old, attrs)
+	assert.True(t, sampler == tracer.instrumentationConfig().sampler)
+
+	old = attrs
+	attrs = map[string]string{"transaction_sampler": "rate_limiting", "transaction_sample_rules": "name:GET /*=0.25", "transaction_sample_rate": "0.5"}
+	tracer.updateRemoteConfig(nil, old, attrs)
+	assert.False(t, sampler == tracer.instrumentationConfig().sampler)
+}
+
+func TestSameSamplerRules(t *testing.T) {
+	a, err := parseSampleRules(envTransactionSampleRules, "name:GET /*=0.5,type:request=0.1")
+	require.NoError(t, err)
+	b, err := parseSampleRules(envTransactionSampleRules, "name:GET /*=0.5,type:request=0.1")
+	require.NoError(t, err)
+	assert.True(t, sameSamplerRules(a, b))
+	assert.True(t, sameSamplerRules(nil, []SamplerRule{}))
+	assert.False(t, sameSamplerRules(a, b[:1]))
+
+	b[1].TransactionType = "messaging"
+	assert.False(t, sameSamplerRules(a, b))
+
+	custom := []SamplerRule{{TransactionName: "GET /*", Sampler: NewRateLimitingSampler(1)}}
+	assert.False(t, sameSamplerRules(custom, custom))
+}
@@ -18,6 +18,7 @@
 package atatus // import "go.atatus.com/agent"
 
 import (
+	"context"
 	cryptorand "crypto/rand"
 	"encoding/binary"
 	"strings"
@@ -102,6 +103,7 @@ func (tx *Transaction) StartSpanOptions(name, spanType string, opts SpanOptions)
 	span := tx.tracer.startSpan(name, spanType, transactionID, opts)
 	span.tx = tx
 	span.parent = opts.parent
+	span.transactionName = tx.Name
 	if opts.ExitSpan {
 		span.exit = true
 	}
@@ -128,6 +130,13 @@ func (tx *Transaction) StartSpanOptions(name, spanType string, opts SpanOptions)
 		span.compressedSpan.options = tx.compressedSpan.options
 		span.exitSpanMinDuration = tx.exitSpanMinDuration
 		tx.spansCreated++
+		if tx.tracer.cpuProfilingActive() {
+			parentLabels := tx.profileLabels
+			if span.parent != nil && !span.parent.ended() && span.parent.profileLabels != nil {
+				parentLabels = span.parent.profileLabels
+			}
+			span.setProfileLabels(opts.ctx, parentLabels, tx.Name)
+		}
 	}
 
 	if tx.breakdownMetricsEnabled {
@@ -183,6 +192,9 @@ func (t *Tracer) StartSpan(name, spanType string, transactionID SpanID, opts Spa
 	if opts.ExitSpan {
 		span.exit = true
 	}
+	if t.cpuProfilingActive() {
+		span.setProfileLabels(opts.ctx, nil, "")
+	}
 
 	return span
 }
@@ -206,6 +218,11 @@ type SpanOptions struct {
 	// callers of Transaction.StartSpanOptions.
 	parent *Span
 
+	// ctx, if non-nil, holds the context in which the span is started,
+	// whose pprof labels are kept on the goroutine while the span is
+	// active. It is set by StartSpanOptions.
+	ctx context.Context
+
 	// Start is the start time of the span. If this has the zero value,
 	// time.Now() will be used instead.
 	//
@@ -338,6 +355,11 @@ func (s *Span) End() {
 	if s.ended() {
 		return
 	}
+	if s.profileLabels != nil {
+		// Restore the goroutine's pprof labels to
+		// those in place before the span started.
+		s.profileLabels.restore()
+	}
 	if s.exit && !s.Context.setDestinationServiceCalled {
 		// The span was created as an exit span, but the user did not
 		// manually set the destination.service.resource
@@ -373,6 +395,7 @@ func (s *Span) End() {
 			s.tx.TransactionData.mu.Lock()
 			defer s.tx.TransactionData.mu.Unlock()
 			s.reportSelfTime()
+			s.transactionName = s.tx.Name
 		}
 	}
 
@@ -573,6 +596,31 @@ type SpanData struct {
 	mu            sync.Mutex
 	stacktrace    []stacktrace.Frame
 	errorCaptured bool
+
+	// profileLabels holds the pprof labels set on the goroutine
+	// that started the span, if the CPU profiler was active.
+	profileLabels *goroutineProfileLabels
+
+	// transactionName holds the name of the span's transaction when
+	// the span ended, or started if the transaction ended first, for
+	// applying the transaction name patterns received with hostinfo.
+	transactionName string
+}
+
+// setProfileLabels sets the current goroutine's pprof labels to
+// identify the span and its transaction, adding to the labels of
+// ctx and parent. The goroutine's labels are restored when the
+// span ends.
+func (s *Span) setProfileLabels(ctx context.Context, parent *goroutineProfileLabels, transactionName string) {
+	labels := make([]string, 0, 6)
+	if transactionName != "" {
+		labels = append(labels, profileLabelTransactionName, transactionName)
+	}
+	labels = append(labels,
+		profileLabelTransactionID, s.transactionID.String(),
+		profileLabelSpanID, s.traceContext.Span.String(),
+	)
+	s.profileLabels = setGoroutineProfileLabels(ctx, parent, labels...)
 }
 
 func (s *SpanData) setStacktrace(skip int) {
@@ -336,6 +336,36 @@ func (e *TraceStateEntry) validateValue() error {
 	return nil
 }
 
+// withAtatusSampleRate returns a copy of s with the Atatus ("at")
+// entry replaced by one recording sampleRate, preserving the other
+// vendors' entries.
+func (s TraceState) withAtatusSampleRate(sampleRate float64) TraceState {
+	entries := []TraceStateEntry{{
+		Key:   atatusTracestateVendorKey,
+		Value: formatAtatusTracestateValue(sampleRate),
+	}}
+	return NewTraceState(append(entries, s.otherEntries()...)...)
+}
+
+// withoutAtatusEntry returns a copy of s without the Atatus ("at") entry.
+func (s TraceState) withoutAtatusEntry() TraceState {
+	if s.head == nil || s.head.Key != atatusTracestateVendorKey {
+		return s
+	}
+	return NewTraceState(s.otherEntries()...)
+}
+
+// otherEntries returns the entries of s other than the Atatus ("at") entry.
+func (s TraceState) otherEntries() []TraceStateEntry {
+	var entries []TraceStateEntry
+	for e := s.head; e != nil; e = e.next {
+		if e.Key != atatusTracestateVendorKey {
+			entries = append(entries, TraceStateEntry{Key: e.Key, Value: e.Value})
+		}
+	}
+	return entries
+}
+
 func formatAtatusTracestateValue(sampleRate float64) string {
 	// 0       -> "s:0"
 	// 1       -> "s:1"
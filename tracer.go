@@ -25,6 +25,7 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -87,6 +88,14 @@ type TracerOptions struct {
 	// the default notify host will be used.
 	NotifyHost string
 
+	// NotifyProxy holds the URL of the proxy through which aggregated
+	// data is sent to the Atatus notify host.
+	//
+	// If NotifyProxy is empty, the proxy will be defined using the
+	// ATATUS_NOTIFY_PROXY environment variable, or if that is not set,
+	// the HTTPS_PROXY or HTTP_PROXY environment variables.
+	NotifyProxy string
+
 	// Analytics holds the APM Analytics Flag.
 	//
 	// If Analytics is empty, the API Analytics will be defined using the
@@ -103,8 +112,23 @@ type TracerOptions struct {
 	//
 	// If TraceThreshold is empty, the TraceThreshold will be defined using the
 	// ATATUS_TRACE_THRESHOLD environment variable.
+	//
+	// Traces of faster transactions are also retained if the transaction has
+	// an error, or a 4xx or 5xx HTTP status code other than 404, unless
+	// disabled by setting the ATATUS_TRACE_ERRORS or ATATUS_TRACE_HTTP_FAILURES
+	// environment variables to false, or if a span exceeds the threshold for
+	// its kind defined by the ATATUS_TRACE_SPAN_THRESHOLDS environment
+	// variable, e.g. "db=500ms".
 	TraceThreshold int
 
+	// NotifyInterval holds the interval at which aggregated transactions,
+	// traces, errors and metrics are sent to Atatus.
+	//
+	// If NotifyInterval is zero, the interval will be defined using the
+	// ATATUS_NOTIFY_INTERVAL environment variable, or if that is not set,
+	// defaults to 60 seconds.
+	NotifyInterval time.Duration
+
 	// ServiceName holds the service name.
 	//
 	// If ServiceName is empty, the service name will be defined using the
@@ -133,14 +157,116 @@ type TracerOptions struct {
 	// the environment variable ATATUS_CENTRAL_CONFIG=false.
 	Transport transport.Transport
 
+	// PayloadSink holds the sink to use for the aggregated payloads
+	// sent to Atatus: transactions, traces, errors, HTTP failures,
+	// metrics and analytics.
+	//
+	// If PayloadSink is nil, payloads will be written locally if an export
+	// mode is set, and will otherwise be sent to NotifyHost over HTTP.
+	PayloadSink PayloadSink
+
+	// ExportMode, if non-empty, selects a local exporter for the aggregated
+	// payloads in place of NotifyHost: "file" writes them to ExportFile, and
+	// "stdout" writes them to standard output. Payloads are written as
+	// newline-delimited JSON records, tagged with their endpoint path.
+	//
+	// If ExportMode is empty, the export mode will be defined using the
+	// ATATUS_EXPORT_MODE environment variable. ExportMode is ignored if
+	// PayloadSink is non-nil.
+	ExportMode string
+
+	// ExportFile holds the path of the file written in the "file" export
+	// mode. The file is rotated when it would exceed the size defined by
+	// ATATUS_EXPORT_FILE_MAX_SIZE, keeping the three most recent files.
+	//
+	// If ExportFile is empty, the file will be defined using the
+	// ATATUS_EXPORT_FILE environment variable, or "atatus-export.ndjson"
+	// if that is unset.
+	ExportFile string
+
+	// OTLPEndpoint holds the base URL of an OTLP/HTTP endpoint, such as an
+	// OpenTelemetry Collector, to which transactions and spans are exported
+	// as traces, errors as logs, and metrics as gauges. In the "otlp" export
+	// mode, telemetry is exported to the endpoint in place of NotifyHost;
+	// otherwise it is exported alongside NotifyHost if OTLPEndpoint is set.
+	//
+	// If OTLPEndpoint is empty, the endpoint will be defined using the
+	// ATATUS_OTLP_ENDPOINT environment variable, or in the "otlp" export
+	// mode, "http://localhost:4318" if that is unset. Requests are encoded
+	// as defined by ATATUS_OTLP_PROTOCOL, "http/protobuf" by default, or
+	// "http/json", and include the headers defined by ATATUS_OTLP_HEADERS.
+	OTLPEndpoint string
+
+	// MaxErrors holds the maximum number of errors sent to Atatus
+	// in each notify interval.
+	//
+	// If MaxErrors is zero, the limit will be defined using the
+	// ATATUS_MAX_ERRORS environment variable, or if that is not set,
+	// defaults to 20.
+	MaxErrors int
+
+	// MaxErrorRequests holds the maximum number of failed HTTP requests
+	// sampled in each notify interval.
+	//
+	// If MaxErrorRequests is zero, the limit will be defined using the
+	// ATATUS_MAX_ERROR_REQUESTS environment variable, or if that is not
+	// set, defaults to 20.
+	MaxErrorRequests int
+
+	// MaxTraces holds the maximum number of traces sent to Atatus in
+	// each notify interval. The slowest trace of each transaction is
+	// kept first.
+	//
+	// If MaxTraces is zero, the limit will be defined using the
+	// ATATUS_MAX_TRACES environment variable, or if that is not set,
+	// defaults to 5.
+	MaxTraces int
+
+	// MaxSecondaryTraces holds the maximum number of additional traces
+	// kept for transactions that already have a trace, used to fill up
+	// to MaxTraces.
+	//
+	// If MaxSecondaryTraces is zero, the limit will be defined using the
+	// ATATUS_MAX_SECONDARY_TRACES environment variable, or if that is not
+	// set, defaults to 4.
+	MaxSecondaryTraces int
+
+	// MaxAnalyticsEvents holds the maximum number of analytics events
+	// sent to Atatus in each notify interval.
+	//
+	// If MaxAnalyticsEvents is zero, the limit will be defined using the
+	// ATATUS_MAX_ANALYTICS_EVENTS environment variable, or if that is not
+	// set, defaults to 10000.
+	MaxAnalyticsEvents int
+
+	// MaxAnalyticsPayloadSize holds the maximum size in bytes of each
+	// analytics payload. Analytics events exceeding this size are sent
+	// in multiple payloads.
+	//
+	// If MaxAnalyticsPayloadSize is zero, the size will be defined using
+	// the ATATUS_MAX_ANALYTICS_PAYLOAD_SIZE environment variable, or if
+	// that is not set, defaults to 6MB.
+	MaxAnalyticsPayloadSize int
+
+	// MaxMetrics holds the maximum number of metrics sets gathered in
+	// each notify interval that are sent to Atatus, in addition to the
+	// agent's own metrics.
+	//
+	// If MaxMetrics is zero, the limit will be defined using the
+	// ATATUS_MAX_METRICS environment variable, or if that is not set,
+	// defaults to 20.
+	MaxMetrics int
+
 	requestDuration       time.Duration
 	metricsInterval       time.Duration
 	maxSpans              int
 	requestSize           int
 	bufferSize            int
 	metricsBufferSize     int
-	sampler               Sampler
+	samplerConfig         samplerConfig
+	parentSampling        parentSamplingPolicies
 	sanitizedFieldNames   wildcard.Matchers
+	baggageToLabels       wildcard.Matchers
 	disabledMetrics       wildcard.Matchers
 	ignoreTransactionURLs wildcard.Matchers
 	captureHeaders        bool
@@ -152,12 +278,14 @@ type TracerOptions struct {
 	configWatcher         apmconfig.Watcher
 	breakdownMetrics      bool
 	propagateLegacyHeader bool
+	propagators           []string
 	profileSender         profileSender
-	cpuProfileInterval    time.Duration
-	cpuProfileDuration    time.Duration
-	heapProfileInterval   time.Duration
+	profiling             profilingConfig
 	exitSpanMinDuration   time.Duration
 	compressionOptions    compressionOptions
+	batchLimits           batchLimits
+	aggregatorOptions     aggregatorOptions
+	otlpExporter          *otlpExporter
 }
 
 // initDefaults updates opts with default values.
@@ -220,11 +348,14 @@ func (opts *TracerOptions) initDefaults(continueOnError bool) error {
 		spanCompressionSameKindMaxDuration = defaultSpanCompressionSameKindMaxDuration
 	}
 
-	sampler, err := initialSampler()
+	samplerConfig, err := initialSamplerConfig()
 	if failed(err) {
-		sampler = nil
+		samplerConfig = defaultSamplerConfig
 	}
 
+	parentSampling, err := initialParentSampling()
+	failed(err)
+
 	captureHeaders, err := initialCaptureHeaders()
 	if failed(err) {
 		captureHeaders = defaultCaptureHeaders
@@ -271,14 +402,34 @@ func (opts *TracerOptions) initDefaults(continueOnError bool) error {
 		propagateLegacyHeader = true
 	}
 
-	cpuProfileInterval, cpuProfileDuration, err := initialCPUProfileIntervalDuration()
+	propagators, err := initialPropagators()
 	if failed(err) {
-		cpuProfileInterval = 0
-		cpuProfileDuration = 0
+		propagators = defaultPropagators
 	}
-	heapProfileInterval, err := initialHeapProfileInterval()
+
+	var profiling profilingConfig
+	profiling.cpuInterval, profiling.cpuDuration, err = initialCPUProfileIntervalDuration()
+	if failed(err) {
+		profiling.cpuInterval = 0
+		profiling.cpuDuration = 0
+	}
+	profiling.heapInterval, err = initialHeapProfileInterval()
 	if failed(err) {
-		heapProfileInterval = 0
+		profiling.heapInterval = 0
+	}
+	profiling.goroutineInterval, err = initialGoroutineProfileInterval()
+	if failed(err) {
+		profiling.goroutineInterval = 0
+	}
+	profiling.mutexInterval, profiling.mutexDuration, err = initialMutexProfileIntervalDuration()
+	if failed(err) {
+		profiling.mutexInterval = 0
+		profiling.mutexDuration = 0
+	}
+	profiling.blockInterval, profiling.blockDuration, err = initialBlockProfileIntervalDuration()
+	if failed(err) {
+		profiling.blockInterval = 0
+		profiling.blockDuration = 0
 	}
 
 	exitSpanMinDuration, err := initialExitSpanMinDuration()
@@ -286,6 +437,135 @@ func (opts *TracerOptions) initDefaults(continueOnError bool) error {
 		exitSpanMinDuration = defaultExitSpanMinDuration
 	}
 
+	notifyRetryQueueSize, err := initialNotifyRetryQueueSize()
+	if failed(err) {
+		notifyRetryQueueSize = defaultNotifyRetryQueueSize
+	}
+
+	notifySpoolMaxSize, err := initialNotifySpoolMaxSize()
+	if failed(err) {
+		notifySpoolMaxSize = defaultNotifySpoolMaxSize.Bytes()
+	}
+
+	notifySpoolMaxAge, err := initialNotifySpoolMaxAge()
+	if failed(err) {
+		notifySpoolMaxAge = defaultNotifySpoolMaxAge
+	}
+
+	notifyCompression, err := initialNotifyCompression()
+	if failed(err) {
+		notifyCompression = defaultNotifyCompression
+	}
+
+	notifyCompressionMinSize, err := initialNotifyCompressionMinSize()
+	if failed(err) {
+		notifyCompressionMinSize = int(defaultNotifyCompressionMinSize)
+	}
+
+	batchLimits := batchLimits{
+		errors:               opts.MaxErrors,
+		errorRequests:        opts.MaxErrorRequests,
+		traces:               opts.MaxTraces,
+		secondaryTraces:      opts.MaxSecondaryTraces,
+		analyticsEvents:      opts.MaxAnalyticsEvents,
+		analyticsPayloadSize: opts.MaxAnalyticsPayloadSize,
+		metrics:              opts.MaxMetrics,
+	}
+	if batchLimits.errors <= 0 {
+		batchLimits.errors, err = initialMaxErrors()
+		if failed(err) {
+			batchLimits.errors = defaultMaxErrors
+		}
+	}
+	if batchLimits.errorRequests <= 0 {
+		batchLimits.errorRequests, err = initialMaxErrorRequests()
+		if failed(err) {
+			batchLimits.errorRequests = defaultMaxErrorRequests
+		}
+	}
+	if batchLimits.traces <= 0 {
+		batchLimits.traces, err = initialMaxTraces()
+		if failed(err) {
+			batchLimits.traces = defaultMaxTraces
+		}
+	}
+	if batchLimits.secondaryTraces <= 0 {
+		batchLimits.secondaryTraces, err = initialMaxSecondaryTraces()
+		if failed(err) {
+			batchLimits.secondaryTraces = defaultMaxSecondaryTraces
+		}
+	}
+	if batchLimits.analyticsEvents <= 0 {
+		batchLimits.analyticsEvents, err = initialMaxAnalyticsEvents()
+		if failed(err) {
+			batchLimits.analyticsEvents = defaultMaxAnalyticsEvents
+		}
+	}
+	if batchLimits.analyticsPayloadSize <= 0 {
+		batchLimits.analyticsPayloadSize, err = initialMaxAnalyticsPayloadSize()
+		if failed(err) {
+			batchLimits.analyticsPayloadSize = int(defaultMaxAnalyticsPayloadSize)
+		}
+	}
+	if batchLimits.metrics <= 0 {
+		batchLimits.metrics, err = initialMaxMetrics()
+		if failed(err) {
+			batchLimits.metrics = defaultMaxMetrics
+		}
+	}
+
+	var exportMode string
+	if opts.ExportMode != "" {
+		exportMode, err = parseExportMode(opts.ExportMode)
+	} else {
+		exportMode, err = initialExportMode()
+	}
+	failed(err)
+
+	exportFileMaxSize, err := initialExportFileMaxSize()
+	if failed(err) {
+		exportFileMaxSize = defaultExportFileMaxSize.Bytes()
+	}
+
+	otlpEndpoint := opts.OTLPEndpoint
+	if otlpEndpoint == "" {
+		otlpEndpoint = initialOTLPEndpoint()
+	}
+	if otlpEndpoint == "" && exportMode == exportModeOTLP {
+		otlpEndpoint = defaultOTLPEndpoint
+	}
+	if opts.NotifyProxy == "" {
+		opts.NotifyProxy = initialNotifyProxy()
+	}
+
+	var otlpExporter *otlpExporter
+	if otlpEndpoint != "" {
+		otlpProtocol, err := initialOTLPProtocol()
+		if failed(err) {
+			otlpProtocol = defaultOTLPProtocol
+		}
+		otlpHeaders, err := initialOTLPHeaders()
+		failed(err)
+		exporter, err := newOTLPExporter(otlpEndpoint, otlpProtocol, otlpHeaders, opts.NotifyProxy)
+		if !failed(err) {
+			otlpExporter = exporter
+		}
+	}
+
+	payloadSink := opts.PayloadSink
+	if payloadSink == nil && exportMode == exportModeOTLP {
+		payloadSink = discardPayloadSink{}
+	} else if payloadSink == nil && exportMode != "" {
+		exportFile := opts.ExportFile
+		if exportFile == "" {
+			exportFile = initialExportFile()
+		}
+		sink, err := newExportPayloadSink(exportMode, exportFile, exportFileMaxSize)
+		if !failed(err) {
+			payloadSink = sink
+		}
+	}
+
 	if opts.ServiceName != "" {
 		err := validateServiceName(opts.ServiceName)
 		if failed(err) {
@@ -294,6 +574,9 @@ func (opts *TracerOptions) initDefaults(continueOnError bool) error {
 	}
 
 	if len(errs) != 0 && !continueOnError {
+		if sink, ok := payloadSink.(*exportPayloadSink); ok {
+			sink.close()
+		}
 		return errs[0]
 	}
 	for _, err := range errs {
@@ -311,8 +594,10 @@ func (opts *TracerOptions) initDefaults(continueOnError bool) error {
 		exactMatchMaxDuration: spanCompressionExactMatchMaxDuration,
 		sameKindMaxDuration:   spanCompressionSameKindMaxDuration,
 	}
-	opts.sampler = sampler
+	opts.samplerConfig = samplerConfig
+	opts.parentSampling = parentSampling
 	opts.sanitizedFieldNames = initialSanitizedFieldNames()
+	opts.baggageToLabels = initialBaggageToLabels()
 	opts.disabledMetrics = initialDisabledMetrics()
 	opts.ignoreTransactionURLs = initialIgnoreTransactionURLs()
 	opts.breakdownMetrics = breakdownMetricsEnabled
@@ -323,7 +608,19 @@ func (opts *TracerOptions) initDefaults(continueOnError bool) error {
 	opts.active = active
 	opts.recording = recording
 	opts.propagateLegacyHeader = propagateLegacyHeader
+	opts.propagators = propagators
 	opts.exitSpanMinDuration = exitSpanMinDuration
+	opts.batchLimits = batchLimits
+	opts.otlpExporter = otlpExporter
+	opts.aggregatorOptions = aggregatorOptions{
+		retryQueueSize:  notifyRetryQueueSize,
+		spoolDir:        initialNotifySpoolDir(),
+		spoolMaxSize:    notifySpoolMaxSize,
+		spoolMaxAge:     notifySpoolMaxAge,
+		compress:        notifyCompression,
+		compressMinSize: notifyCompressionMinSize,
+		sink:            payloadSink,
+	}
 	if opts.Transport == nil {
 		opts.Transport = transport.Default
 	}
@@ -334,9 +631,7 @@ func (opts *TracerOptions) initDefaults(continueOnError bool) error {
 	}
 	if ps, ok := opts.Transport.(profileSender); ok {
 		opts.profileSender = ps
-		opts.cpuProfileInterval = cpuProfileInterval
-		opts.cpuProfileDuration = cpuProfileDuration
-		opts.heapProfileInterval = heapProfileInterval
+		opts.profiling = profiling
 	}
 
 	serviceName, serviceVersion, serviceEnvironment := initialService()
@@ -385,6 +680,20 @@ func (opts *TracerOptions) initDefaults(continueOnError bool) error {
 
 	opts.TraceThreshold = traceThreshold
 
+	rules, err := initialTraceRules()
+	if failed(err) {
+		rules = traceRules{errors: defaultTraceErrors, httpFailures: defaultTraceHTTPFailures}
+	}
+	opts.aggregatorOptions.traceRules = rules
+
+	if opts.NotifyInterval <= 0 {
+		notifyInterval, err := initialNotifyInterval()
+		if failed(err) {
+			notifyInterval = defaultNotifyInterval
+		}
+		opts.NotifyInterval = notifyInterval
+	}
+
 	opts.Transport.SetNotifyURL(opts.NotifyHost, opts.LicenseKey, opts.ServiceName, AgentVersion) // at_handling send stream
 
 	return nil
@@ -406,6 +715,7 @@ type tracerService struct {
 	Tracing        bool
 	TraceThreshold int
 	NotifyHost     string
+	NotifyProxy    string
 }
 
 // Tracer manages the sampling and sending of transactions to
@@ -436,6 +746,7 @@ type Tracer struct {
 	system  *model.System
 
 	active            int32
+	cpuProfiling      int32
 	bufferSize        int
 	metricsBufferSize int
 	closing           chan struct{}
@@ -447,6 +758,8 @@ type Tracer struct {
 	events            chan tracerEvent
 	breakdownMetrics  *breakdownMetrics
 	profileSender     profileSender
+	aggregatorOptions aggregatorOptions
+	otlp              *otlpExporter
 
 	// stats is heap-allocated to ensure correct alignment for atomic access.
 	stats *TracerStats
@@ -514,15 +827,22 @@ func newTracer(opts TracerOptions) *Tracer {
 		bufferSize:        opts.bufferSize,
 		metricsBufferSize: opts.metricsBufferSize,
 		profileSender:     opts.profileSender,
+		aggregatorOptions: opts.aggregatorOptions,
+		otlp:              opts.otlpExporter,
 		instrumentationConfigInternal: &instrumentationConfig{
 			local: make(map[string]func(*instrumentationConfigValues)),
 		},
 	}
+	t.aggregatorOptions.stats = t.stats
+	t.aggregatorOptions.limits = func() batchLimits {
+		return t.instrumentationConfig().batchLimits
+	}
 	t.Service.AppName = opts.ServiceName
 	t.Service.AppVersion = opts.ServiceVersion
 	t.Service.Environment = opts.ServiceEnvironment
 	t.Service.LicenseKey = opts.LicenseKey
 	t.Service.NotifyHost = opts.NotifyHost
+	t.Service.NotifyProxy = opts.NotifyProxy
 	t.Service.Analytics = opts.Analytics
 	t.Service.Tracing = opts.Tracing
 	t.Service.TraceThreshold = opts.TraceThreshold
@@ -551,8 +871,36 @@ func newTracer(opts TracerOptions) *Tracer {
 		cfg.compressionOptions.sameKindMaxDuration = opts.compressionOptions.sameKindMaxDuration
 	})
 	t.setLocalInstrumentationConfig(envTransactionSampleRate, func(cfg *instrumentationConfigValues) {
-		cfg.sampler = opts.sampler
-		cfg.extendedSampler, _ = opts.sampler.(ExtendedSampler)
+		cfg.setSamplerConfig(func(c *samplerConfig) {
+			c.custom = false
+			c.rate = opts.samplerConfig.rate
+		})
+	})
+	t.setLocalInstrumentationConfig(envTransactionSampler, func(cfg *instrumentationConfigValues) {
+		cfg.setSamplerConfig(func(c *samplerConfig) {
+			c.kind = opts.samplerConfig.kind
+		})
+	})
+	t.setLocalInstrumentationConfig(envTransactionSampleTarget, func(cfg *instrumentationConfigValues) {
+		cfg.setSamplerConfig(func(c *samplerConfig) {
+			c.target = opts.samplerConfig.target
+		})
+	})
+	t.setLocalInstrumentationConfig(envTransactionSampleInterval, func(cfg *instrumentationConfigValues) {
+		cfg.setSamplerConfig(func(c *samplerConfig) {
+			c.interval = opts.samplerConfig.interval
+		})
+	})
+	t.setLocalInstrumentationConfig(envTransactionSampleRules, func(cfg *instrumentationConfigValues) {
+		cfg.setSamplerConfig(func(c *samplerConfig) {
+			c.rules = opts.samplerConfig.rules
+		})
+	})
+	t.setLocalInstrumentationConfig(envParentSampling, func(cfg *instrumentationConfigValues) {
+		cfg.parentSampling.trusted = opts.parentSampling.trusted
+	})
+	t.setLocalInstrumentationConfig(envUntrustedParentSampling, func(cfg *instrumentationConfigValues) {
+		cfg.parentSampling.untrusted = opts.parentSampling.untrusted
 	})
 	t.setLocalInstrumentationConfig(envSpanFramesMinDuration, func(cfg *instrumentationConfigValues) {
 		cfg.spanFramesMinDuration = opts.spanFramesMinDuration
@@ -563,15 +911,66 @@ func newTracer(opts TracerOptions) *Tracer {
 	t.setLocalInstrumentationConfig(envUseAtatusTraceparentHeader, func(cfg *instrumentationConfigValues) {
 		cfg.propagateLegacyHeader = opts.propagateLegacyHeader
 	})
+	t.setLocalInstrumentationConfig(envPropagators, func(cfg *instrumentationConfigValues) {
+		cfg.propagators = opts.propagators
+	})
 	t.setLocalInstrumentationConfig(envSanitizeFieldNames, func(cfg *instrumentationConfigValues) {
 		cfg.sanitizedFieldNames = opts.sanitizedFieldNames
 	})
+	t.setLocalInstrumentationConfig(envBaggageToLabels, func(cfg *instrumentationConfigValues) {
+		cfg.baggageToLabels = opts.baggageToLabels
+	})
 	t.setLocalInstrumentationConfig(envIgnoreURLs, func(cfg *instrumentationConfigValues) {
 		cfg.ignoreTransactionURLs = opts.ignoreTransactionURLs
 	})
 	t.setLocalInstrumentationConfig(envExitSpanMinDuration, func(cfg *instrumentationConfigValues) {
 		cfg.exitSpanMinDuration = opts.exitSpanMinDuration
 	})
+	t.setLocalInstrumentationConfig(envMaxErrors, func(cfg *instrumentationConfigValues) {
+		cfg.batchLimits.errors = opts.batchLimits.errors
+	})
+	t.setLocalInstrumentationConfig(envMaxErrorRequests, func(cfg *instrumentationConfigValues) {
+		cfg.batchLimits.errorRequests = opts.batchLimits.errorRequests
+	})
+	t.setLocalInstrumentationConfig(envMaxTraces, func(cfg *instrumentationConfigValues) {
+		cfg.batchLimits.traces = opts.batchLimits.traces
+	})
+	t.setLocalInstrumentationConfig(envMaxSecondaryTraces, func(cfg *instrumentationConfigValues) {
+		cfg.batchLimits.secondaryTraces = opts.batchLimits.secondaryTraces
+	})
+	t.setLocalInstrumentationConfig(envMaxAnalyticsEvents, func(cfg *instrumentationConfigValues) {
+		cfg.batchLimits.analyticsEvents = opts.batchLimits.analyticsEvents
+	})
+	t.setLocalInstrumentationConfig(envMaxAnalyticsPayloadSize, func(cfg *instrumentationConfigValues) {
+		cfg.batchLimits.analyticsPayloadSize = opts.batchLimits.analyticsPayloadSize
+	})
+	t.setLocalInstrumentationConfig(envMaxMetrics, func(cfg *instrumentationConfigValues) {
+		cfg.batchLimits.metrics = opts.batchLimits.metrics
+	})
+	t.setLocalInstrumentationConfig(envCPUProfileInterval, func(cfg *instrumentationConfigValues) {
+		cfg.profiling.cpuInterval = opts.profiling.cpuInterval
+	})
+	t.setLocalInstrumentationConfig(envCPUProfileDuration, func(cfg *instrumentationConfigValues) {
+		cfg.profiling.cpuDuration = opts.profiling.cpuDuration
+	})
+	t.setLocalInstrumentationConfig(envHeapProfileInterval, func(cfg *instrumentationConfigValues) {
+		cfg.profiling.heapInterval = opts.profiling.heapInterval
+	})
+	t.setLocalInstrumentationConfig(envGoroutineProfileInterval, func(cfg *instrumentationConfigValues) {
+		cfg.profiling.goroutineInterval = opts.profiling.goroutineInterval
+	})
+	t.setLocalInstrumentationConfig(envMutexProfileInterval, func(cfg *instrumentationConfigValues) {
+		cfg.profiling.mutexInterval = opts.profiling.mutexInterval
+	})
+	t.setLocalInstrumentationConfig(envMutexProfileDuration, func(cfg *instrumentationConfigValues) {
+		cfg.profiling.mutexDuration = opts.profiling.mutexDuration
+	})
+	t.setLocalInstrumentationConfig(envBlockProfileInterval, func(cfg *instrumentationConfigValues) {
+		cfg.profiling.blockInterval = opts.profiling.blockInterval
+	})
+	t.setLocalInstrumentationConfig(envBlockProfileDuration, func(cfg *instrumentationConfigValues) {
+		cfg.profiling.blockDuration = opts.profiling.blockDuration
+	})
 	if apmlog.DefaultLogger != nil {
 		defaultLogLevel := apmlog.DefaultLogger.Level()
 		t.setLocalInstrumentationConfig(apmlog.EnvLogLevel, func(cfg *instrumentationConfigValues) {
@@ -590,10 +989,9 @@ func newTracer(opts TracerOptions) *Tracer {
 	go t.loop()
 	t.configCommands <- func(cfg *tracerConfig) {
 		cfg.recording = opts.recording
-		cfg.cpuProfileInterval = opts.cpuProfileInterval
-		cfg.cpuProfileDuration = opts.cpuProfileDuration
-		cfg.heapProfileInterval = opts.heapProfileInterval
+		cfg.profiling = opts.profiling
 		cfg.metricsInterval = opts.metricsInterval
+		cfg.notifyInterval = opts.NotifyInterval
 		cfg.requestDuration = opts.requestDuration
 		cfg.requestSize = opts.requestSize
 		cfg.disabledMetrics = opts.disabledMetrics
@@ -617,20 +1015,21 @@ type tracerConfig struct {
 	requestSize             int
 	requestDuration         time.Duration
 	metricsInterval         time.Duration
+	notifyInterval          time.Duration
 	logger                  WarningLogger
 	metricsGatherers        []MetricsGatherer
 	contextSetter           stacktrace.ContextSetter
 	preContext, postContext int
 	disabledMetrics         wildcard.Matchers
-	cpuProfileDuration      time.Duration
-	cpuProfileInterval      time.Duration
-	heapProfileInterval     time.Duration
+	profiling               profilingConfig
 }
 
 type tracerConfigCommand func(*tracerConfig)
 
 // Close closes the Tracer, preventing transactions from being
-// sent to the APM server.
+// sent to the APM server. Any transactions, traces, errors and
+// metrics aggregated since the last flush are sent before Close
+// returns.
 func (t *Tracer) Close() {
 	select {
 	case <-t.closing:
@@ -642,7 +1041,8 @@ func (t *Tracer) Close() {
 
 // Flush waits for the Tracer to flush any transactions and errors it currently
 // has queued to the APM server, the tracer is stopped, or the abort channel
-// is signaled.
+// is signaled. This includes the aggregated transactions, traces, errors and
+// metrics that would otherwise be sent at the end of the current interval.
 func (t *Tracer) Flush(abort <-chan struct{}) {
 	flushed := make(chan struct{}, 1)
 	select {
@@ -671,6 +1071,12 @@ func (t *Tracer) Active() bool {
 	return atomic.LoadInt32(&t.active) == 1
 }
 
+// cpuProfilingActive reports whether the CPU profiler is currently
+// running, in which case transactions and spans set pprof labels.
+func (t *Tracer) cpuProfilingActive() bool {
+	return atomic.LoadInt32(&t.cpuProfiling) == 1
+}
+
 // ShouldPropagateLegacyHeader reports whether instrumentation should
 // propagate the legacy "Atatus-Apm-Traceparent" header in addition to
 // the standard W3C "traceparent" header.
@@ -681,6 +1087,35 @@ func (t *Tracer) ShouldPropagateLegacyHeader() bool {
 	return t.instrumentationConfig().propagateLegacyHeader
 }
 
+// Propagators returns the names of the trace context propagation
+// formats that instrumentation should use for injecting trace context
+// into outgoing requests, and extracting it from incoming requests.
+// See SetPropagators for the supported formats.
+func (t *Tracer) Propagators() []string {
+	return t.instrumentationConfig().propagators
+}
+
+// SetPropagators sets the trace context propagation formats that
+// instrumentation should use: any of "tracecontext" (W3C Trace Context),
+// "b3" (Zipkin B3 single header), "b3multi" (Zipkin B3 multiple headers),
+// and "jaeger" (Jaeger uber-trace-id). All formats are injected into
+// outgoing requests; trace context is extracted from incoming requests
+// using the first format found, in the order given.
+//
+// Configuration via Kibana takes precedence over local configuration, so
+// if propagators has been configured via Kibana, this call will not have
+// any effect until/unless that configuration has been removed.
+func (t *Tracer) SetPropagators(names ...string) error {
+	propagators, err := parsePropagators("propagators", strings.Join(names, ","))
+	if err != nil {
+		return err
+	}
+	t.setLocalInstrumentationConfig(envPropagators, func(cfg *instrumentationConfigValues) {
+		cfg.propagators = propagators
+	})
+	return nil
+}
+
 // SetRequestDuration sets the maximum amount of time to keep a request open
 // to the APM server for streaming data before closing the stream and starting
 // a new request.
@@ -698,6 +1133,19 @@ func (t *Tracer) SetMetricsInterval(d time.Duration) {
 	})
 }
 
+// SetNotifyInterval sets the notify interval -- the amount of time in
+// between aggregated transactions, traces, errors and metrics being sent
+// to Atatus. If d is not positive, the default interval of 60 seconds is
+// used.
+func (t *Tracer) SetNotifyInterval(d time.Duration) {
+	if d <= 0 {
+		d = defaultNotifyInterval
+	}
+	t.sendConfigCommand(func(cfg *tracerConfig) {
+		cfg.notifyInterval = d
+	})
+}
+
 // SetContextSetter sets the stacktrace.ContextSetter to be used for
 // setting stacktrace source context. If nil (which is the initial
 // value), no context will be set.
@@ -745,6 +1193,28 @@ func (t *Tracer) SetSanitizedFieldNames(patterns ...string) error {
 	return nil
 }
 
+// SetBaggageToLabels sets the wildcard patterns that will be used to
+// match the keys of baggage received with incoming requests. Matching
+// baggage members will be recorded as labels on the transaction. If
+// SetBaggageToLabels is called with no arguments, then no baggage will
+// be recorded.
+//
+// Configuration via Kibana takes precedence over local configuration, so
+// if baggage_to_labels has been configured via Kibana, this call will
+// not have any effect until/unless that configuration has been removed.
+func (t *Tracer) SetBaggageToLabels(patterns ...string) {
+	var matchers wildcard.Matchers
+	if len(patterns) != 0 {
+		matchers = make(wildcard.Matchers, len(patterns))
+		for i, p := range patterns {
+			matchers[i] = configutil.ParseWildcardPattern(p)
+		}
+	}
+	t.setLocalInstrumentationConfig(envBaggageToLabels, func(cfg *instrumentationConfigValues) {
+		cfg.baggageToLabels = matchers
+	})
+}
+
 // SetIgnoreTransactionURLs sets the wildcard patterns that will be used to
 // ignore transactions with matching URLs.
 func (t *Tracer) SetIgnoreTransactionURLs(pattern string) error {
@@ -827,13 +1297,38 @@ func (t *Tracer) SetRecording(r bool) {
 //
 // It is valid to pass nil, in which case all transactions will be sampled.
 //
+// The sampler replaces the sampler kind, target and interval, whether set
+// with the ATATUS_TRANSACTION_SAMPLER, ATATUS_TRANSACTION_SAMPLE_TARGET and
+// ATATUS_TRANSACTION_SAMPLE_INTERVAL environment variables or via central
+// configuration, which have no effect while it is in use. Sample rules
+// still apply, falling back to the sampler for unmatched transactions.
+//
 // Configuration via Kibana takes precedence over local configuration, so
-// if sampling has been configured via Kibana, this call will not have any
-// effect until/unless that configuration has been removed.
+// if the sample rate has been configured via Kibana, this call will not
+// have any effect until/unless that configuration has been removed.
 func (t *Tracer) SetSampler(s Sampler) {
 	t.setLocalInstrumentationConfig(envTransactionSampleRate, func(cfg *instrumentationConfigValues) {
-		cfg.sampler = s
-		cfg.extendedSampler, _ = s.(ExtendedSampler)
+		cfg.setSamplerConfig(func(c *samplerConfig) {
+			c.custom = true
+			c.sampler = s
+		})
+	})
+}
+
+// SetParentSamplingPolicy sets the sampling policies for transactions
+// continuing a trace started by another service: untrusted applies if
+// TransactionOptions.UntrustedTraceContext is true, and trusted applies
+// otherwise.
+//
+// Configuration via Kibana takes precedence over local configuration, so
+// if the policies have been configured via Kibana, this call will not have
+// any effect until/unless that configuration has been removed.
+func (t *Tracer) SetParentSamplingPolicy(trusted, untrusted ParentSamplingPolicy) {
+	t.setLocalInstrumentationConfig(envParentSampling, func(cfg *instrumentationConfigValues) {
+		cfg.parentSampling.trusted = trusted
+	})
+	t.setLocalInstrumentationConfig(envUntrustedParentSampling, func(cfg *instrumentationConfigValues) {
+		cfg.parentSampling.untrusted = untrusted
 	})
 }
 
@@ -931,9 +1426,20 @@ func (t *Tracer) Stats() TracerStats {
 	return t.stats.copy()
 }
 
+// signalFlushed signals each of the channels passed to Tracer.Flush,
+// which are buffered so the sends do not block.
+func signalFlushed(flushed []chan<- struct{}) {
+	for _, ch := range flushed {
+		ch <- struct{}{}
+	}
+}
+
 func (t *Tracer) loop() {
 
-	agg := newAggregator(&t.Service)
+	agg := newAggregator(&t.Service, t.aggregatorOptions)
+	if t.otlp != nil {
+		go t.otlp.run(makeService(t.Service.AppName, t.Service.AppVersion, t.Service.Environment), t.system)
+	}
 
 	ctx, cancelContext := context.WithCancel(context.Background())
 	defer cancelContext()
@@ -944,7 +1450,7 @@ func (t *Tracer) loop() {
 	var requestBuf bytes.Buffer
 	var metadata []byte
 	var gracePeriod time.Duration = -1
-	var flushed chan<- struct{}
+	var flushed []chan<- struct{}
 	var requestBufTransactions, requestBufSpans, requestBufErrors, requestBufMetricsets uint64
 	zlibWriter, _ := zlib.NewWriterLevel(&requestBuf, zlib.BestSpeed)
 	zlibFlushed := true
@@ -979,7 +1485,7 @@ func (t *Tracer) loop() {
 				case <-ctx.Done():
 				}
 			}
-			if agg.features.tracing == true {
+			if agg.currentFeatures().tracing == true {
 				t.Transport.SetNotifyURL(t.Service.NotifyHost, t.Service.LicenseKey, t.Service.AppName, AgentVersion) // at_handling send stream
 				requestResult <- t.Transport.SendStream(ctx, iochanReader)
 			} else {
@@ -1011,8 +1517,11 @@ func (t *Tracer) loop() {
 		}
 	}()
 
-	cpuProfilingState := newCPUProfilingState(t.profileSender)
+	cpuProfilingState := newCPUProfilingState(t.profileSender, &t.cpuProfiling)
 	heapProfilingState := newHeapProfilingState(t.profileSender)
+	goroutineProfilingState := newGoroutineProfilingState(t.profileSender)
+	mutexProfilingState := newMutexProfilingState(t.profileSender)
+	blockProfilingState := newBlockProfilingState(t.profileSender)
 
 	var cfg tracerConfig
 	buffer := ringbuffer.New(t.bufferSize)
@@ -1033,24 +1542,96 @@ func (t *Tracer) loop() {
 		stats:         &stats,
 	}
 
-	agg.setModelWriter(&modelWriter) // at_handling send stream
+	// aggFlushing holds the channels of Flush calls waiting for the
+	// aggregator flush in progress, and aggFlushQueued those of calls
+	// made while it was in progress, which wait for the next flush so
+	// that it includes their events.
+	var aggFlushing, aggFlushQueued []chan<- struct{}
+	aggFlushed := make(chan struct{}, 1)
+	otlpFlushed := make(chan struct{}, 1)
+	requestAggFlush := func() {
+		if t.otlp != nil {
+			t.otlp.requestFlush(otlpFlushed)
+			return
+		}
+		agg.requestFlush(aggFlushed)
+	}
+	// forwardEvent writes the event to the stream, if enabled, and then
+	// forwards it to the aggregator, which resets it once processed. The
+	// stream is written here as the ring buffer is owned by the loop,
+	// and the event is converted for the OTLP exporter, if any, before
+	// the aggregator can reset it. Events ignored by the patterns
+	// received with hostinfo are neither streamed nor exported.
+	forwardEvent := func(event tracerEvent) {
+		var ignored bool
+		switch event.eventType {
+		case transactionEvent:
+			ignored = agg.hostinfoPatterns().ignoreTxn(event.tx.TransactionData.Name)
+		case spanEvent:
+			ignored = agg.hostinfoPatterns().ignoreTxn(event.span.transactionName)
+		case errorEvent:
+			ignored = agg.ignoreError(event.err)
+		}
+		streaming := agg.streaming() && !ignored
+		if t.otlp != nil && !ignored {
+			modelWriter.exportOTLP(t.otlp, event)
+		}
+		switch event.eventType {
+		case transactionEvent:
+			if !t.breakdownMetrics.recordTransaction(event.tx.TransactionData) {
+				if !breakdownMetricsLimitWarningLogged && cfg.logger != nil {
+					cfg.logger.Warningf("%s", breakdownMetricsLimitWarning)
+					breakdownMetricsLimitWarningLogged = true
+				}
+			}
+			if streaming {
+				modelWriter.writeTransaction(event.tx.Transaction, event.tx.TransactionData) // at_handling send stream
+			}
+			agg.c.txnChan <- event
+		case spanEvent:
+			if streaming && event.span.transactionID.Validate() == nil {
+				modelWriter.writeSpan(event.span.Span, event.span.SpanData) // at_handling send stream
+			}
+			agg.c.spanChan <- event
+		case errorEvent:
+			if streaming {
+				modelWriter.writeError(event.err) // at_handling send stream
+			}
+			agg.c.errChan <- event
+		}
+	}
 
 	handleTracerConfigCommand := func(cmd tracerConfigCommand) {
 		var oldMetricsInterval time.Duration
 		if cfg.recording {
 			oldMetricsInterval = cfg.metricsInterval
 		}
+		oldNotifyInterval := cfg.notifyInterval
 		cmd(&cfg)
-		var metricsInterval, cpuProfileInterval, cpuProfileDuration, heapProfileInterval time.Duration
+		if cfg.notifyInterval != oldNotifyInterval {
+			agg.setNotifyInterval(cfg.notifyInterval)
+		}
+		var metricsInterval time.Duration
+		var profiling profilingConfig
 		if cfg.recording {
 			metricsInterval = cfg.metricsInterval
-			cpuProfileInterval = cfg.cpuProfileInterval
-			cpuProfileDuration = cfg.cpuProfileDuration
-			heapProfileInterval = cfg.heapProfileInterval
+			profiling = cfg.profiling
+		}
+		if profiling.cpuDuration <= 0 {
+			profiling.cpuInterval = 0
+		}
+		if profiling.mutexDuration <= 0 {
+			profiling.mutexInterval = 0
+		}
+		if profiling.blockDuration <= 0 {
+			profiling.blockInterval = 0
 		}
 
-		cpuProfilingState.updateConfig(cpuProfileInterval, cpuProfileDuration)
-		heapProfilingState.updateConfig(heapProfileInterval, 0)
+		cpuProfilingState.updateConfig(profiling.cpuInterval, profiling.cpuDuration)
+		heapProfilingState.updateConfig(profiling.heapInterval, 0)
+		goroutineProfilingState.updateConfig(profiling.goroutineInterval, 0)
+		mutexProfilingState.updateConfig(profiling.mutexInterval, profiling.mutexDuration)
+		blockProfilingState.updateConfig(profiling.blockInterval, profiling.blockDuration)
 		if !gatheringMetrics && metricsInterval != oldMetricsInterval {
 			if metricsTimerStart.IsZero() {
 				if metricsInterval > 0 {
@@ -1081,6 +1662,15 @@ func (t *Tracer) loop() {
 		case <-t.closing:
 			cancelContext() // informs transport that EOF is expected
 			iochanReader.CloseRead(io.EOF)
+			// Hand any queued events over to the aggregator,
+			// and wait for it to send its final batch.
+			for n := len(t.events); n > 0; n-- {
+				forwardEvent(<-t.events)
+			}
+			agg.close()
+			if t.otlp != nil {
+				t.otlp.close()
+			}
 			return
 		case cmd := <-t.configCommands:
 			handleTracerConfigCommand(cmd)
@@ -1121,29 +1711,15 @@ func (t *Tracer) loop() {
 				t.updateRemoteConfig(cfg.logger, lastConfigChange, change.Attrs)
 				lastConfigChange = change.Attrs
 				handleTracerConfigCommand(func(cfg *tracerConfig) {
-					cfg.recording = t.instrumentationConfig().recording
+					instrumentationConfig := t.instrumentationConfig()
+					cfg.recording = instrumentationConfig.recording
+					cfg.profiling = instrumentationConfig.profiling
 				})
 			}
 			continue
 		case event := <-t.events:
-			switch event.eventType {
-			case transactionEvent:
-				agg.c.txnChan <- event
-				if !t.breakdownMetrics.recordTransaction(event.tx.TransactionData) {
-					if !breakdownMetricsLimitWarningLogged && cfg.logger != nil {
-						cfg.logger.Warningf("%s", breakdownMetricsLimitWarning)
-						breakdownMetricsLimitWarningLogged = true
-					}
-				}
-				// modelWriter.writeTransaction(event.tx.Transaction, event.tx.TransactionData)
-			case spanEvent:
-				agg.c.spanChan <- event
-				// modelWriter.writeSpan(event.span.Span, event.span.SpanData)
-			case errorEvent:
-				// var out model.Error
-				// modelWriter.buildModelError(&out, event.err)
-				agg.c.errChan <- event
-				// modelWriter.writeError(event.err)
+			forwardEvent(event)
+			if event.eventType == errorEvent {
 				// Flush the buffer to transmit the error immediately.
 				flushRequest = true
 			}
@@ -1164,9 +1740,18 @@ func (t *Tracer) loop() {
 				gatherMetrics = !gatheringMetrics
 			}
 		case <-gatheredMetrics:
+			if t.otlp != nil {
+				t.otlp.addMetrics(&metrics)
+			}
 			agg.c.metricsChan <- &metrics
 			// modelWriter.writeMetrics(&metrics)
 			gatheringMetrics = false
+			if sentMetrics != nil {
+				// Metrics are sent by the aggregator, so SendMetrics
+				// returns once they have been queued for it.
+				sentMetrics <- struct{}{}
+				sentMetrics = nil
+			}
 			flushRequest = true
 			if cfg.recording && cfg.metricsInterval > 0 {
 				metricsTimerStart = time.Now()
@@ -1175,32 +1760,52 @@ func (t *Tracer) loop() {
 		case <-cpuProfilingState.timer.C:
 			cpuProfilingState.start(ctx, cfg.logger, t.metadataReader())
 		case <-cpuProfilingState.finished:
-			cpuProfilingState.resetTimer()
+			cpuProfilingState.finish()
 		case <-heapProfilingState.timer.C:
 			heapProfilingState.start(ctx, cfg.logger, t.metadataReader())
 		case <-heapProfilingState.finished:
-			heapProfilingState.resetTimer()
-		case flushed = <-t.forceFlush:
-			// Drain any objects buffered in the channels.
+			heapProfilingState.finish()
+		case <-goroutineProfilingState.timer.C:
+			goroutineProfilingState.start(ctx, cfg.logger, t.metadataReader())
+		case <-goroutineProfilingState.finished:
+			goroutineProfilingState.finish()
+		case <-mutexProfilingState.timer.C:
+			mutexProfilingState.start(ctx, cfg.logger, t.metadataReader())
+		case <-mutexProfilingState.finished:
+			mutexProfilingState.finish()
+		case <-blockProfilingState.timer.C:
+			blockProfilingState.start(ctx, cfg.logger, t.metadataReader())
+		case <-blockProfilingState.finished:
+			blockProfilingState.finish()
+		case flush := <-t.forceFlush:
+			// Drain any objects buffered in the channels, and have
+			// the aggregator send its current batch before flushing
+			// the stream, which the aggregator writes to.
 			for n := len(t.events); n > 0; n-- {
-				event := <-t.events
-				switch event.eventType {
-				case transactionEvent:
-					if !t.breakdownMetrics.recordTransaction(event.tx.TransactionData) {
-						if !breakdownMetricsLimitWarningLogged && cfg.logger != nil {
-							cfg.logger.Warningf("%s", breakdownMetricsLimitWarning)
-							breakdownMetricsLimitWarningLogged = true
-						}
-					}
-					modelWriter.writeTransaction(event.tx.Transaction, event.tx.TransactionData)
-				case spanEvent:
-					modelWriter.writeSpan(event.span.Span, event.span.SpanData)
-				case errorEvent:
-					modelWriter.writeError(event.err)
-				}
+				forwardEvent(<-t.events)
+			}
+			if aggFlushing != nil {
+				aggFlushQueued = append(aggFlushQueued, flush)
+				continue
+			}
+			aggFlushing = []chan<- struct{}{flush}
+			requestAggFlush()
+			continue
+		case <-otlpFlushed:
+			agg.requestFlush(aggFlushed)
+			continue
+		case <-aggFlushed:
+			flushed = append(flushed, aggFlushing...)
+			aggFlushing, aggFlushQueued = aggFlushQueued, nil
+			if aggFlushing != nil {
+				requestAggFlush()
+			}
+			if len(flushed) == 0 {
+				continue
 			}
 			if !requestActive && buffer.Len() == 0 && metricsBuffer.Len() == 0 {
-				flushed <- struct{}{}
+				signalFlushed(flushed)
+				flushed = nil
 				continue
 			}
 			closeRequest = true
@@ -1247,10 +1852,8 @@ func (t *Tracer) loop() {
 				sentMetrics <- struct{}{}
 				sentMetrics = nil
 			}
-			if flushed != nil {
-				flushed <- struct{}{}
-				flushed = nil
-			}
+			signalFlushed(flushed)
+			flushed = nil
 			if req.Buf != nil {
 				// req will be canceled by CloseRead below.
 				req.Buf = nil
@@ -17,7 +17,10 @@
 
 package atatus // import "go.atatus.com/agent"
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+	"time"
+)
 
 // TracerStats holds statistics for a Tracer.
 type TracerStats struct {
@@ -28,6 +31,7 @@ type TracerStats struct {
 	TransactionsDropped uint64
 	SpansSent           uint64
 	SpansDropped        uint64
+	Aggregator          TracerStatsAggregator
 }
 
 // TracerStatsErrors holds error statistics for a Tracer.
@@ -36,6 +40,111 @@ type TracerStatsErrors struct {
 	SendStream uint64
 }
 
+// TracerStatsAggregator holds statistics for the payloads
+// aggregated by a Tracer and sent to Atatus.
+type TracerStatsAggregator struct {
+	// ErrorsDropped, ErrorRequestsDropped, AnalyticsDropped and
+	// MetricsDropped count the errors, failed HTTP requests, request
+	// analytics and metrics gathers dropped on reaching the limits
+	// of a single flush.
+	ErrorsDropped        uint64
+	ErrorRequestsDropped uint64
+	AnalyticsDropped     uint64
+	MetricsDropped       uint64
+
+	// BytesSent holds the total size of the payloads sent,
+	// after compression.
+	BytesSent uint64
+
+	// LastFlushDuration holds the time taken by the most recent flush.
+	LastFlushDuration time.Duration
+
+	// Payloads holds the number of payloads sent and failed
+	// for each endpoint.
+	Payloads TracerStatsPayloads
+}
+
+// TracerStatsPayloads holds payload statistics
+// for each of the Atatus endpoints.
+type TracerStatsPayloads struct {
+	Hostinfo     TracerStatsPayload
+	Transactions TracerStatsPayload
+	Traces       TracerStatsPayload
+	Errors       TracerStatsPayload
+	ErrorMetrics TracerStatsPayload
+	Metrics      TracerStatsPayload
+	Analytics    TracerStatsPayload
+}
+
+// TracerStatsPayload holds the number of payloads sent to an endpoint,
+// and the number that failed with an error or an error response.
+type TracerStatsPayload struct {
+	Sent   uint64
+	Failed uint64
+}
+
+// kind returns the statistics for payloads of the given kind.
+func (s *TracerStatsPayloads) kind(kind PayloadKind) *TracerStatsPayload {
+	switch kind {
+	case PayloadHostinfo:
+		return &s.Hostinfo
+	case PayloadTransaction:
+		return &s.Transactions
+	case PayloadTrace:
+		return &s.Traces
+	case PayloadError:
+		return &s.Errors
+	case PayloadErrorMetric:
+		return &s.ErrorMetrics
+	case PayloadMetric:
+		return &s.Metrics
+	case PayloadAnalytics:
+		return &s.Analytics
+	}
+	return nil
+}
+
+// total returns the sum of the statistics for each endpoint.
+func (s TracerStatsPayloads) total() TracerStatsPayload {
+	var total TracerStatsPayload
+	for _, p := range []TracerStatsPayload{
+		s.Hostinfo, s.Transactions, s.Traces, s.Errors,
+		s.ErrorMetrics, s.Metrics, s.Analytics,
+	} {
+		total.Sent += p.Sent
+		total.Failed += p.Failed
+	}
+	return total
+}
+
+func (s *TracerStatsPayload) copy() TracerStatsPayload {
+	return TracerStatsPayload{
+		Sent:   atomic.LoadUint64(&s.Sent),
+		Failed: atomic.LoadUint64(&s.Failed),
+	}
+}
+
+// copy returns a copy of the most recent aggregator stats.
+func (s *TracerStatsAggregator) copy() TracerStatsAggregator {
+	return TracerStatsAggregator{
+		ErrorsDropped:        atomic.LoadUint64(&s.ErrorsDropped),
+		ErrorRequestsDropped: atomic.LoadUint64(&s.ErrorRequestsDropped),
+		AnalyticsDropped:     atomic.LoadUint64(&s.AnalyticsDropped),
+		MetricsDropped:       atomic.LoadUint64(&s.MetricsDropped),
+		BytesSent:            atomic.LoadUint64(&s.BytesSent),
+		LastFlushDuration:    time.Duration(atomic.LoadInt64((*int64)(&s.LastFlushDuration))),
+		Payloads: TracerStatsPayloads{
+			Hostinfo:     s.Payloads.Hostinfo.copy(),
+			Transactions: s.Payloads.Transactions.copy(),
+			Traces:       s.Payloads.Traces.copy(),
+			Errors:       s.Payloads.Errors.copy(),
+			ErrorMetrics: s.Payloads.ErrorMetrics.copy(),
+			Metrics:      s.Payloads.Metrics.copy(),
+			Analytics:    s.Payloads.Analytics.copy(),
+		},
+	}
+}
+
 func (s TracerStats) isZero() bool {
 	return s == TracerStats{}
 }
@@ -66,5 +175,6 @@ func (s *TracerStats) copy() TracerStats {
 		TransactionsDropped: atomic.LoadUint64(&s.TransactionsDropped),
 		SpansSent:           atomic.LoadUint64(&s.SpansSent),
 		SpansDropped:        atomic.LoadUint64(&s.SpansDropped),
+		Aggregator:          s.Aggregator.copy(),
 	}
 }
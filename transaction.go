@@ -18,6 +18,7 @@
 package atatus // import "go.atatus.com/agent"
 
 import (
+	"context"
 	cryptorand "crypto/rand"
 	"encoding/binary"
 	"math/rand"
@@ -75,6 +76,7 @@ func (t *Tracer) StartTransactionOptions(name, transactionType string, opts Tran
 	tx.stackTraceLimit = instrumentationConfig.stackTraceLimit
 	tx.Context.captureHeaders = instrumentationConfig.captureHeaders
 	tx.propagateLegacyHeader = instrumentationConfig.propagateLegacyHeader
+	tx.propagators = instrumentationConfig.propagators
 	tx.Context.sanitizedFieldNames = instrumentationConfig.sanitizedFieldNames
 	tx.breakdownMetricsEnabled = t.breakdownMetrics.enabled
 
@@ -107,40 +109,34 @@ func (t *Tracer) StartTransactionOptions(name, transactionType string, opts Tran
 	}
 
 	if root {
-		var result SampleResult
-		if instrumentationConfig.extendedSampler != nil {
-			result = instrumentationConfig.extendedSampler.SampleExtended(SampleParams{
-				TraceContext: tx.traceContext,
-			})
-			if !result.Sampled {
-				// Special case: for unsampled transactions we
-				// report a sample rate of 0, so that we do not
-				// count them in aggregations in the server.
-				// This is necessary to avoid overcounting, as
-				// we will scale the sampled transactions.
-				result.SampleRate = 0
-			}
-			sampleRate := roundSampleRate(result.SampleRate)
-			tx.traceContext.State = NewTraceState(TraceStateEntry{
-				Key:   atatusTracestateVendorKey,
-				Value: formatAtatusTracestateValue(sampleRate),
-			})
-		} else if instrumentationConfig.sampler != nil {
-			result.Sampled = instrumentationConfig.sampler.Sample(tx.traceContext)
-		} else {
-			result.Sampled = true
+		tx.sample(instrumentationConfig, name, transactionType)
+	} else {
+		policy := instrumentationConfig.parentSampling.trusted
+		if opts.UntrustedTraceContext {
+			policy = instrumentationConfig.parentSampling.untrusted
 		}
-		if result.Sampled {
-			o := tx.traceContext.Options.WithRecorded(true)
-			tx.traceContext.Options = o
+		switch policy {
+		case ParentSamplingAlways:
+			tx.traceContext.Options = opts.TraceContext.Options.WithRecorded(true)
+			tx.traceContext.State = tx.traceContext.State.withAtatusSampleRate(1)
+		case ParentSamplingResample:
+			tx.traceContext.Options = opts.TraceContext.Options.WithRecorded(false)
+			tx.sample(instrumentationConfig, name, transactionType)
+		default:
+			// The parent's sampling decision is honoured. Services
+			// receiving requests from untrusted origins should use
+			// another policy, so they cannot be forced into sampling
+			// every request.
+			tx.traceContext.Options = opts.TraceContext.Options
+		}
+	}
+
+	if len(instrumentationConfig.baggageToLabels) != 0 {
+		for _, m := range opts.Baggage.members {
+			if instrumentationConfig.baggageToLabels.MatchAny(m.Key) {
+				tx.Context.SetLabel(m.Key, m.Value)
+			}
 		}
-	} else {
-		// TODO(axw) make this behaviour configurable. In some cases
-		// it may not be a good idea to honour the recorded flag, as
-		// it may open up the application to DoS by forced sampling.
-		// Even ignoring bad actors, a service that has many feeder
-		// applications may end up being sampled at a very high rate.
-		tx.traceContext.Options = opts.TraceContext.Options
 	}
 
 	tx.Name = name
@@ -149,6 +145,12 @@ func (t *Tracer) StartTransactionOptions(name, transactionType string, opts Tran
 	if tx.timestamp.IsZero() {
 		tx.timestamp = time.Now()
 	}
+	if t.cpuProfilingActive() {
+		tx.profileLabels = setGoroutineProfileLabels(opts.Context, nil,
+			profileLabelTransactionName, name,
+			profileLabelTransactionID, tx.traceContext.Span.String(),
+		)
+	}
 	return tx
 }
 
@@ -158,13 +160,31 @@ type TransactionOptions struct {
 	// zero, a new trace will be started.
 	TraceContext TraceContext
 
+	// UntrustedTraceContext records whether TraceContext was received from
+	// an untrusted origin, such as an external client of a public service.
+	// The tracer's untrusted parent sampling policy applies to transactions
+	// continuing such a trace, in place of the trusted policy.
+	UntrustedTraceContext bool
+
 	// TransactionID holds the ID to assign to the transaction. If this is
 	// zero, a new ID will be generated and used instead.
 	TransactionID SpanID
 
+	// Baggage holds the baggage received with the request which the
+	// transaction is handling, if any. Members with keys matching the
+	// tracer's baggage-to-labels patterns will be recorded as labels on
+	// the transaction.
+	Baggage Baggage
+
 	// Start is the start time of the transaction. If this has the
 	// zero value, time.Now() will be used instead.
 	Start time.Time
+
+	// Context holds the context in which the transaction is started, if
+	// any. While the CPU profiler is active, the pprof labels of Context,
+	// such as those added by pprof.Do, are kept on the goroutine along
+	// with those identifying the transaction.
+	Context context.Context
 }
 
 // Transaction describes an event occurring in the monitored service.
@@ -180,6 +200,42 @@ type Transaction struct {
 	*TransactionData
 }
 
+// sample makes the sampling decision for the transaction with the
+// tracer's Sampler, recording the sample rate in the trace state if
+// the Sampler is an ExtendedSampler.
+func (tx *Transaction) sample(cfg *instrumentationConfig, name, transactionType string) {
+	var result SampleResult
+	if cfg.extendedSampler != nil {
+		result = cfg.extendedSampler.SampleExtended(SampleParams{
+			TraceContext:    tx.traceContext,
+			TransactionName: name,
+			TransactionType: transactionType,
+		})
+		if !result.Sampled {
+			// Special case: for unsampled transactions we
+			// report a sample rate of 0, so that we do not
+			// count them in aggregations in the server.
+			// This is necessary to avoid overcounting, as
+			// we will scale the sampled transactions.
+			result.SampleRate = 0
+		}
+		sampleRate := roundSampleRate(result.SampleRate)
+		tx.traceContext.State = tx.traceContext.State.withAtatusSampleRate(sampleRate)
+	} else if cfg.sampler != nil {
+		result.Sampled = cfg.sampler.Sample(tx.traceContext)
+		// The sample rate is unknown, so any
+		// rate from a parent is discarded.
+		tx.traceContext.State = tx.traceContext.State.withoutAtatusEntry()
+	} else {
+		result.Sampled = true
+		tx.traceContext.State = tx.traceContext.State.withoutAtatusEntry()
+	}
+	if result.Sampled {
+		o := tx.traceContext.Options.WithRecorded(true)
+		tx.traceContext.Options = o
+	}
+}
+
 // Sampled reports whether or not the transaction is sampled.
 func (tx *Transaction) Sampled() bool {
 	if tx == nil {
@@ -214,6 +270,18 @@ func (tx *Transaction) ShouldPropagateLegacyHeader() bool {
 	return tx.propagateLegacyHeader
 }
 
+// Propagators returns the names of the trace context propagation
+// formats that instrumentation should use for injecting the trace
+// context of tx into outgoing requests. See Tracer.SetPropagators.
+func (tx *Transaction) Propagators() []string {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.ended() {
+		return nil
+	}
+	return tx.propagators
+}
+
 // EnsureParent returns the span ID for for tx's parent, generating a
 // parent span ID if one has not already been set and tx has not been
 // ended. If tx is nil or has been ended, a zero (invalid) SpanID is
@@ -264,6 +332,7 @@ func (tx *Transaction) Discard() {
 	if tx.ended() {
 		return
 	}
+	tx.clearProfileLabels()
 	tx.reset(tx.tracer)
 	tx.TransactionData = nil
 }
@@ -281,6 +350,7 @@ func (tx *Transaction) End() {
 	if tx.ended() {
 		return
 	}
+	tx.clearProfileLabels()
 	if tx.recording {
 		if tx.Duration < 0 {
 			tx.Duration = time.Since(tx.timestamp)
@@ -309,6 +379,16 @@ func (tx *Transaction) End() {
 	tx.TransactionData = nil
 }
 
+// clearProfileLabels restores the pprof labels the current goroutine
+// had before the transaction started, if the transaction set any.
+//
+// This must be called with tx.mu held.
+func (tx *Transaction) clearProfileLabels() {
+	if tx.profileLabels != nil {
+		tx.profileLabels.restore()
+	}
+}
+
 func (tx *Transaction) enqueue() {
 	event := tracerEvent{eventType: transactionEvent}
 	event.tx.Transaction = tx
@@ -374,8 +454,13 @@ type TransactionData struct {
 	stackTraceLimit         int
 	breakdownMetricsEnabled bool
 	propagateLegacyHeader   bool
+	propagators             []string
 	timestamp               time.Time
 
+	// profileLabels holds the pprof labels set on the goroutine
+	// that started the transaction, if the CPU profiler was active.
+	profileLabels *goroutineProfileLabels
+
 	mu                sync.Mutex
 	errorCaptured     bool
 	spansCreated      int
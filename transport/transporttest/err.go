@@ -52,3 +52,8 @@ func (t ErrorTransport) SendStream(ctx context.Context, r io.Reader) error {
 		return ctx.Err()
 	}
 }
+
+// SetNotifyURL returns nil.
+func (t ErrorTransport) SetNotifyURL(notifyHost, licenseKey, appName, agentVersion string) error {
+	return nil
+}
@@ -69,6 +69,11 @@ func (r *RecorderTransport) SendStream(ctx context.Context, stream io.Reader) er
 	return r.record(ctx, stream)
 }
 
+// SetNotifyURL returns nil; the transport does not send to a notify host.
+func (r *RecorderTransport) SetNotifyURL(notifyHost, licenseKey, appName, agentVersion string) error {
+	return nil
+}
+
 // SendProfile records the stream such that it can later be obtained via Payloads.
 func (r *RecorderTransport) SendProfile(ctx context.Context, metadata io.Reader, profiles ...io.Reader) error {
 	return r.recordProto(ctx, metadata, profiles)